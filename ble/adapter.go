@@ -1,6 +1,7 @@
 package ble
 
 import (
+	"context"
 	"log"
 
 	"github.com/godbus/dbus"
@@ -15,11 +16,11 @@ import (
 //
 // RemoveDevice removes the specified device and its pairing information.
 //
-// SetDiscoveryFilter sets the discovery filter to require
-// LE transport and the given UUIDs.
+// SetDiscoveryFilter sets the discovery filter to the given filter keys,
+// requiring LE transport unless another transport is specified.
 //
-// Discover performs discovery for a device with the given UUIDs,
-// for at most the specified timeout, or indefinitely if timeout is 0.
+// Discover performs discovery for a device matching the given filter,
+// until a value is received on the stop channel or the context is cancelled.
 // See also the Discover method of the ObjectCache type.
 type Adapter interface {
 	BaseObject
@@ -27,8 +28,8 @@ type Adapter interface {
 	StartDiscovery() error
 	StopDiscovery() error
 	RemoveDevice(*Device) error
-	SetDiscoveryFilter(uuids ...string) error
-	Discover(sigChannel chan<- *dbus.Signal, stopDiscoveryChannel <-chan bool, uuids ...string)
+	SetDiscoveryFilter(filter DiscoveryFilter) error
+	Discover(ctx context.Context, sigChannel chan<- *dbus.Signal, stopDiscoveryChannel <-chan bool, filter DiscoveryFilter)
 
 	Address() string //The Bluetooth device address - readonly
 	Alias() string   //The Bluetooth friendly name - readwrite
@@ -0,0 +1,173 @@
+package ble
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/prop"
+)
+
+//Advertisement types accepted by the LEAdvertisement1 Type property
+const (
+	AdvertisementBroadcast  = "broadcast"
+	AdvertisementPeripheral = "peripheral"
+)
+
+// Advertisement holds the properties of an org.bluez.LEAdvertisement1 object.
+// Zero values are not sent to BlueZ.
+// See bluez/doc/advertising-api.txt
+type Advertisement struct {
+	Type             string            //"broadcast" or "peripheral"
+	ServiceUUIDs     []string          //Service UUIDs to include in the advertisement
+	ManufacturerData map[uint16][]byte //Manufacturer data keyed by company identifier
+	ServiceData      map[string][]byte //Service data keyed by service UUID
+	LocalName        string            //Local name to include in the advertisement
+	Includes         []string          //System provided data to include, ex. tx-power
+	Timeout          uint16            //Seconds the advertisement is broadcast for. 0 advertises until unregistered
+	MinInterval      uint32            //Minimum advertising interval in milliseconds - BlueZ 5.64+ experimental
+	MaxInterval      uint32            //Maximum advertising interval in milliseconds - BlueZ 5.64+ experimental
+	TxPower          *int16            //Requested transmit power in dBm - BlueZ 5.64+ experimental
+}
+
+// AdvertisingLimits reports the advertising capabilities of the controller.
+type AdvertisingLimits struct {
+	ActiveInstances    uint8    `json:"activeInstances"`
+	SupportedInstances uint8    `json:"supportedInstances"`
+	SupportedIncludes  []string `json:"supportedIncludes"`
+}
+
+// AdvertisementInstance is an advertisement registered with the
+// org.bluez.LEAdvertisingManager1 interface of an adapter.
+type AdvertisementInstance struct {
+	app      *application
+	manager  *blob
+	released func()
+}
+
+// Release is called by BlueZ when the advertisement is removed, for example
+// once its Timeout has elapsed.
+func (instance *AdvertisementInstance) Release() *dbus.Error {
+	log.Printf("%s: advertisement released", instance.app.path)
+	instance.app.unexport()
+	if instance.released != nil {
+		go instance.released()
+	}
+	return nil
+}
+
+// GetAdvertisingLimits returns the number of active and supported advertisement instances.
+func (conn *Connection) GetAdvertisingLimits() (AdvertisingLimits, error) {
+	limits := AdvertisingLimits{SupportedIncludes: []string{}}
+	manager, err := conn.findObject(LEAdvertisingManagerInterface, func(_ *blob) bool { return true })
+	if err != nil {
+		return limits, err
+	}
+
+	limits.ActiveInstances, _ = manager.properties["ActiveInstances"].Value().(uint8)
+	limits.SupportedInstances, _ = manager.properties["SupportedInstances"].Value().(uint8)
+	if includes, ok := manager.properties["SupportedIncludes"].Value().([]string); ok {
+		limits.SupportedIncludes = includes
+	}
+	return limits, nil
+}
+
+// RegisterAdvertisement exports the advertisement at path and registers it with
+// the adapter. released is invoked, in its own goroutine, when BlueZ removes the advertisement.
+func (conn *Connection) RegisterAdvertisement(path dbus.ObjectPath, advertisement Advertisement, released func()) (*AdvertisementInstance, error) {
+	manager, err := conn.findObject(LEAdvertisingManagerInterface, func(_ *blob) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := newApplication(conn, path)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &AdvertisementInstance{
+		app:      app,
+		manager:  manager,
+		released: released,
+	}
+
+	err = app.export(path,
+		map[string]interface{}{LEAdvertisementInterface: instance},
+		prop.Map{LEAdvertisementInterface: advertisement.properties()})
+	if err != nil {
+		app.unexport()
+		return nil, err
+	}
+
+	log.Printf("%s: registering advertisement %s", manager.Path(), path)
+	if err := manager.call("RegisterAdvertisement", path, Properties{}); err != nil {
+		app.unexport()
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Unregister stops the advertisement and removes it from the bus.
+func (instance *AdvertisementInstance) Unregister() error {
+	log.Printf("%s: unregistering advertisement %s", instance.manager.Path(), instance.app.path)
+	err := instance.manager.call("UnregisterAdvertisement", instance.app.path)
+	instance.app.unexport()
+	return err
+}
+
+// Path returns the D-Bus path the advertisement is exported at.
+func (instance *AdvertisementInstance) Path() dbus.ObjectPath {
+	return instance.app.path
+}
+
+func (advertisement Advertisement) properties() map[string]*prop.Prop {
+	advType := advertisement.Type
+	if advType == "" {
+		advType = AdvertisementBroadcast
+	}
+
+	props := map[string]*prop.Prop{
+		"Type": {Value: advType, Emit: prop.EmitConst},
+	}
+	if len(advertisement.ServiceUUIDs) > 0 {
+		props["ServiceUUIDs"] = &prop.Prop{Value: advertisement.ServiceUUIDs, Emit: prop.EmitConst}
+	}
+	if len(advertisement.ManufacturerData) > 0 {
+		manData := make(map[uint16]dbus.Variant)
+		for id, data := range advertisement.ManufacturerData {
+			manData[id] = dbus.MakeVariant(data)
+		}
+		props[BluezManufacturerData] = &prop.Prop{Value: manData, Emit: prop.EmitConst}
+	}
+	if len(advertisement.ServiceData) > 0 {
+		servData := make(map[string]dbus.Variant)
+		for uuid, data := range advertisement.ServiceData {
+			servData[uuid] = dbus.MakeVariant(data)
+		}
+		props[BluezServiceData] = &prop.Prop{Value: servData, Emit: prop.EmitConst}
+	}
+	if advertisement.LocalName != "" {
+		props["LocalName"] = &prop.Prop{Value: advertisement.LocalName, Emit: prop.EmitConst}
+	}
+	if len(advertisement.Includes) > 0 {
+		props["Includes"] = &prop.Prop{Value: advertisement.Includes, Emit: prop.EmitConst}
+	}
+	if advertisement.Timeout > 0 {
+		props["Timeout"] = &prop.Prop{Value: advertisement.Timeout, Emit: prop.EmitConst}
+	}
+	if advertisement.MinInterval > 0 {
+		props["MinInterval"] = &prop.Prop{Value: advertisement.MinInterval, Emit: prop.EmitConst}
+	}
+	if advertisement.MaxInterval > 0 {
+		props["MaxInterval"] = &prop.Prop{Value: advertisement.MaxInterval, Emit: prop.EmitConst}
+	}
+	if advertisement.TxPower != nil {
+		props[BluezTxPower] = &prop.Prop{Value: *advertisement.TxPower, Emit: prop.EmitConst}
+	}
+	return props
+}
+
+// String returns a description of the advertising limits.
+func (limits AdvertisingLimits) String() string {
+	return fmt.Sprintf("%d of %d advertisement instances active", limits.ActiveInstances, limits.SupportedInstances)
+}
@@ -0,0 +1,121 @@
+package ble
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/prop"
+)
+
+// application is a tree of D-Bus objects exported by this process and
+// registered with BlueZ (advertisement monitors, GATT services, etc.).
+// BlueZ discovers the objects through the org.freedesktop.DBus.ObjectManager
+// interface exported at the root path of the application.
+type application struct {
+	conn *Connection
+	path dbus.ObjectPath
+
+	mutex  sync.Mutex
+	props  map[dbus.ObjectPath]*prop.Properties
+	ifaces map[dbus.ObjectPath][]string
+}
+
+func newApplication(conn *Connection, path dbus.ObjectPath) (*application, error) {
+	if conn.replay != nil {
+		return nil, errors.New("objects cannot be exported when replaying a recording")
+	}
+
+	app := &application{
+		conn:   conn,
+		path:   path,
+		props:  make(map[dbus.ObjectPath]*prop.Properties),
+		ifaces: make(map[dbus.ObjectPath][]string),
+	}
+	if err := conn.bus.Export(app, path, ObjectManager); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// GetManagedObjects returns the objects exported by the application.
+// See http://dbus.freedesktop.org/doc/dbus-specification.html#standard-interfaces-objectmanager
+func (app *application) GetManagedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, *dbus.Error) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+
+	objects := make(map[dbus.ObjectPath]map[string]map[string]dbus.Variant, len(app.ifaces))
+	for path, ifaces := range app.ifaces {
+		objects[path] = make(map[string]map[string]dbus.Variant, len(ifaces))
+		for _, iface := range ifaces {
+			objects[path][iface] = map[string]dbus.Variant{}
+			if props, ok := app.props[path]; ok {
+				if all, err := props.GetAll(iface); err == nil {
+					objects[path][iface] = all
+				}
+			}
+		}
+	}
+	return objects, nil
+}
+
+// export exports an object at path. methods maps each interface name to the value
+// implementing its methods (or nil when the interface has no methods) and properties
+// maps each interface name to its properties. Properties that BlueZ may write
+// must be marked Writable.
+func (app *application) export(path dbus.ObjectPath, methods map[string]interface{}, properties prop.Map) error {
+	ifaces := []string{}
+	for iface, object := range methods {
+		if object != nil {
+			if err := app.conn.bus.Export(object, path, iface); err != nil {
+				return err
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+	for iface := range properties {
+		if _, ok := methods[iface]; !ok {
+			ifaces = append(ifaces, iface)
+		}
+	}
+
+	props, err := prop.Export(app.conn.bus, path, properties)
+	if err != nil {
+		return err
+	}
+
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+
+	app.props[path] = props
+	app.ifaces[path] = ifaces
+	return nil
+}
+
+// setProperty updates a property of an exported object, emitting PropertiesChanged.
+func (app *application) setProperty(path dbus.ObjectPath, iface string, name string, value interface{}) {
+	app.mutex.Lock()
+	props := app.props[path]
+	app.mutex.Unlock()
+
+	if props != nil {
+		props.SetMust(iface, name, value)
+	}
+}
+
+// unexport removes every object exported by the application from the bus.
+func (app *application) unexport() {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+
+	for path, ifaces := range app.ifaces {
+		for _, iface := range ifaces {
+			app.conn.bus.Export(nil, path, iface) // nolint
+		}
+		app.conn.bus.Export(nil, path, DbusProperties) // nolint
+	}
+	app.conn.bus.Export(nil, app.path, ObjectManager) // nolint
+
+	app.props = make(map[dbus.ObjectPath]*prop.Properties)
+	app.ifaces = make(map[dbus.ObjectPath][]string)
+}
@@ -8,10 +8,12 @@ It is similar to github.com/adafruit/Adafruit_Python_BluefruitLE
 package ble
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/godbus/dbus"
@@ -24,6 +26,12 @@ type Connection struct {
 	// It would be nice to factor out the subtypes here,
 	// but then the reflection used by dbus.Store() wouldn't work.
 	objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+	//Signals and method replies are written to the recorder when recording
+	recorder *recorder
+
+	//Set when the connection replays a recording rather than using DBUS
+	replay *replayer
 }
 
 // Open opens a connection to the system D-Bus
@@ -43,19 +51,36 @@ func Open() (*Connection, error) {
 
 // Close closes the D-Bus connection.
 func (conn *Connection) Close() {
-	conn.bus.Close() // nolint
+	conn.StopRecording() // nolint
+	if conn.bus != nil {
+		conn.bus.Close() // nolint
+	}
 }
 
 // Update gets all objects and properties.
 // See http://dbus.freedesktop.org/doc/dbus-specification.html#standard-interfaces-objectmanager
 func (conn *Connection) Update() error {
+	if conn.replay != nil {
+		return conn.replay.updateObjects(conn)
+	}
+
 	call := conn.bus.Object("org.bluez", "/").Call(
 		dot(ObjectManager, "GetManagedObjects"),
 		0,
 	)
+	conn.recordReply("/", dot(ObjectManager, "GetManagedObjects"), call.Body, call.Err)
 	return call.Store(&conn.objects)
 }
 
+// object returns the proxy used to call methods on a BlueZ object.
+// Replayed connections have no proxies, method replies are read from the recording.
+func (conn *Connection) object(path dbus.ObjectPath) dbus.BusObject {
+	if conn.bus == nil {
+		return nil
+	}
+	return conn.bus.Object("org.bluez", path)
+}
+
 type dbusInterfaces *map[string]map[string]dbus.Variant
 
 // The iterObjects function applies a function of type objectProc to
@@ -163,16 +188,79 @@ func (obj *blob) Modalias() string {
 	return modalias
 }
 
+// The timeouts of BlueZ method calls, keyed by method name. Methods without a timeout use defaultCallTimeout
+var (
+	callTimeouts = map[string]time.Duration{
+		"Connect": 20 * time.Second,
+		"Pair":    30 * time.Second,
+	}
+	defaultCallTimeout = 5 * time.Second
+	callTimeoutsMutex  sync.Mutex
+)
+
+type callTimeoutKey struct{}
+
+// SetCallTimeout sets the timeout of calls to the given BlueZ method, ex. Connect or ReadValue.
+// An empty method sets the timeout of every method without its own timeout.
+func SetCallTimeout(method string, timeout time.Duration) {
+	callTimeoutsMutex.Lock()
+	defer callTimeoutsMutex.Unlock()
+
+	if method == "" {
+		defaultCallTimeout = timeout
+	} else {
+		callTimeouts[method] = timeout
+	}
+}
+
+// WithCallTimeout returns a context that overrides the timeout of the method calls made with it.
+func WithCallTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, callTimeoutKey{}, timeout)
+}
+
+// callTimeout returns the timeout of a call to the given method made with ctx.
+func callTimeout(ctx context.Context, method string) time.Duration {
+	if timeout, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+
+	callTimeoutsMutex.Lock()
+	defer callTimeoutsMutex.Unlock()
+
+	if timeout, ok := callTimeouts[method]; ok {
+		return timeout
+	}
+	return defaultCallTimeout
+}
+
 func (obj *blob) callv(method string, args ...interface{}) *dbus.Call {
-	const callTimeout = 5 * time.Second
-	c := obj.object.Go(dot(obj.iface, method), 0, nil, args...)
+	return obj.callvContext(context.Background(), method, args...)
+}
+
+// callvContext calls a method, cancelling the pending call when ctx is done or the method's timeout elapses.
+func (obj *blob) callvContext(ctx context.Context, method string, args ...interface{}) *dbus.Call {
+	if obj.conn.replay != nil {
+		c := obj.conn.replay.call(obj.path, dot(obj.iface, method))
+		c.Err = ClassifyError(c.Err)
+		return c
+	}
+
+	timeout := callTimeout(ctx, method)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c := obj.object.GoWithContext(ctx, dot(obj.iface, method), 0, nil, args...)
 	if c.Err == nil {
-		select {
-		case <-c.Done:
-		case <-time.After(callTimeout):
-			c.Err = fmt.Errorf("BLE call timeout")
-		}
+		//The call is completed with the context's error when the context is done
+		<-c.Done
 	}
+	if c.Err != nil && ctx.Err() == context.DeadlineExceeded {
+		c.Err = &Error{Kind: ErrorTimeout, Message: fmt.Sprintf("%s: %s did not complete within %s", callTimeoutMessage, method, timeout)}
+	}
+	obj.conn.recordReply(obj.path, dot(obj.iface, method), c.Body, c.Err)
+
+	//Errors are classified so that callers can retry temporary errors
+	c.Err = ClassifyError(c.Err)
 	return c
 }
 
@@ -180,6 +268,10 @@ func (obj *blob) call(method string, args ...interface{}) error {
 	return obj.callv(method, args...).Err
 }
 
+func (obj *blob) callContext(ctx context.Context, method string, args ...interface{}) error {
+	return obj.callvContext(ctx, method, args...).Err
+}
+
 // Print prints the object.
 func (obj *blob) Print(w *io.Writer) {
 	fmt.Fprintf(*w, "%s [%s]\n", obj.path, obj.iface) // nolint
@@ -216,7 +308,7 @@ func (conn *Connection) findObject(iface string, matching predicate) (*blob, err
 			path:       path,
 			iface:      iface,
 			properties: props,
-			object:     conn.bus.Object("org.bluez", path),
+			object:     conn.object(path),
 		}
 		if matching(obj) {
 			found = append(found, obj)
@@ -247,7 +339,7 @@ func (conn *Connection) findObjects(iface string, matching predicate) ([]*blob,
 			path:       path,
 			iface:      iface,
 			properties: props,
-			object:     conn.bus.Object("org.bluez", path),
+			object:     conn.object(path),
 		}
 		if matching(obj) {
 			found = append(found, obj)
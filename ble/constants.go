@@ -13,11 +13,21 @@ const (
 	DbusProperties          = "org.freedesktop.DBus.Properties"
 	DbusIntrospectable      = "org.freedesktop.DBus.Introspectable"
 
+	AdvertisementMonitorManagerInterface = "org.bluez.AdvertisementMonitorManager1"
+	AdvertisementMonitorInterface        = "org.bluez.AdvertisementMonitor1"
+	GattManagerInterface                 = "org.bluez.GattManager1"
+	LEAdvertisingManagerInterface        = "org.bluez.LEAdvertisingManager1"
+	LEAdvertisementInterface             = "org.bluez.LEAdvertisement1"
+
 	//DBUS signals
 	InterfacesAdded   = "org.freedesktop.DBus.ObjectManager.InterfacesAdded"
 	InterfacesRemoved = "org.freedesktop.DBus.ObjectManager.InterfacesRemoved"
 	PropertiesChanged = "org.freedesktop.DBus.Properties.PropertiesChanged"
 
+	//Advertisement monitor methods called by BlueZ. The calls are recorded as signals
+	MonitorDeviceFound = "org.bluez.AdvertisementMonitor1.DeviceFound"
+	MonitorDeviceLost  = "org.bluez.AdvertisementMonitor1.DeviceLost"
+
 	//DBus signal rules
 	AddRule        = "type='signal',interface='org.freedesktop.DBus.ObjectManager',member='InterfacesAdded'"
 	RemoveRule     = "type='signal',interface='org.freedesktop.DBus.ObjectManager',member='InterfacesRemoved'"
@@ -43,6 +53,7 @@ const (
 	BluezLegacyPairing       = "LegacyPairing"
 	BluezManufacturerData    = "ManufacturerData"
 	BluezModalias            = "Modalias"
+	BluezMTU                 = "MTU"
 	BluezName                = "Name"
 	BluezNotifyAcquired      = "NotifyAcquired"
 	BluezNotifying           = "Notifying"
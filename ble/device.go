@@ -1,9 +1,13 @@
 package ble
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"reflect"
 
@@ -16,10 +20,13 @@ type Device interface {
 	BaseObject
 
 	Connect() error
+	ConnectContext(context.Context) error
 	Disconnect() error
+	DisconnectContext(context.Context) error
 	ConnectProfile(string) error
 	DisconnectProfile(string) error
 	Pair() error
+	PairContext(context.Context) error
 	CancelPairing() error
 
 	Address() string                          //The Bluetooth device address of the remote device - readonly
@@ -43,6 +50,10 @@ type Device interface {
 	TxPower() int16                           //Advertised transmitted power level - readonly, optional
 	ManufacturerData() map[string]interface{} //Manufacturer specific advertisement data - readonly, optional
 	ServiceData() map[string]interface{}      //Service advertisement data - readonly, optional
+	ManufacturerIDs() []uint16                //Company identifiers contained in the manufacturer advertisement data
+	ServiceDataUUIDs() []string               //Service UUIDs contained in the service advertisement data
+	ManufacturerValue(uint16) ([]byte, bool)  //The manufacturer advertisement data of a company identifier
+	ServiceDataValue(string) ([]byte, bool)   //The service advertisement data of a service UUID
 	ServicesResolved() bool                   //Indicate whether or not service discovery has been resolved - readonly
 	AdvertisingFlags() []byte                 //The Advertising Data Flags of the remote device - readonly, experimental
 }
@@ -80,11 +91,19 @@ func (conn *Connection) GetDevices(uuids ...string) ([]Device, error) {
 
 func uuidsInclude(advertised []string, uuids []string) bool {
 	for _, u := range uuids {
-		if !ValidUUID(strings.ToLower(u)) {
+		uuid, err := NormalizeUUID(u)
+		if err != nil {
 			log.Printf("invalid UUID %s", u)
 			return false
 		}
-		if !stringArrayContains(advertised, u) {
+		found := false
+		for _, a := range advertised {
+			if ConvertUUID(a) == uuid {
+				found = true
+				break
+			}
+		}
+		if !found {
 			return false
 		}
 	}
@@ -172,8 +191,9 @@ func (device *blob) ServiceData() map[string]interface{} {
 
 	servDataMap := make(map[string]interface{})
 
+	//Service data is keyed by service UUID - a{sv}
 	if service, ok := device.properties[BluezServiceData]; ok {
-		servData := service.Value().(map[uint16]dbus.Variant)
+		servData, _ := service.Value().(map[string]dbus.Variant)
 		for key, value := range servData {
 			servDataMap["id"] = key
 
@@ -190,6 +210,54 @@ func (device *blob) ServiceData() map[string]interface{} {
 	return servDataMap
 }
 
+func (device *blob) ManufacturerIDs() []uint16 {
+	ids := []uint16{}
+	if manufacturer, ok := device.properties[BluezManufacturerData]; ok {
+		manData, _ := manufacturer.Value().(map[uint16]dbus.Variant)
+		for key := range manData {
+			ids = append(ids, key)
+		}
+	}
+	return ids
+}
+
+func (device *blob) ServiceDataUUIDs() []string {
+	uuids := []string{}
+	if service, ok := device.properties[BluezServiceData]; ok {
+		servData, _ := service.Value().(map[string]dbus.Variant)
+		for key := range servData {
+			uuids = append(uuids, key)
+		}
+	}
+	return uuids
+}
+
+// ManufacturerValue returns the manufacturer advertisement data of the company identifier id.
+func (device *blob) ManufacturerValue(id uint16) ([]byte, bool) {
+	if manufacturer, ok := device.properties[BluezManufacturerData]; ok {
+		manData, _ := manufacturer.Value().(map[uint16]dbus.Variant)
+		if value, ok := manData[id]; ok {
+			data, ok := value.Value().([]byte)
+			return data, ok
+		}
+	}
+	return nil, false
+}
+
+// ServiceDataValue returns the service advertisement data of the service uuid.
+func (device *blob) ServiceDataValue(uuid string) ([]byte, bool) {
+	if service, ok := device.properties[BluezServiceData]; ok {
+		servData, _ := service.Value().(map[string]dbus.Variant)
+		for key, value := range servData {
+			if EqualUUIDs(key, uuid) {
+				data, ok := value.Value().([]byte)
+				return data, ok
+			}
+		}
+	}
+	return nil, false
+}
+
 func (device *blob) AdvertisingFlags() []byte {
 	var val = device.properties[BluezAdvertisingFlags].Value()
 	if val == nil {
@@ -235,13 +303,23 @@ func (device *blob) Adapter() dbus.ObjectPath {
 }
 
 func (device *blob) Connect() error {
+	return device.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the device, cancelling the connection attempt when ctx is done.
+func (device *blob) ConnectContext(ctx context.Context) error {
 	log.Printf("%s: connecting", device.Name())
-	return device.call("Connect")
+	return device.callContext(ctx, "Connect")
 }
 
 func (device *blob) Disconnect() error {
+	return device.DisconnectContext(context.Background())
+}
+
+// DisconnectContext disconnects from the device, cancelling the call when ctx is done.
+func (device *blob) DisconnectContext(ctx context.Context) error {
 	log.Printf("%s: disconnecting", device.Name())
-	return device.call("Disconnect")
+	return device.callContext(ctx, "Disconnect")
 }
 
 func (device *blob) ConnectProfile(uuid string) error {
@@ -255,8 +333,13 @@ func (device *blob) DisconnectProfile(uuid string) error {
 }
 
 func (device *blob) Pair() error {
+	return device.PairContext(context.Background())
+}
+
+// PairContext pairs with the device, cancelling pairing when ctx is done.
+func (device *blob) PairContext(ctx context.Context) error {
 	log.Printf("%s: pairing", device.Name())
-	return device.call("Pair")
+	return device.callContext(ctx, "Pair")
 }
 
 func (device *blob) CancelPairing() error {
@@ -264,6 +347,127 @@ func (device *blob) CancelPairing() error {
 	return device.call("CancelPairing")
 }
 
+// deviceWatch is a handler registered with WatchDevice
+type deviceWatch struct {
+	handler func(changed map[string]dbus.Variant)
+}
+
+var (
+	// The PropertiesChanged signals of every watched device are received on one channel
+	// and dispatched to the handlers registered for the device's path.
+	watchSignals  = make(chan *dbus.Signal, 100)
+	watchHandlers = make(map[dbus.ObjectPath]map[*deviceWatch]bool)
+	watchStarted  bool
+	watchMutex    sync.Mutex
+)
+
+// WatchDevice calls handler with the properties that changed each time a PropertiesChanged
+// signal is received for the device, until ctx is cancelled. Handlers for every watched device
+// are called from a single goroutine, so handler must not block.
+func (conn *Connection) WatchDevice(ctx context.Context, device Device, handler func(changed map[string]dbus.Variant)) error {
+	if conn.replay != nil {
+		return errors.New("devices cannot be watched when replaying a recording")
+	}
+
+	path := device.Path()
+	rule := fmt.Sprintf(PropertiesRule+",path='%s'", path)
+	if err := conn.AddMatch(rule); err != nil {
+		return err
+	}
+
+	watch := &deviceWatch{handler: handler}
+
+	watchMutex.Lock()
+	if !watchStarted {
+		watchStarted = true
+		go watchLoop(conn)
+		conn.bus.Signal(watchSignals)
+	}
+	if watchHandlers[path] == nil {
+		watchHandlers[path] = make(map[*deviceWatch]bool)
+	}
+	watchHandlers[path][watch] = true
+	watchMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		watchMutex.Lock()
+		delete(watchHandlers[path], watch)
+		if len(watchHandlers[path]) == 0 {
+			delete(watchHandlers, path)
+		}
+		watchMutex.Unlock()
+
+		conn.RemoveMatch(rule) // nolint
+	}()
+	return nil
+}
+
+func watchLoop(conn *Connection) {
+	for s := range watchSignals {
+		if s.Name != PropertiesChanged || len(s.Body) < 2 {
+			continue
+		}
+		if iface, _ := s.Body[0].(string); iface != DeviceInterface {
+			continue
+		}
+
+		watchMutex.Lock()
+		handlers := make([]func(map[string]dbus.Variant), 0, len(watchHandlers[s.Path]))
+		for watch := range watchHandlers[s.Path] {
+			handlers = append(handlers, watch.handler)
+		}
+		watchMutex.Unlock()
+		if len(handlers) == 0 {
+			continue
+		}
+		conn.recordSignal(s)
+
+		// Reflection used by dbus.Store() requires explicit type here.
+		var changed map[string]dbus.Variant
+		if err := dbus.Store(s.Body[1:2], &changed); err != nil {
+			continue
+		}
+		for _, handler := range handlers {
+			handler(changed)
+		}
+	}
+}
+
+// WaitForServicesResolved waits until GATT service discovery completes for the connected device
+// with the given address. The object cache is updated while waiting, so the device's services and
+// characteristics can be found once the updated device is returned.
+func (conn *Connection) WaitForServicesResolved(ctx context.Context, address string, timeout time.Duration) (Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if err := conn.Update(); err != nil {
+			return nil, err
+		}
+		device, err := conn.GetDeviceByAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		if !device.Connected() {
+			return nil, errors.New("device disconnected before its services were resolved")
+		}
+		if device.ServicesResolved() {
+			return device, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out after %s waiting for the device's services to be resolved", timeout)
+		}
+	}
+}
+
 func stringArrayContains(a []string, str string) bool {
 	for _, s := range a {
 		if strings.ToLower(s) == strings.ToLower(str) {
@@ -1,6 +1,7 @@
 package ble
 
 import (
+	"context"
 	"log"
 
 	"github.com/godbus/dbus"
@@ -8,6 +9,9 @@ import (
 
 //AddMatch - Adds a signal matching rule to DBUS. Allows a specific type of DBUS signal to be handled within a program.
 func (conn *Connection) AddMatch(rule string) error {
+	if conn.replay != nil {
+		return nil
+	}
 	return conn.bus.BusObject().Call(
 		"org.freedesktop.DBus.AddMatch",
 		0,
@@ -17,6 +21,9 @@ func (conn *Connection) AddMatch(rule string) error {
 
 //RemoveMatch - Removes a signal matching rule from DBUS.
 func (conn *Connection) RemoveMatch(rule string) error {
+	if conn.replay != nil {
+		return nil
+	}
 	return conn.bus.BusObject().Call(
 		"org.freedesktop.DBus.RemoveMatch",
 		0,
@@ -24,8 +31,15 @@ func (conn *Connection) RemoveMatch(rule string) error {
 	).Err
 }
 
-// StartDiscovery - Initiates discovery of LE peripherals with the given UUIDs.
-func (conn *Connection) StartDiscovery(stopDiscoveryChannel <-chan bool, uuids ...string) chan *dbus.Signal {
+// StartDiscovery - Initiates discovery of peripherals matching the given discovery filter.
+// Discovery stops when a value is received on stopDiscoveryChannel or ctx is cancelled.
+func (conn *Connection) StartDiscovery(ctx context.Context, stopDiscoveryChannel <-chan bool, filter DiscoveryFilter) chan *dbus.Signal {
+
+	//Recorded signals are retrieved with NextRecordedSignal
+	if conn.replay != nil {
+		log.Printf("Discovery cannot be started when replaying a recording")
+		return nil
+	}
 
 	//Create the channel that will be used to return DBUS signal events to the caller
 	//This channel is closed when the Discover method ends
@@ -38,13 +52,13 @@ func (conn *Connection) StartDiscovery(stopDiscoveryChannel <-chan bool, uuids .
 		return nil
 	}
 
-	go adapter.Discover(deviceDiscoveredChannel, stopDiscoveryChannel, uuids...)
+	go adapter.Discover(ctx, deviceDiscoveredChannel, stopDiscoveryChannel, filter)
 	return deviceDiscoveredChannel
 }
 
 // Discover puts the adapter in discovery mode, waits for the specified amount of time to discover
-// one of the given UUIDs, and then stops discovery mode.
-func (adapter *blob) Discover(deviceChannel chan<- *dbus.Signal, stopDiscoveryChannel <-chan bool, uuids ...string) {
+// devices matching the given filter, and then stops discovery mode.
+func (adapter *blob) Discover(ctx context.Context, deviceChannel chan<- *dbus.Signal, stopDiscoveryChannel <-chan bool, filter DiscoveryFilter) {
 
 	conn := adapter.conn
 	signals := make(chan *dbus.Signal)
@@ -58,9 +72,9 @@ func (adapter *blob) Discover(deviceChannel chan<- *dbus.Signal, stopDiscoveryCh
 
 	var err error
 
-	if len(uuids) > 0 {
+	if !filter.IsEmpty() {
 		log.Printf("Setting discovery filter")
-		if err = adapter.SetDiscoveryFilter(uuids...); err != nil {
+		if err = adapter.SetDiscoveryFilter(filter); err != nil {
 			log.Printf("Error setting discovery filter: %s", err.Error())
 			return
 		}
@@ -73,7 +87,7 @@ func (adapter *blob) Discover(deviceChannel chan<- *dbus.Signal, stopDiscoveryCh
 	}
 
 	log.Printf("Starting discoverDevicesLoop")
-	if err = adapter.discoverLoop(deviceChannel, uuids, signals, stopDiscoveryChannel); err != nil {
+	if err = adapter.discoverLoop(ctx, deviceChannel, filter.UUIDs, signals, stopDiscoveryChannel); err != nil {
 		log.Printf("Error returned from discoverDevicesLoop: %s", err.Error())
 		return
 	}
@@ -83,18 +97,18 @@ func (adapter *blob) Discover(deviceChannel chan<- *dbus.Signal, stopDiscoveryCh
 	return
 }
 
-func (adapter *blob) discoverLoop(deviceChannel chan<- *dbus.Signal, uuids []string, signals <-chan *dbus.Signal, stopDiscoveryChannel <-chan bool) error {
+func (adapter *blob) discoverLoop(ctx context.Context, deviceChannel chan<- *dbus.Signal, uuids []string, signals <-chan *dbus.Signal, stopDiscoveryChannel <-chan bool) error {
 	for {
 		select {
 		case s := <-signals:
 			log.Printf("Signal received: %#v)", s)
+			adapter.conn.recordSignal(s)
 			switch s.Name {
-			case InterfacesAdded:
-				deviceChannel <- s
-			case InterfacesRemoved:
-				deviceChannel <- s
-			case PropertiesChanged:
-				deviceChannel <- s
+			case InterfacesAdded, InterfacesRemoved, PropertiesChanged:
+				select {
+				case deviceChannel <- s:
+				case <-ctx.Done():
+				}
 			default:
 				log.Printf("%s: unexpected signal %s", adapter.Name(), s.Name)
 			}
@@ -105,6 +119,11 @@ func (adapter *blob) discoverLoop(deviceChannel chan<- *dbus.Signal, uuids []str
 				log.Printf("[DEBUG] Ending discover loop")
 				return nil
 			}
+		case <-ctx.Done():
+			log.Printf("[DEBUG] Discovery cancelled")
+			adapter.StopDiscovery()
+			log.Printf("[DEBUG] Ending discover loop")
+			return nil
 		}
 	}
 }
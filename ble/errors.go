@@ -0,0 +1,142 @@
+package ble
+
+import (
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+// ErrorKind classifies the errors returned by BlueZ method calls.
+type ErrorKind string
+
+// The kinds of BlueZ errors. Errors of the InProgress, NotReady, ConnectionAborted and Timeout
+// kinds are temporary, the operation may succeed if it is retried.
+const (
+	ErrorInProgress        ErrorKind = "inProgress"
+	ErrorNotReady          ErrorKind = "notReady"
+	ErrorConnectionAborted ErrorKind = "connectionAborted"
+	ErrorTimeout           ErrorKind = "timeout"
+	ErrorNotConnected      ErrorKind = "notConnected"
+	ErrorAlreadyExists     ErrorKind = "alreadyExists"
+	ErrorNotAuthorized     ErrorKind = "notAuthorized"
+	ErrorNotPermitted      ErrorKind = "notPermitted"
+	ErrorNotSupported      ErrorKind = "notSupported"
+	ErrorInvalidArguments  ErrorKind = "invalidArguments"
+	ErrorDoesNotExist      ErrorKind = "doesNotExist"
+	ErrorFailed            ErrorKind = "failed"
+)
+
+// The errors returned by BlueZ, see bluez/doc/device-api.txt and gatt-api.txt
+var bluezErrorKinds = map[string]ErrorKind{
+	"org.bluez.Error.InProgress":               ErrorInProgress,
+	"org.bluez.Error.NotReady":                 ErrorNotReady,
+	"org.bluez.Error.NotConnected":             ErrorNotConnected,
+	"org.bluez.Error.AlreadyConnected":         ErrorAlreadyExists,
+	"org.bluez.Error.AlreadyExists":            ErrorAlreadyExists,
+	"org.bluez.Error.NotAuthorized":            ErrorNotAuthorized,
+	"org.bluez.Error.AuthenticationFailed":     ErrorNotAuthorized,
+	"org.bluez.Error.AuthenticationRejected":   ErrorNotAuthorized,
+	"org.bluez.Error.AuthenticationCanceled":   ErrorNotAuthorized,
+	"org.bluez.Error.AuthenticationTimeout":    ErrorNotAuthorized,
+	"org.bluez.Error.NotPermitted":             ErrorNotPermitted,
+	"org.bluez.Error.NotSupported":             ErrorNotSupported,
+	"org.bluez.Error.NotAvailable":             ErrorNotSupported,
+	"org.bluez.Error.InvalidArguments":         ErrorInvalidArguments,
+	"org.bluez.Error.InvalidValueLength":       ErrorInvalidArguments,
+	"org.bluez.Error.InvalidOffset":            ErrorInvalidArguments,
+	"org.bluez.Error.DoesNotExist":             ErrorDoesNotExist,
+	"org.bluez.Error.Failed":                   ErrorFailed,
+	"org.freedesktop.DBus.Error.NoReply":       ErrorTimeout,
+	"org.freedesktop.DBus.Error.UnknownObject": ErrorDoesNotExist,
+}
+
+// Messages identifying temporary errors. BlueZ returns connection failures as org.bluez.Error.Failed,
+// and replayed recordings only contain the error message.
+var bluezErrorMessages = map[string]ErrorKind{
+	"le-connection-abort-by-local":     ErrorConnectionAborted,
+	"br-connection-aborted-by-local":   ErrorConnectionAborted,
+	"software caused connection abort": ErrorConnectionAborted,
+	"in progress":                      ErrorInProgress,
+	"not ready":                        ErrorNotReady,
+	callTimeoutMessage:                 ErrorTimeout,
+
+	// ATT errors returned when the link does not have the security the attribute requires
+	"insufficient authentication": ErrorNotAuthorized,
+	"insufficient encryption":     ErrorNotAuthorized,
+	"insufficient authorization":  ErrorNotAuthorized,
+}
+
+// The error message returned when a method call does not complete within its timeout
+const callTimeoutMessage = "BLE call timeout"
+
+// Error is a classified error returned by a BlueZ method call.
+type Error struct {
+	Kind    ErrorKind
+	Name    string // The D-Bus error name, ex. org.bluez.Error.InProgress, if known
+	Message string
+}
+
+// Error returns the message of the error, or its name if it has no message.
+func (err *Error) Error() string {
+	if err.Message != "" {
+		return err.Message
+	}
+	return err.Name
+}
+
+// Temporary reports whether the operation that failed may succeed if it is retried.
+func (err *Error) Temporary() bool {
+	switch err.Kind {
+	case ErrorInProgress, ErrorNotReady, ErrorConnectionAborted, ErrorTimeout:
+		return true
+	}
+	return false
+}
+
+// ClassifyError converts D-Bus errors and errors with recognized messages to an *Error.
+// Other errors, including nil, are returned unchanged.
+func ClassifyError(err error) error {
+	var name string
+	switch dbusErr := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return err
+	case dbus.Error:
+		name = dbusErr.Name
+	case *dbus.Error:
+		name = dbusErr.Name
+	}
+
+	classified := &Error{Name: name, Message: err.Error()}
+	message := strings.ToLower(classified.Message)
+	for text, kind := range bluezErrorMessages {
+		if strings.Contains(message, strings.ToLower(text)) {
+			classified.Kind = kind
+			return classified
+		}
+	}
+	if kind, ok := bluezErrorKinds[name]; ok {
+		classified.Kind = kind
+		return classified
+	}
+	if name != "" {
+		classified.Kind = ErrorFailed
+		return classified
+	}
+	return err
+}
+
+// ErrorKindOf returns the kind of a classified error, or an empty kind if err is not classified.
+func ErrorKindOf(err error) ErrorKind {
+	if bluezErr, ok := err.(*Error); ok {
+		return bluezErr.Kind
+	}
+	return ""
+}
+
+// IsTemporary reports whether err is a temporary BlueZ error.
+func IsTemporary(err error) bool {
+	bluezErr, ok := err.(*Error)
+	return ok && bluezErr.Temporary()
+}
@@ -0,0 +1,117 @@
+package ble
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+//Discovery filter transports accepted by Adapter1.SetDiscoveryFilter
+const (
+	TransportAuto  = "auto"
+	TransportLE    = "le"
+	TransportBREDR = "bredr"
+)
+
+// DiscoveryFilter holds the filter keys passed to Adapter1.SetDiscoveryFilter.
+// See bluez/doc/adapter-api.txt
+//
+// Optional keys are pointers so that an unset key is not sent to BlueZ.
+// RSSI and Pathloss are mutually exclusive.
+type DiscoveryFilter struct {
+	UUIDs         []string //Service UUIDs, only devices advertising one of them are reported
+	RSSI          *int16   //Minimum RSSI a device must have to be reported
+	Pathloss      *uint16  //Maximum pathloss a device may have to be reported
+	Transport     string   //"auto", "le" or "bredr". Defaults to "le"
+	DuplicateData *bool    //Report every advertisement rather than only property changes - BlueZ 5.46+
+	Discoverable  *bool    //Only report devices in discoverable mode - BlueZ 5.50+
+	Pattern       string   //Address or name prefix a device must match to be reported - BlueZ 5.54+
+}
+
+//legacyFilterKeys are the keys understood by every BlueZ version supporting SetDiscoveryFilter
+var legacyFilterKeys = []string{"UUIDs", "RSSI", "Pathloss", "Transport"}
+
+// IsEmpty returns true if no filter key has been specified.
+func (filter DiscoveryFilter) IsEmpty() bool {
+	return len(filter.UUIDs) == 0 &&
+		filter.RSSI == nil &&
+		filter.Pathloss == nil &&
+		filter.Transport == "" &&
+		filter.DuplicateData == nil &&
+		filter.Discoverable == nil &&
+		filter.Pattern == ""
+}
+
+// Validate ensures the filter keys can be accepted by BlueZ.
+func (filter DiscoveryFilter) Validate() error {
+	if filter.RSSI != nil && filter.Pathloss != nil {
+		return fmt.Errorf("RSSI and Pathloss discovery filters cannot be combined")
+	}
+
+	switch strings.ToLower(filter.Transport) {
+	case "", TransportAuto, TransportLE, TransportBREDR:
+	default:
+		return fmt.Errorf("invalid discovery transport %s, must be one of auto, le or bredr", filter.Transport)
+	}
+
+	for _, uuid := range filter.UUIDs {
+		if _, err := NormalizeUUID(uuid); err != nil {
+			return fmt.Errorf("invalid discovery filter UUID %s", uuid)
+		}
+	}
+	return nil
+}
+
+// dict creates the a{sv} argument expected by SetDiscoveryFilter.
+func (filter DiscoveryFilter) dict() map[string]dbus.Variant {
+	transport := strings.ToLower(filter.Transport)
+	if transport == "" {
+		transport = TransportLE
+	}
+
+	args := map[string]dbus.Variant{
+		"Transport": dbus.MakeVariant(transport),
+	}
+
+	if len(filter.UUIDs) > 0 {
+		uuids := make([]string, len(filter.UUIDs))
+		for i, uuid := range filter.UUIDs {
+			uuids[i] = ConvertUUID(uuid)
+		}
+		args["UUIDs"] = dbus.MakeVariant(uuids)
+	}
+	if filter.RSSI != nil {
+		args["RSSI"] = dbus.MakeVariant(*filter.RSSI)
+	}
+	if filter.Pathloss != nil {
+		args["Pathloss"] = dbus.MakeVariant(*filter.Pathloss)
+	}
+	if filter.DuplicateData != nil {
+		args["DuplicateData"] = dbus.MakeVariant(*filter.DuplicateData)
+	}
+	if filter.Discoverable != nil {
+		args["Discoverable"] = dbus.MakeVariant(*filter.Discoverable)
+	}
+	if filter.Pattern != "" {
+		args["Pattern"] = dbus.MakeVariant(filter.Pattern)
+	}
+	return args
+}
+
+// legacyDict removes the keys older BlueZ versions reject from a filter dictionary.
+// The boolean return value indicates whether or not any keys were removed.
+func legacyDict(args map[string]dbus.Variant) (map[string]dbus.Variant, bool) {
+	legacy := map[string]dbus.Variant{}
+	for _, key := range legacyFilterKeys {
+		if val, ok := args[key]; ok {
+			legacy[key] = val
+		}
+	}
+	return legacy, len(legacy) != len(args)
+}
+
+//isInvalidArguments - Returns true if err is the error BlueZ returns for unsupported filter keys
+func isInvalidArguments(err error) bool {
+	return ErrorKindOf(err) == ErrorInvalidArguments
+}
@@ -4,6 +4,6 @@ package ble
 
 // Discovery filtering doesn't work on Intel Edison running
 // Debian stretch and kernel 3.10.17-yocto-standard-r2.
-func (adapter *blob) SetDiscoveryFilter(uuids ...string) error {
+func (adapter *blob) SetDiscoveryFilter(filter DiscoveryFilter) error {
 	return nil
 }
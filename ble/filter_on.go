@@ -4,17 +4,24 @@ package ble
 
 import (
 	"log"
-
-	"github.com/godbus/dbus"
 )
 
-func (adapter *blob) SetDiscoveryFilter(uuids ...string) error {
-	log.Printf("%s: setting discovery filter %v", adapter.Name(), uuids)
-	return adapter.call(
-		"SetDiscoveryFilter",
-		map[string]dbus.Variant{
-			"Transport": dbus.MakeVariant("le"),
-			"UUIDs":     dbus.MakeVariant(uuids),
-		},
-	)
+func (adapter *blob) SetDiscoveryFilter(filter DiscoveryFilter) error {
+	log.Printf("%s: setting discovery filter %+v", adapter.Name(), filter)
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+
+	args := filter.dict()
+	err := adapter.call("SetDiscoveryFilter", args)
+
+	//Older BlueZ versions reject the DuplicateData, Discoverable and Pattern keys.
+	//Retry with the keys every version supports rather than failing discovery.
+	if err != nil && isInvalidArguments(err) {
+		if legacy, removed := legacyDict(args); removed {
+			log.Printf("[WARN] %s: discovery filter rejected, retrying without unsupported keys: %s", adapter.Name(), err.Error())
+			err = adapter.call("SetDiscoveryFilter", legacy)
+		}
+	}
+	return err
 }
@@ -0,0 +1,141 @@
+package ble
+
+import (
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+// The flags of GATT characteristics and descriptors, see bluez/doc/gatt-api.txt
+const (
+	FlagBroadcast                    = "broadcast"
+	FlagRead                         = "read"
+	FlagWriteWithoutResponse         = "write-without-response"
+	FlagWrite                        = "write"
+	FlagNotify                       = "notify"
+	FlagIndicate                     = "indicate"
+	FlagAuthenticatedSignedWrites    = "authenticated-signed-writes"
+	FlagExtendedProperties           = "extended-properties"
+	FlagReliableWrite                = "reliable-write"
+	FlagWritableAuxiliaries          = "writable-auxiliaries"
+	FlagEncryptRead                  = "encrypt-read"
+	FlagEncryptWrite                 = "encrypt-write"
+	FlagEncryptNotify                = "encrypt-notify"
+	FlagEncryptIndicate              = "encrypt-indicate"
+	FlagEncryptAuthenticatedRead     = "encrypt-authenticated-read"
+	FlagEncryptAuthenticatedWrite    = "encrypt-authenticated-write"
+	FlagEncryptAuthenticatedNotify   = "encrypt-authenticated-notify"
+	FlagEncryptAuthenticatedIndicate = "encrypt-authenticated-indicate"
+	FlagSecureRead                   = "secure-read"
+	FlagSecureWrite                  = "secure-write"
+	FlagSecureNotify                 = "secure-notify"
+	FlagSecureIndicate               = "secure-indicate"
+	FlagAuthorize                    = "authorize"
+)
+
+// GattOperation is an operation on the value of a GATT characteristic or descriptor.
+type GattOperation string
+
+// The operations checked against the flags of characteristics and descriptors.
+const (
+	GattRead   GattOperation = "read"
+	GattWrite  GattOperation = "write"
+	GattNotify GattOperation = "notify"
+)
+
+// The write types of the WriteValue type option. Writes with a response are
+// acknowledged by the device, writes without a response (commands) are not.
+const (
+	WriteTypeRequest = "request"
+	WriteTypeCommand = "command"
+)
+
+// The flags that permit each operation
+var operationFlags = map[GattOperation][]string{
+	GattRead: {FlagRead, FlagEncryptRead, FlagEncryptAuthenticatedRead, FlagSecureRead},
+	GattWrite: {FlagWrite, FlagWriteWithoutResponse, FlagAuthenticatedSignedWrites, FlagReliableWrite,
+		FlagEncryptWrite, FlagEncryptAuthenticatedWrite, FlagSecureWrite},
+	GattNotify: {FlagNotify, FlagIndicate, FlagEncryptNotify, FlagEncryptIndicate,
+		FlagEncryptAuthenticatedNotify, FlagEncryptAuthenticatedIndicate, FlagSecureNotify, FlagSecureIndicate},
+}
+
+// The flags that require the link to be encrypted, and the security each requires
+var securityFlags = map[string]string{
+	FlagEncryptRead:                  "encryption",
+	FlagEncryptWrite:                 "encryption",
+	FlagEncryptNotify:                "encryption",
+	FlagEncryptIndicate:              "encryption",
+	FlagEncryptAuthenticatedRead:     "authenticated encryption",
+	FlagEncryptAuthenticatedWrite:    "authenticated encryption",
+	FlagEncryptAuthenticatedNotify:   "authenticated encryption",
+	FlagEncryptAuthenticatedIndicate: "authenticated encryption",
+	FlagSecureRead:                   "secure connections",
+	FlagSecureWrite:                  "secure connections",
+	FlagSecureNotify:                 "secure connections",
+	FlagSecureIndicate:               "secure connections",
+}
+
+// CheckFlags returns an error if the given flags do not permit the operation, or if the
+// operation requires encryption and the device is not paired. Errors are of the
+// ErrorNotPermitted and ErrorNotAuthorized kinds. Empty flags are not checked, since
+// the flags of the object are not known.
+func CheckFlags(flags []string, operation GattOperation, paired bool) error {
+	if len(flags) == 0 {
+		return nil
+	}
+
+	permitted := false
+	for _, flag := range operationFlags[operation] {
+		if stringArrayContains(flags, flag) {
+			permitted = true
+			if security, ok := securityFlags[flag]; ok && !paired {
+				return &Error{Kind: ErrorNotAuthorized, Message: string(operation) + " requires " + security + " and the device is not paired"}
+			}
+		}
+	}
+	if !permitted {
+		return &Error{Kind: ErrorNotPermitted, Message: string(operation) + " not permitted, flags are " + strings.Join(flags, ", ")}
+	}
+	return nil
+}
+
+// WriteType returns the type of write permitted by the given flags. Writes with a response
+// are preferred when both are permitted. Returns an empty string when the flags do not
+// determine the type, in which case BlueZ chooses it.
+func WriteType(flags []string) string {
+	for _, flag := range operationFlags[GattWrite] {
+		if flag != FlagWriteWithoutResponse && flag != FlagAuthenticatedSignedWrites && stringArrayContains(flags, flag) {
+			return WriteTypeRequest
+		}
+	}
+	if stringArrayContains(flags, FlagWriteWithoutResponse) || stringArrayContains(flags, FlagAuthenticatedSignedWrites) {
+		return WriteTypeCommand
+	}
+	return ""
+}
+
+// checkFlags returns an error if the handle's flags do not permit the operation.
+func (handle *blob) checkFlags(operation GattOperation) error {
+	if err := CheckFlags(handle.Flags(), operation, handle.devicePaired()); err != nil {
+		bluezErr := err.(*Error)
+		bluezErr.Message = handle.UUID() + ": " + bluezErr.Message
+		return bluezErr
+	}
+	return nil
+}
+
+// devicePaired returns whether the device a GATT object belongs to is paired,
+// according to the object cache.
+func (handle *blob) devicePaired() bool {
+	path := string(handle.path)
+	start := strings.Index(path, "/dev_")
+	if start < 0 {
+		return false
+	}
+	if end := strings.Index(path[start+1:], "/"); end >= 0 {
+		path = path[:start+1+end]
+	}
+
+	paired, _ := handle.conn.objects[dbus.ObjectPath(path)][DeviceInterface][BluezPaired].Value().(bool)
+	return paired
+}
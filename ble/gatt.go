@@ -1,14 +1,17 @@
 package ble
 
 import (
+	"context"
 	"log"
+	"strings"
 
 	"github.com/godbus/dbus"
 )
 
 func (conn *Connection) findGattObject(iface string, uuid string) (*blob, error) {
+	uuid = ConvertUUID(uuid)
 	return conn.findObject(iface, func(desc *blob) bool {
-		return desc.UUID() == uuid
+		return ConvertUUID(desc.UUID()) == uuid
 	})
 }
 
@@ -65,26 +68,66 @@ func (conn *Connection) GetService(uuid string) (Service, error) {
 	return conn.findGattObject(ServiceInterface, uuid)
 }
 
+// GetDeviceServices finds the GATT services of the given device.
+func (conn *Connection) GetDeviceServices(device Device) ([]Service, error) {
+	objects, err := conn.findObjects(ServiceInterface, func(service *blob) bool {
+		return strings.HasPrefix(string(service.Path()), string(device.Path())+"/")
+	})
+
+	services := make([]Service, len(objects))
+	for i := range services {
+		services[i] = objects[i]
+	}
+	return services, err
+}
+
 // ReadWriteHandle is the interface satisfied by GATT objects
 // that provide ReadValue and WriteValue operations.
 type ReadWriteHandle interface {
 	GattHandle
 
 	ReadValue() ([]byte, error)
+	ReadValueContext(context.Context) ([]byte, error)
 	WriteValue([]byte) error
+	WriteValueContext(context.Context, []byte) error
 }
 
 // ReadValue reads the handle's value.
 func (handle *blob) ReadValue() ([]byte, error) {
+	return handle.ReadValueContext(context.Background())
+}
+
+// ReadValueContext reads the handle's value, cancelling the read when ctx is done.
+// Returns an error without reading if the handle's flags do not permit reads.
+func (handle *blob) ReadValueContext(ctx context.Context) ([]byte, error) {
+	if err := handle.checkFlags(GattRead); err != nil {
+		return nil, err
+	}
+
 	var data []byte
-	err := handle.callv("ReadValue", Properties{}).Store(&data)
+	err := handle.callvContext(ctx, "ReadValue", Properties{}).Store(&data)
 	return data, err
 }
 
 // WriteValue writes a value to the handle.
 func (handle *blob) WriteValue(data []byte) error {
+	return handle.WriteValueContext(context.Background(), data)
+}
+
+// WriteValueContext writes a value to the handle, cancelling the write when ctx is done.
+// Returns an error without writing if the handle's flags do not permit writes. Characteristics
+// are written with a response unless they only permit writes without a response.
+func (handle *blob) WriteValueContext(ctx context.Context, data []byte) error {
 	log.Printf("In WriteValue")
-	return handle.call("WriteValue", data, Properties{})
+	if err := handle.checkFlags(GattWrite); err != nil {
+		return err
+	}
+
+	options := Properties{}
+	if writeType := WriteType(handle.Flags()); writeType != "" && handle.iface == CharacteristicInterface {
+		options["type"] = dbus.MakeVariant(writeType)
+	}
+	return handle.callContext(ctx, "WriteValue", data, options)
 }
 
 // NotifyHandler represents a function that handles notifications.
@@ -105,6 +148,7 @@ type Characteristic interface {
 	NotifyAcquired() bool     //True, if this characteristic has been acquired by any client using AcquireNotify - readonly, optional
 	Notifying() bool          //True, if notifications or indications on this characteristic are currently enabled - readonly, optional
 	Flags() []string          //Defines how the characteristic value can be used - readonly
+	MTU() uint16              //The ATT MTU negotiated with the device, 0 if not reported - readonly, BlueZ 5.62+
 }
 
 // GetCharacteristic finds a Characteristic with the given UUID.
@@ -112,8 +156,34 @@ func (conn *Connection) GetCharacteristic(uuid string) (Characteristic, error) {
 	return conn.findGattObject(CharacteristicInterface, uuid)
 }
 
+// GetDeviceCharacteristics finds the GATT characteristics of the given device.
+func (conn *Connection) GetDeviceCharacteristics(device Device) ([]Characteristic, error) {
+	objects, err := conn.findObjects(CharacteristicInterface, func(char *blob) bool {
+		return strings.HasPrefix(string(char.Path()), string(device.Path())+"/")
+	})
+
+	chars := make([]Characteristic, len(objects))
+	for i := range chars {
+		chars[i] = objects[i]
+	}
+	return chars, err
+}
+
+// GetDeviceCharacteristic finds the Characteristic of the given device with the given UUID.
+func (conn *Connection) GetDeviceCharacteristic(device Device, uuid string) (Characteristic, error) {
+	uuid = ConvertUUID(uuid)
+	return conn.findObject(CharacteristicInterface, func(char *blob) bool {
+		return strings.HasPrefix(string(char.Path()), string(device.Path())+"/") && ConvertUUID(char.UUID()) == uuid
+	})
+}
+
 // ReadCharacteristic reads a Characteristic with the given UUID.
 func (conn *Connection) ReadCharacteristic(uuid string) ([]byte, error) {
+	return conn.ReadCharacteristicContext(context.Background(), uuid)
+}
+
+// ReadCharacteristicContext reads a Characteristic with the given UUID, cancelling the read when ctx is done.
+func (conn *Connection) ReadCharacteristicContext(ctx context.Context, uuid string) ([]byte, error) {
 
 	var char Characteristic
 	var err error
@@ -121,11 +191,16 @@ func (conn *Connection) ReadCharacteristic(uuid string) ([]byte, error) {
 		return nil, err
 	}
 
-	return char.ReadValue()
+	return char.ReadValueContext(ctx)
 }
 
 // WriteCharacteristic writes a Characteristic with the given UUID.
 func (conn *Connection) WriteCharacteristic(uuid string, value []byte) error {
+	return conn.WriteCharacteristicContext(context.Background(), uuid, value)
+}
+
+// WriteCharacteristicContext writes a Characteristic with the given UUID, cancelling the write when ctx is done.
+func (conn *Connection) WriteCharacteristicContext(ctx context.Context, uuid string, value []byte) error {
 
 	log.Printf("In WriteCharacteristic")
 	var char Characteristic
@@ -136,9 +211,7 @@ func (conn *Connection) WriteCharacteristic(uuid string, value []byte) error {
 
 	log.Printf("Characteristic retrieved")
 
-	//TODO see if flags allow value to be written
-
-	return char.WriteValue(value)
+	return char.WriteValueContext(ctx, value)
 }
 
 // Service returns the object path of the GATT service the characteristic belongs tog.
@@ -180,6 +253,13 @@ func (handle *blob) Notifying() bool {
 	return notifying
 }
 
+// MTU returns the ATT MTU of the connection the characteristic is accessed over,
+// or 0 if BlueZ does not report it.
+func (handle *blob) MTU() uint16 {
+	mtu, _ := handle.properties[BluezMTU].Value().(uint16)
+	return mtu
+}
+
 func (handle *blob) Flags() []string {
 	flags, ok := handle.properties[BluezFlags].Value().([]string)
 	if !ok {
@@ -188,8 +268,12 @@ func (handle *blob) Flags() []string {
 	return flags
 }
 
-// StartNotify starts notifying.
+// StartNotify starts notifying. Returns an error if the handle's flags do not
+// permit notifications or indications.
 func (handle *blob) StartNotify() error {
+	if err := handle.checkFlags(GattNotify); err != nil {
+		return err
+	}
 	return handle.call("StartNotify")
 }
 
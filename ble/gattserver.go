@@ -0,0 +1,247 @@
+package ble
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/prop"
+)
+
+// LocalService describes a GATT service served by this process when acting as a peripheral.
+type LocalService struct {
+	UUID            string
+	Primary         bool
+	Characteristics []LocalCharacteristic
+}
+
+// LocalCharacteristic describes a GATT characteristic served by this process.
+// Flags uses the values defined for the org.bluez.GattCharacteristic1 Flags property
+// (read, write, write-without-response, notify, indicate, encrypt-read, etc.).
+// See bluez/doc/gatt-api.txt
+type LocalCharacteristic struct {
+	UUID  string
+	Flags []string
+	Value []byte
+}
+
+// LocalWriteHandler represents a function that handles values written to a
+// local characteristic by a remote device.
+type LocalWriteHandler func(service string, characteristic string, value []byte, device dbus.ObjectPath)
+
+// LocalNotifyHandler represents a function that handles a remote device
+// enabling or disabling notifications on a local characteristic.
+type LocalNotifyHandler func(service string, characteristic string, notifying bool)
+
+// GattServer is a GATT application registered with the org.bluez.GattManager1
+// interface of an adapter.
+type GattServer struct {
+	app      *application
+	manager  *blob
+	onWrite  LocalWriteHandler
+	onNotify LocalNotifyHandler
+
+	characteristics map[string]*localCharacteristic
+}
+
+// localCharacteristic implements the methods of the org.bluez.GattCharacteristic1 interface
+type localCharacteristic struct {
+	server  *GattServer
+	path    dbus.ObjectPath
+	service string
+	uuid    string
+	flags   []string
+
+	mutex     sync.Mutex
+	value     []byte
+	notifying bool
+}
+
+// RegisterGattServer exports the given services below appPath and registers
+// them with the adapter. onWrite and onNotify are invoked, in their own
+// goroutine, when a remote device writes a characteristic or changes its
+// notification state.
+func (conn *Connection) RegisterGattServer(appPath dbus.ObjectPath, services []LocalService, onWrite LocalWriteHandler, onNotify LocalNotifyHandler) (*GattServer, error) {
+	manager, err := conn.findObject(GattManagerInterface, func(_ *blob) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := newApplication(conn, appPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &GattServer{
+		app:             app,
+		manager:         manager,
+		onWrite:         onWrite,
+		onNotify:        onNotify,
+		characteristics: make(map[string]*localCharacteristic),
+	}
+
+	for i, service := range services {
+		servicePath := dbus.ObjectPath(fmt.Sprintf("%s/service%d", appPath, i))
+		serviceUUID := ConvertUUID(service.UUID)
+
+		charPaths := []dbus.ObjectPath{}
+		for j, char := range service.Characteristics {
+			charPath := dbus.ObjectPath(fmt.Sprintf("%s/char%d", servicePath, j))
+			charPaths = append(charPaths, charPath)
+
+			local := &localCharacteristic{
+				server:  server,
+				path:    charPath,
+				service: serviceUUID,
+				uuid:    ConvertUUID(char.UUID),
+				flags:   char.Flags,
+				value:   char.Value,
+			}
+			if local.value == nil {
+				local.value = []byte{}
+			}
+
+			err = app.export(charPath,
+				map[string]interface{}{CharacteristicInterface: local},
+				prop.Map{CharacteristicInterface: {
+					BluezUUID:      {Value: local.uuid, Emit: prop.EmitConst},
+					BluezService:   {Value: servicePath, Emit: prop.EmitConst},
+					BluezFlags:     {Value: local.flags, Emit: prop.EmitConst},
+					BluezValue:     {Value: local.value, Emit: prop.EmitTrue},
+					BluezNotifying: {Value: false, Emit: prop.EmitTrue},
+				}})
+			if err != nil {
+				app.unexport()
+				return nil, err
+			}
+			server.characteristics[serviceUUID+"/"+local.uuid] = local
+		}
+
+		err = app.export(servicePath,
+			map[string]interface{}{ServiceInterface: nil},
+			prop.Map{ServiceInterface: {
+				BluezUUID:         {Value: serviceUUID, Emit: prop.EmitConst},
+				BluezPrimary:      {Value: service.Primary, Emit: prop.EmitConst},
+				"Characteristics": {Value: charPaths, Emit: prop.EmitConst},
+			}})
+		if err != nil {
+			app.unexport()
+			return nil, err
+		}
+	}
+
+	log.Printf("%s: registering GATT application %s", manager.Path(), appPath)
+	if err := manager.call("RegisterApplication", appPath, Properties{}); err != nil {
+		app.unexport()
+		return nil, err
+	}
+	return server, nil
+}
+
+// Unregister unregisters the GATT application and removes it from the bus.
+func (server *GattServer) Unregister() error {
+	log.Printf("%s: unregistering GATT application %s", server.manager.Path(), server.app.path)
+	err := server.manager.call("UnregisterApplication", server.app.path)
+	server.app.unexport()
+	return err
+}
+
+// SetValue sets the value returned when remote devices read a local characteristic.
+// Remote devices that enabled notifications are notified of the new value.
+func (server *GattServer) SetValue(service string, characteristic string, value []byte) error {
+	local, ok := server.characteristics[ConvertUUID(service)+"/"+ConvertUUID(characteristic)]
+	if !ok {
+		return fmt.Errorf("local characteristic %s of service %s not found", characteristic, service)
+	}
+
+	local.mutex.Lock()
+	local.value = value
+	local.mutex.Unlock()
+
+	//BlueZ sends notifications and indications when the Value property changes
+	server.app.setProperty(local.path, CharacteristicInterface, BluezValue, value)
+	return nil
+}
+
+// ReadValue is called by BlueZ when a remote device reads the characteristic.
+func (char *localCharacteristic) ReadValue(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+	if !char.hasFlag("read", "encrypt-read", "encrypt-authenticated-read", "secure-read") {
+		return nil, dbus.NewError("org.bluez.Error.NotPermitted", []interface{}{"Read not permitted"})
+	}
+
+	char.mutex.Lock()
+	defer char.mutex.Unlock()
+
+	offset, _ := options["offset"].Value().(uint16)
+	if int(offset) > len(char.value) {
+		return nil, dbus.NewError("org.bluez.Error.InvalidOffset", []interface{}{"Invalid offset"})
+	}
+	return char.value[offset:], nil
+}
+
+// WriteValue is called by BlueZ when a remote device writes the characteristic.
+func (char *localCharacteristic) WriteValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	if !char.hasFlag("write", "write-without-response", "encrypt-write", "encrypt-authenticated-write", "secure-write", "reliable-write") {
+		return dbus.NewError("org.bluez.Error.NotPermitted", []interface{}{"Write not permitted"})
+	}
+
+	char.mutex.Lock()
+	offset, _ := options["offset"].Value().(uint16)
+	if int(offset) > len(char.value) {
+		char.mutex.Unlock()
+		return dbus.NewError("org.bluez.Error.InvalidOffset", []interface{}{"Invalid offset"})
+	}
+	newValue := append(append([]byte{}, char.value[:offset]...), value...)
+	char.value = newValue
+	char.mutex.Unlock()
+
+	device, _ := options["device"].Value().(dbus.ObjectPath)
+	log.Printf("%s: value written by %s", char.path, device)
+
+	char.server.app.setProperty(char.path, CharacteristicInterface, BluezValue, newValue)
+	if char.server.onWrite != nil {
+		go char.server.onWrite(char.service, char.uuid, newValue, device)
+	}
+	return nil
+}
+
+// StartNotify is called by BlueZ when a remote device enables notifications.
+func (char *localCharacteristic) StartNotify() *dbus.Error {
+	if !char.hasFlag("notify", "indicate") {
+		return dbus.NewError("org.bluez.Error.NotSupported", []interface{}{"Notifications not supported"})
+	}
+	return char.setNotifying(true)
+}
+
+// StopNotify is called by BlueZ when a remote device disables notifications.
+func (char *localCharacteristic) StopNotify() *dbus.Error {
+	return char.setNotifying(false)
+}
+
+func (char *localCharacteristic) setNotifying(notifying bool) *dbus.Error {
+	char.mutex.Lock()
+	changed := char.notifying != notifying
+	char.notifying = notifying
+	char.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	log.Printf("%s: notifying = %t", char.path, notifying)
+	char.server.app.setProperty(char.path, CharacteristicInterface, BluezNotifying, notifying)
+	if char.server.onNotify != nil {
+		go char.server.onNotify(char.service, char.uuid, notifying)
+	}
+	return nil
+}
+
+func (char *localCharacteristic) hasFlag(flags ...string) bool {
+	for _, flag := range flags {
+		if stringArrayContains(char.flags, flag) {
+			return true
+		}
+	}
+	return false
+}
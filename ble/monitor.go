@@ -0,0 +1,183 @@
+package ble
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/prop"
+)
+
+// MonitorTypeOrPatterns is the advertisement monitor type that matches
+// advertisements containing any of the monitor's patterns.
+const MonitorTypeOrPatterns = "or_patterns"
+
+// MonitorPattern corresponds to an element of the org.bluez.AdvertisementMonitor1
+// Patterns property. Content is matched against the advertising data
+// of type ADType, starting at Position.
+// See bluez/doc/advertisement-monitor-api.txt
+type MonitorPattern struct {
+	Position uint8
+	ADType   uint8
+	Content  []byte
+}
+
+// AdvertisementMonitor holds the properties of an org.bluez.AdvertisementMonitor1 object.
+// Unset RSSI keys are not sent to BlueZ, which then uses its defaults.
+type AdvertisementMonitor struct {
+	Patterns           []MonitorPattern
+	RSSILowThreshold   *int16  //Devices with an RSSI below the threshold for RSSILowTimeout are lost
+	RSSIHighThreshold  *int16  //Devices with an RSSI above the threshold for RSSIHighTimeout are found
+	RSSILowTimeout     *uint16 //Seconds
+	RSSIHighTimeout    *uint16 //Seconds
+	RSSISamplingPeriod *uint16 //Units of 100ms, 0 reports every advertisement
+}
+
+// MonitorHandler represents a function that handles the DeviceFound
+// and DeviceLost calls made by BlueZ on an advertisement monitor.
+type MonitorHandler func(device dbus.ObjectPath)
+
+// MonitorApplication is a set of advertisement monitors registered with
+// the org.bluez.AdvertisementMonitorManager1 interface of an adapter.
+type MonitorApplication struct {
+	app     *application
+	manager *blob
+	found   MonitorHandler
+	lost    MonitorHandler
+}
+
+// monitorObject implements the methods of the org.bluez.AdvertisementMonitor1 interface
+type monitorObject struct {
+	path        dbus.ObjectPath
+	application *MonitorApplication
+}
+
+// Release is called by BlueZ when the monitor is removed.
+func (monitor *monitorObject) Release() *dbus.Error {
+	log.Printf("%s: advertisement monitor released", monitor.path)
+	return nil
+}
+
+// Activate is called by BlueZ when the monitor has been accepted.
+func (monitor *monitorObject) Activate() *dbus.Error {
+	log.Printf("%s: advertisement monitor activated", monitor.path)
+	return nil
+}
+
+// DeviceFound is called by BlueZ when a device matching the monitor is found.
+func (monitor *monitorObject) DeviceFound(device dbus.ObjectPath) *dbus.Error {
+	log.Printf("%s: device found %s", monitor.path, device)
+	monitor.record(MonitorDeviceFound, device)
+	if monitor.application.found != nil {
+		go monitor.application.found(device)
+	}
+	return nil
+}
+
+// DeviceLost is called by BlueZ when a device matching the monitor is lost.
+func (monitor *monitorObject) DeviceLost(device dbus.ObjectPath) *dbus.Error {
+	log.Printf("%s: device lost %s", monitor.path, device)
+	monitor.record(MonitorDeviceLost, device)
+	if monitor.application.lost != nil {
+		go monitor.application.lost(device)
+	}
+	return nil
+}
+
+// record adds a DeviceFound or DeviceLost call to the recording, if one is in progress.
+// The call is recorded as a signal so that it is replayed in order with the other signals.
+func (monitor *monitorObject) record(name string, device dbus.ObjectPath) {
+	monitor.application.app.conn.recordSignal(&dbus.Signal{Path: monitor.path, Name: name, Body: []interface{}{device}})
+}
+
+// SupportedMonitorTypes returns the monitor types supported by the adapter,
+// or an error if the adapter does not provide AdvertisementMonitorManager1.
+// The interface requires BlueZ 5.56+ running with the --experimental flag.
+func (conn *Connection) SupportedMonitorTypes() ([]string, error) {
+	manager, err := conn.findObject(AdvertisementMonitorManagerInterface, func(_ *blob) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	types, _ := manager.properties["SupportedMonitorTypes"].Value().([]string)
+	return types, nil
+}
+
+// RegisterMonitors exports the given advertisement monitors below appPath and
+// registers them with the adapter. found and lost are invoked, in their own
+// goroutine, whenever BlueZ reports a device matching one of the monitors.
+func (conn *Connection) RegisterMonitors(appPath dbus.ObjectPath, found MonitorHandler, lost MonitorHandler, monitors ...AdvertisementMonitor) (*MonitorApplication, error) {
+	manager, err := conn.findObject(AdvertisementMonitorManagerInterface, func(_ *blob) bool { return true })
+	if err != nil {
+		return nil, fmt.Errorf("advertisement monitors are not supported, BlueZ 5.56+ with experimental features is required: %s", err.Error())
+	}
+
+	if types, _ := manager.properties["SupportedMonitorTypes"].Value().([]string); !stringArrayContains(types, MonitorTypeOrPatterns) {
+		return nil, fmt.Errorf("adapter does not support %s advertisement monitors", MonitorTypeOrPatterns)
+	}
+
+	app, err := newApplication(conn, appPath)
+	if err != nil {
+		return nil, err
+	}
+
+	application := &MonitorApplication{
+		app:     app,
+		manager: manager,
+		found:   found,
+		lost:    lost,
+	}
+
+	for i, monitor := range monitors {
+		if len(monitor.Patterns) == 0 {
+			app.unexport()
+			return nil, fmt.Errorf("advertisement monitor %d does not contain any patterns", i)
+		}
+
+		path := dbus.ObjectPath(fmt.Sprintf("%s/monitor%d", appPath, i))
+		methods := map[string]interface{}{
+			AdvertisementMonitorInterface: &monitorObject{path: path, application: application},
+		}
+		if err := app.export(path, methods, prop.Map{AdvertisementMonitorInterface: monitor.properties()}); err != nil {
+			app.unexport()
+			return nil, err
+		}
+	}
+
+	log.Printf("%s: registering advertisement monitors %s", manager.Path(), appPath)
+	if err := manager.call("RegisterMonitor", appPath); err != nil {
+		app.unexport()
+		return nil, err
+	}
+	return application, nil
+}
+
+// Unregister unregisters the advertisement monitors and removes them from the bus.
+func (application *MonitorApplication) Unregister() error {
+	log.Printf("%s: unregistering advertisement monitors %s", application.manager.Path(), application.app.path)
+	err := application.manager.call("UnregisterMonitor", application.app.path)
+	application.app.unexport()
+	return err
+}
+
+func (monitor AdvertisementMonitor) properties() map[string]*prop.Prop {
+	props := map[string]*prop.Prop{
+		"Type":     {Value: MonitorTypeOrPatterns, Emit: prop.EmitConst},
+		"Patterns": {Value: monitor.Patterns, Emit: prop.EmitConst},
+	}
+	if monitor.RSSILowThreshold != nil {
+		props["RSSILowThreshold"] = &prop.Prop{Value: *monitor.RSSILowThreshold, Emit: prop.EmitConst}
+	}
+	if monitor.RSSIHighThreshold != nil {
+		props["RSSIHighThreshold"] = &prop.Prop{Value: *monitor.RSSIHighThreshold, Emit: prop.EmitConst}
+	}
+	if monitor.RSSILowTimeout != nil {
+		props["RSSILowTimeout"] = &prop.Prop{Value: *monitor.RSSILowTimeout, Emit: prop.EmitConst}
+	}
+	if monitor.RSSIHighTimeout != nil {
+		props["RSSIHighTimeout"] = &prop.Prop{Value: *monitor.RSSIHighTimeout, Emit: prop.EmitConst}
+	}
+	if monitor.RSSISamplingPeriod != nil {
+		props["RSSISamplingPeriod"] = &prop.Prop{Value: *monitor.RSSISamplingPeriod, Emit: prop.EmitConst}
+	}
+	return props
+}
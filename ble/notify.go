@@ -1,8 +1,10 @@
 package ble
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/godbus/dbus"
 )
@@ -10,19 +12,32 @@ import (
 var (
 	notifySignals = make(chan *dbus.Signal, 100)
 	notifyHandler = make(map[dbus.ObjectPath]NotifyHandler)
+	notifyMutex   sync.Mutex
 )
 
 func (char *blob) HandleNotify(handler NotifyHandler) error {
 	conn := char.conn
+	if conn.replay != nil {
+		return errors.New("notifications cannot be enabled when replaying a recording")
+	}
+	if err := char.checkFlags(GattNotify); err != nil {
+		return err
+	}
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
 	if len(notifyHandler) == 0 {
-		go notifyLoop()
+		go notifyLoop(conn)
 		conn.bus.Signal(notifySignals)
 	}
 	path := char.Path()
 	prev := notifyHandler[path]
 	notifyHandler[path] = handler
 	if prev != nil {
-		return nil
+		// BlueZ disables notifications when the device disconnects.
+		if char.Notifying() {
+			return nil
+		}
+		return char.StartNotify()
 	}
 	rule := fmt.Sprintf(PropertiesRule+",path='%s'", path)
 	err := conn.AddMatch(rule)
@@ -33,7 +48,9 @@ func (char *blob) HandleNotify(handler NotifyHandler) error {
 }
 
 func applyHandler(s *dbus.Signal) {
+	notifyMutex.Lock()
 	handler := notifyHandler[s.Path]
+	notifyMutex.Unlock()
 	if handler == nil {
 		log.Printf("%s: no notify handler", s.Path)
 		return
@@ -51,8 +68,9 @@ func applyHandler(s *dbus.Signal) {
 	}
 }
 
-func notifyLoop() {
+func notifyLoop(conn *Connection) {
 	for s := range notifySignals {
+		conn.recordSignal(s)
 		applyHandler(s)
 	}
 }
@@ -66,3 +84,29 @@ func (conn *Connection) HandleNotify(uuid string, handler NotifyHandler) error {
 	}
 	return char.HandleNotify(handler)
 }
+
+// StopNotifications stops notifications from every GATT characteristic
+// a handler was registered for, and removes the corresponding signal matches.
+func (conn *Connection) StopNotifications() error {
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
+	var lastErr error
+	for path := range notifyHandler {
+		rule := fmt.Sprintf(PropertiesRule+",path='%s'", path)
+		if err := conn.RemoveMatch(rule); err != nil {
+			log.Printf("%s: error removing notify match: %s", path, err.Error())
+			lastErr = err
+		}
+
+		char, err := conn.findGattObjectByPath(CharacteristicInterface, string(path))
+		if err == nil {
+			err = char.StopNotify()
+		}
+		if err != nil {
+			log.Printf("%s: error stopping notifications: %s", path, err.Error())
+			lastErr = err
+		}
+		delete(notifyHandler, path)
+	}
+	return lastErr
+}
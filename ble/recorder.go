@@ -0,0 +1,662 @@
+package ble
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+//Recording and replay of the DBUS signals and method replies seen by a Connection.
+//
+//A recording contains one JSON object per line, in the order the signals and replies were received:
+//
+//  {"time":"...","type":"signal","sender":":1.3","path":"/","name":"org.freedesktop.DBus.ObjectManager.InterfacesAdded","body":[...]}
+//  {"time":"...","type":"reply","path":"/","name":"org.freedesktop.DBus.ObjectManager.GetManagedObjects","body":[...]}
+//
+//Each element of body is {"sig":"<DBUS signature>","value":<value>}. The signature allows the
+//DBUS types, ex. int16 or dbus.ObjectPath, to be restored when the recording is replayed.
+//Byte arrays are recorded as hex strings and variants as nested {"sig","value"} objects.
+//
+//The DeviceFound and DeviceLost calls made by BlueZ on advertisement monitors are recorded as signals
+//named org.bluez.AdvertisementMonitor1.DeviceFound/DeviceLost, whose body is the device path.
+
+const (
+	recordTypeSignal = "signal"
+	recordTypeReply  = "reply"
+
+	//GetManagedObjects replies contain the entire object cache
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var (
+	variantType        = reflect.TypeOf(dbus.Variant{})
+	objectPathType     = reflect.TypeOf(dbus.ObjectPath(""))
+	signatureType      = reflect.TypeOf(dbus.Signature{})
+	interfaceSliceType = reflect.TypeOf([]interface{}{})
+
+	basicTypes = map[byte]reflect.Type{
+		'b': reflect.TypeOf(false),
+		'y': reflect.TypeOf(byte(0)),
+		'n': reflect.TypeOf(int16(0)),
+		'q': reflect.TypeOf(uint16(0)),
+		'i': reflect.TypeOf(int32(0)),
+		'u': reflect.TypeOf(uint32(0)),
+		'x': reflect.TypeOf(int64(0)),
+		't': reflect.TypeOf(uint64(0)),
+		'd': reflect.TypeOf(float64(0)),
+		's': reflect.TypeOf(""),
+		'o': objectPathType,
+		'g': signatureType,
+		'v': variantType,
+	}
+)
+
+//record - A signal or method reply contained in a recording
+type record struct {
+	Time   time.Time       `json:"time"`
+	Type   string          `json:"type"`
+	Sender string          `json:"sender,omitempty"`
+	Path   dbus.ObjectPath `json:"path"`
+	Name   string          `json:"name"`
+	Body   []recordValue   `json:"body"`
+	Error  string          `json:"error,omitempty"`
+}
+
+//recordValue - A DBUS value and its signature
+type recordValue struct {
+	Sig   string      `json:"sig"`
+	Value interface{} `json:"value"`
+}
+
+//recorder - Writes the signals and replies seen by a Connection to a file
+type recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+//replayer - Provides the signals and replies contained in a recording to a Connection
+type replayer struct {
+	mutex   sync.Mutex
+	records []record
+	speed   float64
+
+	//The index of the last signal returned by NextRecordedSignal
+	position int
+}
+
+//StartRecording - Record every signal and method reply seen by the connection to a file. The current
+//object cache is recorded first so that a replay starts with the same objects
+func (conn *Connection) StartRecording(fileName string) error {
+	if conn.replay != nil {
+		return errors.New("a replayed connection cannot be recorded")
+	}
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	conn.recorder = &recorder{file: file, encoder: json.NewEncoder(file)}
+	conn.recordReply("/", dot(ObjectManager, "GetManagedObjects"), []interface{}{conn.objects}, nil)
+
+	log.Printf("[INFO] Recording DBUS signals to %s", fileName)
+	return nil
+}
+
+//StopRecording - Stop recording and close the recording file
+func (conn *Connection) StopRecording() error {
+	if conn.recorder == nil {
+		return nil
+	}
+
+	conn.recorder.mutex.Lock()
+	defer conn.recorder.mutex.Unlock()
+
+	if conn.recorder.file == nil {
+		return nil
+	}
+	err := conn.recorder.file.Close()
+	conn.recorder.file = nil
+	return err
+}
+
+//recordSignal - Add a signal to the recording, if one is in progress
+func (conn *Connection) recordSignal(s *dbus.Signal) {
+	if conn.recorder == nil {
+		return
+	}
+	conn.recorder.write(record{
+		Time:   time.Now(),
+		Type:   recordTypeSignal,
+		Sender: s.Sender,
+		Path:   s.Path,
+		Name:   s.Name,
+		Body:   encodeBody(s.Body),
+	})
+}
+
+//recordReply - Add the reply to a method call to the recording, if one is in progress
+func (conn *Connection) recordReply(path dbus.ObjectPath, method string, body []interface{}, err error) {
+	if conn.recorder == nil {
+		return
+	}
+
+	theRecord := record{
+		Time: time.Now(),
+		Type: recordTypeReply,
+		Path: path,
+		Name: method,
+		Body: encodeBody(body),
+	}
+	if err != nil {
+		theRecord.Error = err.Error()
+	}
+	conn.recorder.write(theRecord)
+}
+
+func (rec *recorder) write(theRecord record) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	if rec.file == nil {
+		return
+	}
+	if err := rec.encoder.Encode(theRecord); err != nil {
+		log.Printf("[ERROR] Error writing to DBUS recording: %s", err.Error())
+	}
+}
+
+//OpenRecording - Open a Connection that replays a recording rather than connecting to DBUS.
+//Method calls return the recorded replies and signals are retrieved with NextRecordedSignal.
+//A speed of 1 replays signals with the recorded delays between them, 2 replays them twice as
+//fast and 0 replays them without delay.
+func OpenRecording(fileName string, speed float64) (*Connection, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	replay := &replayer{speed: speed, position: -1}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var theRecord record
+		decoder := json.NewDecoder(strings.NewReader(scanner.Text()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&theRecord); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fileName, line, err.Error())
+		}
+		replay.records = append(replay.records, theRecord)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	conn := &Connection{replay: replay}
+	if err := conn.Update(); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+	return conn, nil
+}
+
+//Replaying - Is the connection replaying a recording
+func (conn *Connection) Replaying() bool {
+	return conn.replay != nil
+}
+
+//NextRecordedSignal - Return the next signal contained in the recording, waiting for the recorded
+//delay when a replay speed was specified. Returns false when the end of the recording is reached
+//or ctx is cancelled.
+func (conn *Connection) NextRecordedSignal(ctx context.Context) (*dbus.Signal, bool) {
+	replay := conn.replay
+	if replay == nil {
+		return nil, false
+	}
+
+	for {
+		replay.mutex.Lock()
+		previous := replay.position
+		next := previous + 1
+		for next < len(replay.records) && replay.records[next].Type != recordTypeSignal {
+			next++
+		}
+		replay.mutex.Unlock()
+
+		if next >= len(replay.records) || ctx.Err() != nil {
+			return nil, false
+		}
+
+		theRecord := replay.records[next]
+		if replay.speed > 0 && previous >= 0 {
+			delay := float64(theRecord.Time.Sub(replay.records[previous].Time)) / replay.speed
+			select {
+			case <-time.After(time.Duration(delay)):
+			case <-ctx.Done():
+				return nil, false
+			}
+		}
+
+		replay.mutex.Lock()
+		replay.position = next
+		replay.mutex.Unlock()
+
+		body, err := decodeBody(theRecord.Body)
+		if err != nil {
+			log.Printf("[ERROR] Skipping recorded signal %s on %s: %s", theRecord.Name, theRecord.Path, err.Error())
+			continue
+		}
+		return &dbus.Signal{Sender: theRecord.Sender, Path: theRecord.Path, Name: theRecord.Name, Body: body}, true
+	}
+}
+
+//findReply - Find the recorded reply to a method call. The first reply received after the current
+//signal is used. If the method was not called while the signal was handled, the most recent
+//earlier reply is used.
+func (replay *replayer) findReply(path dbus.ObjectPath, method string) *record {
+	replay.mutex.Lock()
+	defer replay.mutex.Unlock()
+
+	matches := func(theRecord *record) bool {
+		return theRecord.Type == recordTypeReply && theRecord.Path == path && theRecord.Name == method
+	}
+
+	for ndx := replay.position + 1; ndx < len(replay.records) && replay.records[ndx].Type != recordTypeSignal; ndx++ {
+		if matches(&replay.records[ndx]) {
+			return &replay.records[ndx]
+		}
+	}
+	for ndx := replay.position; ndx >= 0; ndx-- {
+		if matches(&replay.records[ndx]) {
+			return &replay.records[ndx]
+		}
+	}
+	return nil
+}
+
+//call - Return the recorded reply to a method call
+func (replay *replayer) call(path dbus.ObjectPath, method string) *dbus.Call {
+	call := &dbus.Call{Destination: "org.bluez", Path: path, Method: method}
+
+	theRecord := replay.findReply(path, method)
+	if theRecord == nil {
+		call.Err = fmt.Errorf("no reply to %s on %s was recorded", method, path)
+		return call
+	}
+
+	if theRecord.Error != "" {
+		call.Err = errors.New(theRecord.Error)
+		return call
+	}
+	call.Body, call.Err = decodeBody(theRecord.Body)
+	return call
+}
+
+//updateObjects - Replace the object cache with the recorded reply to GetManagedObjects
+func (replay *replayer) updateObjects(conn *Connection) error {
+	call := replay.call("/", dot(ObjectManager, "GetManagedObjects"))
+	if call.Err != nil {
+		return call.Err
+	}
+
+	if len(call.Body) != 1 {
+		return errors.New("invalid GetManagedObjects reply recorded")
+	}
+	objects, ok := call.Body[0].(map[dbus.ObjectPath]map[string]map[string]dbus.Variant)
+	if !ok {
+		return errors.New("invalid GetManagedObjects reply recorded")
+	}
+	conn.objects = objects
+	return nil
+}
+
+func encodeBody(body []interface{}) []recordValue {
+	values := make([]recordValue, 0, len(body))
+	for _, value := range body {
+		values = append(values, encodeValue(value))
+	}
+	return values
+}
+
+func decodeBody(values []recordValue) ([]interface{}, error) {
+	body := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		decoded, err := decodeValue(value)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, decoded)
+	}
+	return body, nil
+}
+
+//encodeValue - Convert a DBUS value to its signature and a JSON representation
+func encodeValue(value interface{}) recordValue {
+	if value == nil {
+		return recordValue{}
+	}
+	theValue := reflect.ValueOf(value)
+	return recordValue{Sig: typeSignature(theValue.Type()), Value: encodeJSON(theValue)}
+}
+
+//typeSignature - Return the DBUS signature of a Go type. Interfaces are recorded as variants
+func typeSignature(t reflect.Type) string {
+	switch t {
+	case variantType:
+		return "v"
+	case objectPathType:
+		return "o"
+	case signatureType:
+		return "g"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "b"
+	case reflect.Uint8:
+		return "y"
+	case reflect.Int16:
+		return "n"
+	case reflect.Uint16:
+		return "q"
+	case reflect.Int, reflect.Int32:
+		return "i"
+	case reflect.Uint, reflect.Uint32:
+		return "u"
+	case reflect.Int64:
+		return "x"
+	case reflect.Uint64:
+		return "t"
+	case reflect.Float32, reflect.Float64:
+		return "d"
+	case reflect.String:
+		return "s"
+	case reflect.Slice, reflect.Array:
+		return "a" + typeSignature(t.Elem())
+	case reflect.Map:
+		return "a{" + typeSignature(t.Key()) + typeSignature(t.Elem()) + "}"
+	case reflect.Struct:
+		sig := "("
+		for ndx := 0; ndx < t.NumField(); ndx++ {
+			sig += typeSignature(t.Field(ndx).Type)
+		}
+		return sig + ")"
+	case reflect.Ptr:
+		return typeSignature(t.Elem())
+	case reflect.Interface:
+		return "v"
+	}
+
+	//Types that cannot be sent over DBUS are recorded as strings
+	return "s"
+}
+
+func encodeJSON(value reflect.Value) interface{} {
+	switch value.Type() {
+	case variantType:
+		return encodeValue(value.Interface().(dbus.Variant).Value())
+	case signatureType:
+		return value.Interface().(dbus.Signature).String()
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		return value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint()
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return value.String()
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			bytes := make([]byte, value.Len())
+			reflect.Copy(reflect.ValueOf(bytes), value)
+			return hex.EncodeToString(bytes)
+		}
+		elements := make([]interface{}, 0, value.Len())
+		for ndx := 0; ndx < value.Len(); ndx++ {
+			elements = append(elements, encodeJSON(value.Index(ndx)))
+		}
+		return elements
+	case reflect.Map:
+		entries := map[string]interface{}{}
+		for _, key := range value.MapKeys() {
+			entries[fmt.Sprint(key.Interface())] = encodeJSON(value.MapIndex(key))
+		}
+		return entries
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		if value.Kind() == reflect.Interface {
+			return encodeValue(value.Elem().Interface())
+		}
+		return encodeJSON(value.Elem())
+	case reflect.Struct:
+		fields := make([]interface{}, 0, value.NumField())
+		for ndx := 0; ndx < value.NumField(); ndx++ {
+			fields = append(fields, encodeJSON(value.Field(ndx)))
+		}
+		return fields
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+//decodeValue - Restore a DBUS value from its signature and JSON representation
+func decodeValue(value recordValue) (interface{}, error) {
+	if value.Sig == "" {
+		return nil, nil
+	}
+	decoded, err := decodeJSON(value.Sig, value.Value)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.Interface(), nil
+}
+
+func decodeJSON(sig string, raw interface{}) (reflect.Value, error) {
+	theType, err := typeForSignature(sig)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	switch {
+	case sig == "v":
+		inner, ok := raw.(map[string]interface{})
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected a variant, found %v", raw)
+		}
+		innerSig, _ := inner["sig"].(string)
+		value, err := decodeValue(recordValue{Sig: innerSig, Value: inner["value"]})
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(dbus.MakeVariant(value)), nil
+	case sig == "ay":
+		text, _ := raw.(string)
+		bytes, err := hex.DecodeString(text)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid byte array %v", raw)
+		}
+		return reflect.ValueOf(bytes), nil
+	case strings.HasPrefix(sig, "a{"):
+		entries, ok := raw.(map[string]interface{})
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected a dictionary, found %v", raw)
+		}
+		keySig, valueSig, err := nextType(sig[2 : len(sig)-1])
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		theMap := reflect.MakeMap(theType)
+		for key, entry := range entries {
+			theKey, err := decodeJSON(keySig, key)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			theValue, err := decodeJSON(valueSig, entry)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			theMap.SetMapIndex(theKey, theValue)
+		}
+		return theMap, nil
+	case strings.HasPrefix(sig, "a"), strings.HasPrefix(sig, "("):
+		elements, ok := raw.([]interface{})
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected an array, found %v", raw)
+		}
+		theSlice := reflect.MakeSlice(theType, 0, len(elements))
+		elementSigs := sig[1:]
+		if sig[0] == '(' {
+			elementSigs = sig[1 : len(sig)-1]
+		}
+		for _, element := range elements {
+			elementSig := elementSigs
+			if sig[0] == '(' {
+				if elementSig, elementSigs, err = nextType(elementSigs); err != nil {
+					return reflect.Value{}, err
+				}
+			}
+			theElement, err := decodeJSON(elementSig, element)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			theSlice = reflect.Append(theSlice, theElement)
+		}
+		return theSlice, nil
+	}
+
+	return decodeBasic(theType, raw)
+}
+
+//decodeBasic - Decode a basic value. Values are strings when they are dictionary keys
+func decodeBasic(theType reflect.Type, raw interface{}) (reflect.Value, error) {
+	text := fmt.Sprint(raw)
+	value := reflect.New(theType).Elem()
+
+	var err error
+	switch theType.Kind() {
+	case reflect.Bool:
+		var theBool bool
+		theBool, err = strconv.ParseBool(text)
+		value.SetBool(theBool)
+	case reflect.Int16, reflect.Int32, reflect.Int64:
+		var theInt int64
+		theInt, err = strconv.ParseInt(text, 10, theType.Bits())
+		value.SetInt(theInt)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var theUint uint64
+		theUint, err = strconv.ParseUint(text, 10, theType.Bits())
+		value.SetUint(theUint)
+	case reflect.Float64:
+		var theFloat float64
+		theFloat, err = strconv.ParseFloat(text, 64)
+		value.SetFloat(theFloat)
+	case reflect.String:
+		value.SetString(text)
+	default:
+		if theType == signatureType {
+			var sig dbus.Signature
+			sig, err = dbus.ParseSignature(text)
+			value.Set(reflect.ValueOf(sig))
+		} else {
+			err = fmt.Errorf("unsupported type %s", theType)
+		}
+	}
+
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid %s value %v", theType, raw)
+	}
+	return value, nil
+}
+
+//typeForSignature - Return the Go type used for a single complete DBUS type
+func typeForSignature(sig string) (reflect.Type, error) {
+	if sig == "" {
+		return nil, errors.New("empty signature")
+	}
+
+	if theType, ok := basicTypes[sig[0]]; ok && len(sig) == 1 {
+		return theType, nil
+	}
+
+	switch {
+	case strings.HasPrefix(sig, "a{") && strings.HasSuffix(sig, "}"):
+		keySig, valueSig, err := nextType(sig[2 : len(sig)-1])
+		if err != nil {
+			return nil, err
+		}
+		keyType, err := typeForSignature(keySig)
+		if err != nil {
+			return nil, err
+		}
+		valueType, err := typeForSignature(valueSig)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(keyType, valueType), nil
+	case strings.HasPrefix(sig, "a"):
+		elementType, err := typeForSignature(sig[1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elementType), nil
+	case strings.HasPrefix(sig, "(") && strings.HasSuffix(sig, ")"):
+		//Structs are decoded as []interface{}, as they are by godbus
+		return interfaceSliceType, nil
+	}
+	return nil, fmt.Errorf("unsupported signature %s", sig)
+}
+
+//nextType - Split the first complete type from a signature, ex. a{sv}as returns a{sv} and as
+func nextType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errors.New("incomplete signature")
+	}
+
+	switch sig[0] {
+	case 'a':
+		element, rest, err := nextType(sig[1:])
+		return "a" + element, rest, err
+	case '{', '(':
+		closing := byte('}')
+		if sig[0] == '(' {
+			closing = ')'
+		}
+		end := 1
+		for end < len(sig) && sig[end] != closing {
+			_, rest, err := nextType(sig[end:])
+			if err != nil {
+				return "", "", err
+			}
+			end = len(sig) - len(rest)
+		}
+		if end >= len(sig) {
+			return "", "", fmt.Errorf("incomplete signature %s", sig)
+		}
+		return sig[:end+1], sig[end+1:], nil
+	}
+	return sig[:1], sig[1:], nil
+}
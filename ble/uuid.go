@@ -1,6 +1,9 @@
 package ble
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 func hexMatch(s, pattern string) bool {
 	const hexDigits = "0123456789abcdef"
@@ -36,20 +39,51 @@ func ValidUUID(u string) bool {
 	}
 }
 
-// ConvertUUID creates the 128 bit representation of a uuid from a
-//16, 32, or 128 bit uuid
-func ConvertUUID(uuid string) string {
-	var longuuid = BluetoothBaseUUID
+// NormalizeUUID returns the canonical lower case 128 bit representation of a uuid.
+// 16 and 32 bit Bluetooth SIG uuids, ex. 180d or 0x180D, are expanded using the
+// Bluetooth base uuid. Returns an error if the uuid is not valid.
+func NormalizeUUID(uuid string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(uuid))
+	if len(normalized) == 6 || len(normalized) == 10 {
+		normalized = strings.TrimPrefix(normalized, "0x")
+	}
+	if !ValidUUID(normalized) {
+		return "", fmt.Errorf("invalid UUID %s", uuid)
+	}
 
-	switch len(uuid) {
+	switch len(normalized) {
 	case 4:
 		//Convert 16bit uuid to 128 bit uuid
-		strings.Replace(longuuid, "00000000", "0000"+uuid, 1)
+		normalized = "0000" + normalized + BluetoothBaseUUID[8:]
 	case 8:
 		//convert 32bit uuid to 128 bit uuid
-		strings.Replace(longuuid, "00000000", uuid, 1)
-	default:
-		longuuid = uuid
+		normalized = normalized + BluetoothBaseUUID[8:]
+	}
+	return strings.ToLower(normalized), nil
+}
+
+// NormalizeUUIDs normalizes each uuid with NormalizeUUID.
+func NormalizeUUIDs(uuids []string) ([]string, error) {
+	normalized := make([]string, len(uuids))
+	for i, uuid := range uuids {
+		var err error
+		if normalized[i], err = NormalizeUUID(uuid); err != nil {
+			return nil, err
+		}
+	}
+	return normalized, nil
+}
+
+// ConvertUUID creates the 128 bit representation of a uuid from a
+// 16, 32, or 128 bit uuid. Invalid uuids are returned in lower case.
+func ConvertUUID(uuid string) string {
+	if normalized, err := NormalizeUUID(uuid); err == nil {
+		return normalized
 	}
-	return strings.ToLower(longuuid)
+	return strings.ToLower(uuid)
+}
+
+// EqualUUIDs reports whether two uuids are equal, once converted to their 128 bit representation.
+func EqualUUIDs(a, b string) bool {
+	return ConvertUUID(a) == ConvertUUID(b)
 }
@@ -0,0 +1,120 @@
+package ble
+
+import "testing"
+
+func TestNormalizeUUID(t *testing.T) {
+	tests := []struct {
+		name       string
+		uuid       string
+		normalized string
+	}{
+		{"16 bit", "180d", "0000180d-0000-1000-8000-00805f9b34fb"},
+		{"16 bit upper case", "180D", "0000180d-0000-1000-8000-00805f9b34fb"},
+		{"16 bit with prefix", "0x180d", "0000180d-0000-1000-8000-00805f9b34fb"},
+		{"16 bit with upper case prefix", "0X180D", "0000180d-0000-1000-8000-00805f9b34fb"},
+		{"16 bit with whitespace", " 180d\n", "0000180d-0000-1000-8000-00805f9b34fb"},
+		{"32 bit", "1234abcd", "1234abcd-0000-1000-8000-00805f9b34fb"},
+		{"32 bit with prefix", "0x1234ABCD", "1234abcd-0000-1000-8000-00805f9b34fb"},
+		{"128 bit", "da2e7828-fbce-4e01-ae9e-261174997c48", "da2e7828-fbce-4e01-ae9e-261174997c48"},
+		{"128 bit upper case", "DA2E7828-FBCE-4E01-AE9E-261174997C48", "da2e7828-fbce-4e01-ae9e-261174997c48"},
+		{"128 bit base uuid", "0000180D-0000-1000-8000-00805F9B34FB", "0000180d-0000-1000-8000-00805f9b34fb"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalized, err := NormalizeUUID(test.uuid)
+			if err != nil {
+				t.Fatalf("NormalizeUUID(%q) returned error: %s", test.uuid, err.Error())
+			}
+			if normalized != test.normalized {
+				t.Errorf("NormalizeUUID(%q) = %q, expected %q", test.uuid, normalized, test.normalized)
+			}
+		})
+	}
+}
+
+func TestNormalizeUUIDInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		uuid string
+	}{
+		{"empty", ""},
+		{"too short", "18d"},
+		{"prefix only", "0x"},
+		{"non hex 16 bit", "18zz"},
+		{"12 bit with prefix", "0x18d"},
+		{"24 bit", "12abcd"},
+		{"prefixed 128 bit", "0xda2e7828-fbce-4e01-ae9e-261174997c48"},
+		{"128 bit without dashes", "da2e7828fbce4e01ae9e261174997c48"},
+		{"128 bit with misplaced dashes", "da2e782-8fbce-4e01-ae9e-261174997c48"},
+		{"non hex 128 bit", "da2e7828-fbce-4e01-ae9e-26117499zc48"},
+		{"128 bit with braces", "{da2e7828-fbce-4e01-ae9e-261174997c48}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if normalized, err := NormalizeUUID(test.uuid); err == nil {
+				t.Errorf("NormalizeUUID(%q) = %q, expected an error", test.uuid, normalized)
+			}
+		})
+	}
+}
+
+func TestNormalizeUUIDs(t *testing.T) {
+	normalized, err := NormalizeUUIDs([]string{"180d", "0x2A37"})
+	if err != nil {
+		t.Fatalf("NormalizeUUIDs returned error: %s", err.Error())
+	}
+	expected := []string{"0000180d-0000-1000-8000-00805f9b34fb", "00002a37-0000-1000-8000-00805f9b34fb"}
+	for i := range expected {
+		if normalized[i] != expected[i] {
+			t.Errorf("NormalizeUUIDs returned %q at %d, expected %q", normalized[i], i, expected[i])
+		}
+	}
+
+	if _, err := NormalizeUUIDs([]string{"180d", "invalid"}); err == nil {
+		t.Error("NormalizeUUIDs with an invalid uuid did not return an error")
+	}
+}
+
+func TestConvertUUID(t *testing.T) {
+	tests := []struct {
+		uuid      string
+		converted string
+	}{
+		{"0x180D", "0000180d-0000-1000-8000-00805f9b34fb"},
+		{"1234ABCD", "1234abcd-0000-1000-8000-00805f9b34fb"},
+		{"Not-A-UUID", "not-a-uuid"},
+	}
+
+	for _, test := range tests {
+		if converted := ConvertUUID(test.uuid); converted != test.converted {
+			t.Errorf("ConvertUUID(%q) = %q, expected %q", test.uuid, converted, test.converted)
+		}
+	}
+}
+
+func TestEqualUUIDs(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"180d", "180D", true},
+		{"180d", "0x180d", true},
+		{"180d", "0000180d-0000-1000-8000-00805f9b34fb", true},
+		{"0X180D", "0000180D-0000-1000-8000-00805F9B34FB", true},
+		{"1234abcd", "1234ABCD-0000-1000-8000-00805F9B34FB", true},
+		{"da2e7828-fbce-4e01-ae9e-261174997c48", "DA2E7828-FBCE-4E01-AE9E-261174997C48", true},
+		{"180d", "180f", false},
+		{"180d", "0001180d", false},
+		{"180d", "da2e7828-fbce-4e01-ae9e-261174997c48", false},
+		{"invalid", "INVALID", true},
+		{"invalid", "180d", false},
+	}
+
+	for _, test := range tests {
+		if equal := EqualUUIDs(test.a, test.b); equal != test.equal {
+			t.Errorf("EqualUUIDs(%q, %q) = %t, expected %t", test.a, test.b, equal, test.equal)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package bleadapter
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+	"github.com/godbus/dbus"
+)
+
+//Helper methods related to passive scanning with BlueZ advertisement monitors
+//
+//When scan_mode is "passive", the scan/pause discovery cycle is replaced by an
+//advertisement monitor registered with AdvertisementMonitorManager1. BlueZ scans
+//passively and continuously, calling DeviceFound/DeviceLost for devices whose
+//advertisements match one of the patterns in the BLE_Monitor_Patterns collection.
+//
+//DeviceFound is only called once for each device, so the PropertiesChanged signals of
+//found devices are watched until they are lost. The device is published, and the
+//advertisement rules evaluated, when its properties change, at most once every
+//monitorPublishInterval. RSSI changes alone can be reported several times a second.
+
+const (
+	monitorPatternsCollectionName = "BLE_Monitor_Patterns"
+	monitorAppPath                = dbus.ObjectPath("/com/clearblade/bleadapter/monitor")
+
+	scanModeActive  = "active"
+	scanModePassive = "passive"
+
+	//The minimum time between publishes of a device found by the advertisement monitor
+	monitorPublishInterval = time.Second
+)
+
+var (
+	scanMode = scanModeActive
+
+	//RSSI thresholds applied to the advertisement monitor, retrieved from the adapter config
+	monitorConfig cbble.AdvertisementMonitor
+
+	//The devices found by the advertisement monitor whose property changes are being watched,
+	//keyed by device path
+	monitorWatches      = make(map[dbus.ObjectPath]*monitorWatch)
+	monitorWatchesMutex sync.Mutex
+)
+
+//monitorWatch - A device found by the advertisement monitor. Fields other than cancel are
+//guarded by monitorWatchesMutex
+type monitorWatch struct {
+	//Stops watching the device
+	cancel context.CancelFunc
+
+	lastPublished time.Time
+
+	//Set when a publish has been scheduled but has not yet run
+	pending bool
+}
+
+//startPassiveScan - Register an advertisement monitor using the current configuration.
+//If a monitor with the same configuration is already registered, nothing is done.
+func (adapt *BleAdapter) startPassiveScan() error {
+	patterns, err := adapt.getMonitorPatterns()
+	if err != nil {
+		return err
+	}
+
+	monitor := monitorConfig
+	monitor.Patterns = patterns
+
+	if adapt.monitorApp != nil {
+		if reflect.DeepEqual(adapt.monitor, monitor) {
+			log.Printf("[DEBUG] Advertisement monitor configuration unchanged")
+			return nil
+		}
+		adapt.stopPassiveScan()
+	}
+
+	if len(patterns) == 0 {
+		return errors.New("No enabled patterns found in " + monitorPatternsCollectionName)
+	}
+
+	//Refresh the list of managed objects so the AdvertisementMonitorManager1 interface can be found
+	if err := adapt.connection.Update(); err != nil {
+		log.Printf("[ERROR] Error updating object cache: %#v", err)
+	}
+
+	app, err := adapt.connection.RegisterMonitors(monitorAppPath, adapt.handleMonitorDeviceFound, adapt.handleMonitorDeviceLost, monitor)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Advertisement monitor registered with %d patterns", len(patterns))
+	adapt.monitorApp = app
+	adapt.monitor = monitor
+	return nil
+}
+
+//stopPassiveScan - Unregister the advertisement monitor, if one is registered
+func (adapt *BleAdapter) stopPassiveScan() {
+	if adapt.monitorApp == nil {
+		return
+	}
+
+	if err := adapt.monitorApp.Unregister(); err != nil {
+		log.Printf("[ERROR] Error unregistering advertisement monitor: %s", err.Error())
+	}
+	adapt.monitorApp = nil
+	adapt.monitor = cbble.AdvertisementMonitor{}
+
+	monitorWatchesMutex.Lock()
+	for path, watch := range monitorWatches {
+		watch.cancel()
+		delete(monitorWatches, path)
+	}
+	monitorWatchesMutex.Unlock()
+}
+
+//handleMonitorDeviceFound - Publish devices reported by the advertisement monitor and watch them for changes
+func (adapt *BleAdapter) handleMonitorDeviceFound(path dbus.ObjectPath) {
+	log.Printf("[DEBUG] Advertisement monitor found device: %s", path)
+	address := cbble.ParseAddressFromPath(string(path))
+	adapt.publishDevice(address)
+
+	//The recorded property changes of the device are replayed as signals
+	if !adapt.connection.Replaying() {
+		adapt.watchMonitorDevice(path, address)
+	}
+}
+
+//watchMonitorDevice - Publish a device found by the advertisement monitor when its properties
+//change, until the device is lost or the monitor is unregistered
+func (adapt *BleAdapter) watchMonitorDevice(path dbus.ObjectPath, address string) {
+	monitorWatchesMutex.Lock()
+	defer monitorWatchesMutex.Unlock()
+
+	if _, ok := monitorWatches[path]; ok {
+		return
+	}
+
+	//publishDevice has already refreshed the object cache
+	device, err := adapt.connection.GetDeviceByAddress(address)
+	if err != nil {
+		log.Printf("[WARN] Unable to watch device %s found by the advertisement monitor: %s", address, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(adapt.ctx)
+	watch := &monitorWatch{cancel: cancel, lastPublished: time.Now()}
+	err = adapt.connection.WatchDevice(ctx, device, func(changed map[string]dbus.Variant) {
+		adapt.schedulePublish(path, address, watch)
+	})
+	if err != nil {
+		cancel()
+		log.Printf("[WARN] Unable to watch device %s found by the advertisement monitor: %s", address, err.Error())
+		return
+	}
+
+	monitorWatches[path] = watch
+}
+
+//schedulePublish - Publish a watched device once monitorPublishInterval has passed since it was last
+//published. Changes received while a publish is pending are included in that publish, since the
+//device is read from the object cache when it is published
+func (adapt *BleAdapter) schedulePublish(path dbus.ObjectPath, address string, watch *monitorWatch) {
+	monitorWatchesMutex.Lock()
+	defer monitorWatchesMutex.Unlock()
+
+	if watch.pending || monitorWatches[path] != watch {
+		return
+	}
+	watch.pending = true
+
+	//Runs in its own goroutine, so the signal handlers of other devices are not blocked
+	time.AfterFunc(monitorPublishInterval-time.Since(watch.lastPublished), func() {
+		monitorWatchesMutex.Lock()
+		watched := monitorWatches[path] == watch
+		watch.pending = false
+		watch.lastPublished = time.Now()
+		monitorWatchesMutex.Unlock()
+
+		//The device was lost while the publish was pending
+		if !watched {
+			return
+		}
+		log.Printf("[DEBUG] Advertisement monitor device changed: %s", path)
+		adapt.publishDevice(address)
+	})
+}
+
+//handleMonitorDeviceLost - Publish the address of devices the advertisement monitor no longer sees
+func (adapt *BleAdapter) handleMonitorDeviceLost(path dbus.ObjectPath) {
+	log.Printf("[DEBUG] Advertisement monitor lost device: %s", path)
+
+	monitorWatchesMutex.Lock()
+	if watch, ok := monitorWatches[path]; ok {
+		watch.cancel()
+		delete(monitorWatches, path)
+	}
+	monitorWatchesMutex.Unlock()
+
+	lostJSON, err := json.Marshal(map[string]interface{}{
+		devicePath:    path,
+		deviceAddress: cbble.ParseAddressFromPath(string(path)),
+	})
+	if err != nil {
+		log.Printf("[ERROR] error marshaling lost device into json: %s", err.Error())
+		return
+	}
+
+	if puberr := adapt.transport.Publish(publishTopic+"/lost", lostJSON, messagingQos); puberr != nil {
+		log.Printf("[ERROR] Error occurred when publishing lost device to MQTT: %v", puberr)
+	}
+}
+
+//getMonitorPatterns - Retrieve the advertisement monitor patterns from the platform
+func (adapt *BleAdapter) getMonitorPatterns() ([]cbble.MonitorPattern, error) {
+	rows, err := adapt.transport.GetCollection(monitorPatternsCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := []cbble.MonitorPattern{}
+
+	for _, theRow := range rows {
+		if enabled, _ := theRow["enabled"].(bool); !enabled {
+			continue
+		}
+
+		adType, _ := theRow["ad_type"].(float64)
+		position, _ := theRow["position"].(float64)
+		content, _ := theRow["content"].(string)
+
+		//Content is specified as a hex string, ex. 4c000215
+		contentBytes, err := hex.DecodeString(strings.Replace(strings.TrimPrefix(content, "0x"), ":", "", -1))
+		if err != nil || len(contentBytes) == 0 {
+			log.Printf("[WARN] Skipping advertisement monitor pattern with invalid content \"%s\"", content)
+			continue
+		}
+
+		patterns = append(patterns, cbble.MonitorPattern{
+			Position: uint8(position),
+			ADType:   uint8(adType),
+			Content:  contentBytes,
+		})
+	}
+
+	log.Printf("[DEBUG] Returning advertisement monitor patterns: %#v", patterns)
+	return patterns, nil
+}
+
+//getMonitorConfig - Create the advertisement monitor RSSI settings from the monitor_* adapter configuration columns
+func getMonitorConfig(config map[string]interface{}) cbble.AdvertisementMonitor {
+	monitor := cbble.AdvertisementMonitor{}
+
+	if low, ok := config["monitor_rssi_low_threshold"].(float64); ok && low != 0 {
+		theLow := int16(low)
+		monitor.RSSILowThreshold = &theLow
+	}
+
+	if high, ok := config["monitor_rssi_high_threshold"].(float64); ok && high != 0 {
+		theHigh := int16(high)
+		monitor.RSSIHighThreshold = &theHigh
+	}
+
+	if lowTimeout, ok := config["monitor_rssi_low_timeout"].(float64); ok && lowTimeout != 0 {
+		theLowTimeout := uint16(lowTimeout)
+		monitor.RSSILowTimeout = &theLowTimeout
+	}
+
+	if highTimeout, ok := config["monitor_rssi_high_timeout"].(float64); ok && highTimeout != 0 {
+		theHighTimeout := uint16(highTimeout)
+		monitor.RSSIHighTimeout = &theHighTimeout
+	}
+
+	if period, ok := config["monitor_rssi_sampling_period"].(float64); ok {
+		thePeriod := uint16(period)
+		monitor.RSSISamplingPeriod = &thePeriod
+	}
+
+	return monitor
+}
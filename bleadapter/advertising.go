@@ -0,0 +1,416 @@
+package bleadapter
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+	"github.com/godbus/dbus"
+)
+
+//Helper methods related to the startAdvertising and stopAdvertising commands
+//
+//Advertisements are identified by the advertisementId specified in the command, allowing
+//multiple advertisement instances to be broadcast concurrently, up to the number of
+//instances supported by the controller.
+
+const (
+	advertisementBasePath = "/com/clearblade/bleadapter/advertisement"
+
+	advertisementIBeacon      = "ibeacon"
+	advertisementEddystoneUID = "eddystoneuid"
+	advertisementEddystoneURL = "eddystoneurl"
+	advertisementCustom       = "custom"
+
+	appleCompanyID = 0x004C
+	eddystoneUUID  = "0000feaa-0000-1000-8000-00805f9b34fb"
+)
+
+var (
+	advertisements      = make(map[string]*cbble.AdvertisementInstance)
+	advertisementsMutex sync.Mutex
+	advertisementCount  = 0
+)
+
+//Eddystone-URL scheme prefixes and expansion codes
+var (
+	eddystoneURLSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+	eddystoneURLCodes   = []string{".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+		".com", ".org", ".edu", ".net", ".info", ".biz", ".gov"}
+)
+
+//StartAdvertising - A struct used to encapsulate the "start advertising" subcommand
+type StartAdvertising struct{}
+
+//StopAdvertising - A struct used to encapsulate the "stop advertising" subcommand
+type StopAdvertising struct{}
+
+//Name - Return the name of the subcommand
+func (cmd StartAdvertising) Name() string {
+	return "StartAdvertising"
+}
+
+//Process - Execute the subcommand
+func (cmd StartAdvertising) Process(blecmd *BLECommand) error {
+	id, _ := blecmd.command["advertisementId"].(string)
+	advertisement, err := createAdvertisement(blecmd.command)
+	if err != nil {
+		log.Printf("[ERROR] Invalid advertisement: %s", err.Error())
+		return newCommandError(cmd.Name(), errorCodeInvalidCommand, "Unable to start advertising. Invalid advertisement: "+err.Error(), err)
+	}
+
+	advertisementsMutex.Lock()
+	defer advertisementsMutex.Unlock()
+
+	//Replace any advertisement already using the same id
+	if existing, ok := advertisements[id]; ok {
+		if err := existing.Unregister(); err != nil {
+			log.Printf("[WARN] Error unregistering advertisement %s: %s", id, err.Error())
+		}
+		delete(advertisements, id)
+	}
+
+	advertisementCount++
+	path := dbus.ObjectPath(fmt.Sprintf("%s%d", advertisementBasePath, advertisementCount))
+
+	var instance *cbble.AdvertisementInstance
+	instance, err = blecmd.adapter.connection.RegisterAdvertisement(path, advertisement, func() {
+		//BlueZ released the advertisement, typically because its timeout elapsed
+		advertisementsMutex.Lock()
+		defer advertisementsMutex.Unlock()
+		if advertisements[id] == instance {
+			delete(advertisements, id)
+		}
+	})
+
+	blecmd.command["advertisingLimits"] = getAdvertisingLimits(blecmd)
+
+	if err != nil {
+		log.Printf("[ERROR] Error while registering advertisement: %s", err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to start advertising. Error received when registering the advertisement: "+err.Error(), err)
+	}
+	advertisements[id] = instance
+
+	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	return nil
+}
+
+//Name - Return the name of the subcommand
+func (cmd StopAdvertising) Name() string {
+	return "StopAdvertising"
+}
+
+//Process - Execute the subcommand. If no advertisement id is specified, all advertisements are stopped.
+func (cmd StopAdvertising) Process(blecmd *BLECommand) error {
+	id, _ := blecmd.command["advertisementId"].(string)
+
+	advertisementsMutex.Lock()
+	defer advertisementsMutex.Unlock()
+
+	if id != "" {
+		if _, ok := advertisements[id]; !ok {
+			log.Printf("[ERROR] Unable to stop advertising. Advertisement %s not found.", id)
+			return newCommandError(cmd.Name(), errorCodeInvalidCommand, "Unable to stop advertising. Advertisement "+id+" not found.", nil)
+		}
+	}
+
+	var err error
+	for theID, instance := range advertisements {
+		if id != "" && theID != id {
+			continue
+		}
+		if unregErr := instance.Unregister(); unregErr != nil {
+			log.Printf("[ERROR] Error while unregistering advertisement %s: %s", theID, unregErr.Error())
+			err = newCommandError(cmd.Name(), "", "Unable to stop advertising. Error received when unregistering the advertisement: "+unregErr.Error(), unregErr)
+		}
+		delete(advertisements, theID)
+	}
+
+	blecmd.command["advertisingLimits"] = getAdvertisingLimits(blecmd)
+
+	if err == nil {
+		log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	}
+	return err
+}
+
+//stopAllAdvertisements - Unregister every advertisement instance
+func stopAllAdvertisements() {
+	advertisementsMutex.Lock()
+	defer advertisementsMutex.Unlock()
+
+	for id, instance := range advertisements {
+		if err := instance.Unregister(); err != nil {
+			log.Printf("[ERROR] Error while unregistering advertisement %s: %s", id, err.Error())
+		}
+		delete(advertisements, id)
+	}
+}
+
+func getAdvertisingLimits(blecmd *BLECommand) interface{} {
+	//Refresh the object cache so that ActiveInstances is current
+	if err := blecmd.adapter.connection.Update(); err != nil {
+		log.Printf("[ERROR] Error updating object cache: %#v", err)
+	}
+
+	limits, err := blecmd.adapter.connection.GetAdvertisingLimits()
+	if err != nil {
+		log.Printf("[WARN] Unable to retrieve advertising limits: %s", err.Error())
+		return nil
+	}
+	log.Printf("[DEBUG] Advertising limits: %s", limits)
+	return limits
+}
+
+//createAdvertisement - Create an advertisement from the startAdvertising command
+//
+// {
+//		"command": "startAdvertising",
+//		"advertisementId": "beacon1",
+//		"advertisementType": "ibeacon" | "eddystoneUid" | "eddystoneUrl" | "custom",
+//		"ibeacon": {"uuid": (uuid), "major": 1, "minor": 2, "measuredPower": -59},
+//		"eddystone": {"namespace": (20 hex characters), "instance": (12 hex characters), "url": (url), "txPower": -20},
+//		"manufacturerData": {"id": 76, "data": [1, 2, 3]},
+//		"serviceData": {"uuid": (uuid), "data": [1, 2, 3]},
+//		"serviceUUIDs": [(uuid)],
+//		"localName": "",
+//		"connectable": true|false,
+//		"minIntervalMs": 100,
+//		"maxIntervalMs": 200,
+//		"txPower": -20,
+//		"durationSeconds": 60
+// }
+func createAdvertisement(command map[string]interface{}) (cbble.Advertisement, error) {
+	advertisement := cbble.Advertisement{
+		Type:             cbble.AdvertisementBroadcast,
+		ManufacturerData: map[uint16][]byte{},
+		ServiceData:      map[string][]byte{},
+	}
+
+	advType, _ := command["advertisementType"].(string)
+	switch strings.ToLower(advType) {
+	case advertisementIBeacon:
+		params, _ := command["ibeacon"].(map[string]interface{})
+		data, err := createIBeaconData(params)
+		if err != nil {
+			return advertisement, err
+		}
+		advertisement.ManufacturerData[appleCompanyID] = data
+	case advertisementEddystoneUID, advertisementEddystoneURL:
+		params, _ := command["eddystone"].(map[string]interface{})
+		data, err := createEddystoneData(strings.ToLower(advType), params)
+		if err != nil {
+			return advertisement, err
+		}
+		advertisement.ServiceUUIDs = []string{eddystoneUUID}
+		advertisement.ServiceData[eddystoneUUID] = data
+	case "", advertisementCustom:
+	default:
+		return advertisement, errors.New("Invalid advertisement type " + advType)
+	}
+
+	//Custom data can be combined with any advertisement type
+	if manData, ok := command["manufacturerData"].(map[string]interface{}); ok {
+		theID, ok := manData["id"].(float64)
+		if !ok {
+			return advertisement, errors.New("manufacturerData id not provided")
+		}
+		id, err := jsonUint16("manufacturerData id", theID)
+		if err != nil {
+			return advertisement, err
+		}
+		data, err := jsonByteArray(manData["data"])
+		if err != nil {
+			return advertisement, errors.New("Invalid manufacturerData data: " + err.Error())
+		}
+		advertisement.ManufacturerData[id] = data
+	}
+
+	if servData, ok := command["serviceData"].(map[string]interface{}); ok {
+		theUUID, _ := servData["uuid"].(string)
+		uuid, err := cbble.NormalizeUUID(theUUID)
+		if err != nil {
+			return advertisement, errors.New("Invalid serviceData uuid " + theUUID)
+		}
+		data, err := jsonByteArray(servData["data"])
+		if err != nil {
+			return advertisement, errors.New("Invalid serviceData data: " + err.Error())
+		}
+		advertisement.ServiceData[uuid] = data
+	}
+
+	if uuids, ok := command["serviceUUIDs"].([]interface{}); ok {
+		for _, uuid := range uuids {
+			theUUID, _ := uuid.(string)
+			normalized, err := cbble.NormalizeUUID(theUUID)
+			if err != nil {
+				return advertisement, errors.New("Invalid service uuid " + theUUID)
+			}
+			advertisement.ServiceUUIDs = append(advertisement.ServiceUUIDs, normalized)
+		}
+	}
+
+	advertisement.LocalName, _ = command["localName"].(string)
+
+	if command["connectable"] == true {
+		advertisement.Type = cbble.AdvertisementPeripheral
+	}
+
+	if minInterval, ok := command["minIntervalMs"].(float64); ok {
+		advertisement.MinInterval = uint32(minInterval)
+	}
+	if maxInterval, ok := command["maxIntervalMs"].(float64); ok {
+		advertisement.MaxInterval = uint32(maxInterval)
+	}
+	if advertisement.MinInterval > 0 && advertisement.MaxInterval > 0 && advertisement.MinInterval > advertisement.MaxInterval {
+		return advertisement, errors.New("minIntervalMs must be less than or equal to maxIntervalMs")
+	}
+
+	if txPower, ok := command["txPower"].(float64); ok {
+		theTxPower := int16(txPower)
+		advertisement.TxPower = &theTxPower
+	}
+
+	if duration, ok := command["durationSeconds"].(float64); ok {
+		timeout, err := jsonUint16("durationSeconds", duration)
+		if err != nil {
+			return advertisement, err
+		}
+		advertisement.Timeout = timeout
+	}
+
+	if len(advertisement.ManufacturerData) == 0 && len(advertisement.ServiceData) == 0 &&
+		len(advertisement.ServiceUUIDs) == 0 && advertisement.LocalName == "" {
+		return advertisement, errors.New("Advertisement does not contain any data")
+	}
+
+	return advertisement, nil
+}
+
+//createIBeaconData - Create the Apple manufacturer data for an iBeacon advertisement
+func createIBeaconData(params map[string]interface{}) ([]byte, error) {
+	uuid, _ := params["uuid"].(string)
+	uuidBytes, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	if err != nil || len(uuidBytes) != 16 {
+		return nil, errors.New("Invalid iBeacon uuid " + uuid)
+	}
+
+	theMajor, _ := params["major"].(float64)
+	major, err := jsonUint16("iBeacon major", theMajor)
+	if err != nil {
+		return nil, err
+	}
+	theMinor, _ := params["minor"].(float64)
+	minor, err := jsonUint16("iBeacon minor", theMinor)
+	if err != nil {
+		return nil, err
+	}
+	measuredPower := float64(-59)
+	if power, ok := params["measuredPower"].(float64); ok {
+		measuredPower = power
+	}
+
+	//Type (0x02), length (0x15), uuid, major, minor, measured power
+	data := []byte{0x02, 0x15}
+	data = append(data, uuidBytes...)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(data[18:20], major)
+	binary.BigEndian.PutUint16(data[20:22], minor)
+	return append(data, byte(int8(measuredPower))), nil
+}
+
+//createEddystoneData - Create the service data for an Eddystone-UID or Eddystone-URL advertisement
+func createEddystoneData(frameType string, params map[string]interface{}) ([]byte, error) {
+	txPower := float64(-20)
+	if power, ok := params["txPower"].(float64); ok {
+		txPower = power
+	}
+
+	if frameType == advertisementEddystoneUID {
+		namespace, _ := params["namespace"].(string)
+		instance, _ := params["instance"].(string)
+		namespaceBytes, err := hex.DecodeString(namespace)
+		if err != nil || len(namespaceBytes) != 10 {
+			return nil, errors.New("Invalid Eddystone namespace " + namespace + ", must be 20 hex characters")
+		}
+		instanceBytes, err := hex.DecodeString(instance)
+		if err != nil || len(instanceBytes) != 6 {
+			return nil, errors.New("Invalid Eddystone instance " + instance + ", must be 12 hex characters")
+		}
+
+		//Frame type (0x00), tx power, namespace, instance, reserved
+		data := []byte{0x00, byte(int8(txPower))}
+		data = append(data, namespaceBytes...)
+		data = append(data, instanceBytes...)
+		return append(data, 0, 0), nil
+	}
+
+	url, _ := params["url"].(string)
+	scheme := -1
+	for i, prefix := range eddystoneURLSchemes {
+		if strings.HasPrefix(url, prefix) {
+			scheme = i
+			url = url[len(prefix):]
+			break
+		}
+	}
+	if scheme == -1 {
+		return nil, errors.New("Invalid Eddystone url, must begin with http:// or https://")
+	}
+
+	//Frame type (0x10), tx power, scheme, encoded url
+	data := []byte{0x10, byte(int8(txPower)), byte(scheme)}
+	for len(url) > 0 {
+		encoded := false
+		for code, expansion := range eddystoneURLCodes {
+			if strings.HasPrefix(url, expansion) {
+				data = append(data, byte(code))
+				url = url[len(expansion):]
+				encoded = true
+				break
+			}
+		}
+		if !encoded {
+			data = append(data, url[0])
+			url = url[1:]
+		}
+	}
+
+	//The encoded url can be at most 17 bytes
+	if len(data) > 20 {
+		return nil, errors.New("Eddystone url is too long")
+	}
+	return data, nil
+}
+
+//jsonUint16 - Convert a JSON number to a uint16, returning an error if it is not an integer between 0 and 65535
+func jsonUint16(name string, value float64) (uint16, error) {
+	if value < 0 || value > math.MaxUint16 || value != math.Trunc(value) {
+		return 0, fmt.Errorf("%s must be an integer between 0 and 65535", name)
+	}
+	return uint16(value), nil
+}
+
+//jsonByteArray - Convert an array of numbers received in json to a byte array
+func jsonByteArray(value interface{}) ([]byte, error) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("value must be an array of 8-bit integers")
+	}
+
+	bytes := make([]byte, len(array))
+	for i, elem := range array {
+		num, ok := elem.(float64)
+		if !ok || num < 0 || num > 255 {
+			return nil, errors.New("value must be an array of 8-bit integers")
+		}
+		bytes[i] = byte(num)
+	}
+	return bytes, nil
+}
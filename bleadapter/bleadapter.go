@@ -1,15 +1,14 @@
 package bleadapter
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
-	cb "github.com/clearblade/Go-SDK"
 	cbble "github.com/clearblade/ble-adapter-go/ble"
-	mqttTypes "github.com/clearblade/mqtt_parsing"
-	MQTT "github.com/clearblade/paho.mqtt.golang"
 	"github.com/godbus/dbus"
 )
 
@@ -19,6 +18,9 @@ var (
 	subscribeTopic  = deviceSubscribeTopic
 	mqttIsConnected = false
 
+	//Discovery filter keys, other than UUIDs, retrieved from the adapter config
+	discoveryFilter cbble.DiscoveryFilter
+
 	//Devices advertise at specific intervals. This should be set to at least 2N, where N is the
 	//amount of time associated with the advertising interval.
 	scanInterval int64 = 360 //seconds
@@ -39,6 +41,12 @@ var (
 
 	//Channel used to send a signal to stop listening for ble commands
 	stopScanLoopChannel chan bool
+
+	//Set while an active discovery scan is running and has not been asked to stop. Discovery is
+	//only stopped once, and never when passive scanning is used, since nothing would receive the
+	//values sent to stop it
+	discoveryScanning      bool
+	discoveryScanningMutex sync.Mutex
 )
 
 const (
@@ -57,28 +65,58 @@ const (
 
 //BleAdapter - Struct that represents a BLE Adapter
 type BleAdapter struct {
-	connection     *cbble.Connection
-	cbDeviceClient *cb.DeviceClient
+	//Cancelled when the adapter should shut down
+	ctx context.Context
+
+	connection *cbble.Connection
+
+	//Messaging backend used to communicate with the platform
+	transport Transport
 
 	//Channel used to receive ble device discovery related signals
 	deviceChannel chan *dbus.Signal
 
 	//Channel used to receive ble related commands (read/write) from the platform
-	bleCommandsChannel <-chan *mqttTypes.Publish
+	bleCommandsChannel <-chan *Message
+
+	//Channel used to receive local GATT server values from the platform
+	gattValuesChannel <-chan *Message
+
+	//Channel used to receive firmware package chunks from the platform
+	firmwareChunksChannel <-chan *Message
+
+	//Local GATT server registered when the peripheral role is enabled
+	gattServer   *cbble.GattServer
+	gattServices []cbble.LocalService
+
+	//Advertisement monitor registered when passive scanning is enabled
+	monitorApp *cbble.MonitorApplication
+	monitor    cbble.AdvertisementMonitor
+
+	//When specified, the DBUS signals and method replies seen by the adapter are recorded to the file
+	RecordingFile string
+
+	//When specified, the device registry is saved to the file, otherwise it is kept in memory only.
+	//Devices not seen within RegistryMaxAge are removed from the registry, 0 keeps devices forever
+	RegistryFile   string
+	RegistryMaxAge time.Duration
+	registry       *deviceRegistry
 }
 
-//Start - Starts execution of the BLEAdapter
-func (adapt *BleAdapter) Start(devClient *cb.DeviceClient, theScanInterval int) {
-	adapt.cbDeviceClient = devClient
+//Start - Starts execution of the BLEAdapter. Start returns once ctx is cancelled and the
+//adapter has been shut down.
+func (adapt *BleAdapter) Start(ctx context.Context, transport Transport, theScanInterval int) {
+	adapt.ctx = ctx
+	adapt.transport = transport
 
-	log.Printf("[DEBUG] Initializing MQTT with callbacks")
-	var callbacks = &cb.Callbacks{OnConnectionLostCallback: adapt.OnConnectLost, OnConnectCallback: adapt.OnConnect}
-	if err := adapt.cbDeviceClient.InitializeMQTTWithCallback("bleadapter_"+adapt.cbDeviceClient.DeviceName, "", 30, nil, nil, callbacks); err != nil {
-		log.Fatalf("[ERROR] initCbClient: Unable to initialize MQTT connection: %s", err.Error())
+	if err := adapt.transport.Connect(adapt.OnConnect, adapt.OnConnectLost); err != nil {
+		log.Fatalf("[ERROR] Start: Unable to initialize MQTT connection: %s", err.Error())
 	}
 
+	//The scan interval specified on the command line takes precedence over the local configuration
 	if theScanInterval > 0 {
 		scanInterval = int64(theScanInterval)
+		localAdapterConfig["discovery_scan_seconds"] = float64(theScanInterval)
 	}
 
 	//Open a connection to the System Dbus to begin scanning
@@ -89,13 +127,24 @@ func (adapt *BleAdapter) Start(devClient *cb.DeviceClient, theScanInterval int)
 
 	stopDiscoveryChannel = make(chan bool)
 
-	//Clean up after ourselves
-	defer close(stopDiscoveryChannel)
-
 	//Make sure we close the dbus connection
 	defer adapt.connection.Close()
 
-	for true {
+	if adapt.RecordingFile != "" {
+		if err := adapt.connection.StartRecording(adapt.RecordingFile); err != nil {
+			log.Printf("[ERROR] Unable to record DBUS signals: %s", err.Error())
+		}
+	}
+
+	adapt.registry = newDeviceRegistry(adapt.RegistryFile, adapt.RegistryMaxAge)
+	go adapt.saveRegistry()
+
+	go adapt.runPollScheduler()
+
+	//Release everything the adapter acquired before the dbus connection is closed
+	defer adapt.shutdown()
+
+	for ctx.Err() == nil {
 		//If the MQTT Client is not connected to the platform broker,
 		//there's no need to scan.
 		if mqttIsConnected {
@@ -107,18 +156,59 @@ func (adapt *BleAdapter) Start(devClient *cb.DeviceClient, theScanInterval int)
 			if deviceAdapter, adaptErr := adapt.connection.GetAdapter(); adaptErr != nil {
 				log.Printf("[ERROR] Device BLE adapter could not be retrieved: %s", adaptErr.Error())
 				log.Printf("[DEBUG] Waiting 30 seconds before retrying device BLE adapter retrieval.")
-				time.Sleep(time.Duration(30 * time.Second.Nanoseconds()))
+				sleepWithContext(ctx, 30)
 			} else {
 				if deviceAdapter.Discovering() == false {
 					log.Printf("[DEBUG] Device ble adapter is not discovering.")
 
 					//Retrieve the adapter configuration from the CB Platform data collection
 					adapt.getAdapterConfig()
-					log.Printf("Beginning scan. Scan duration = %d", scanInterval)
+
+					//Register or update the local GATT server
+					adapt.updateGattServer()
+
+					//Connect the devices added to BLE_Managed_Devices and release the removed devices
+					adapt.updateManagedDevices()
+
+					//Refresh the characteristic polling schedules
+					adapt.updatePollSchedules()
+
+					//Refresh the rules evaluated against device values
+					adapt.updateRules()
+
+					if scanMode == scanModePassive {
+						//The device and publish filters are applied to the devices found by the monitor
+						adapt.updateFilters()
+
+						err := adapt.startPassiveScan()
+						if err == nil {
+							//Passive scanning runs continuously. Wait before refreshing the configuration
+							refreshInterval := scanInterval
+							if refreshInterval <= 0 {
+								refreshInterval = 60
+							}
+							log.Printf("[INFO] Passive scan active. Refreshing configuration in %d seconds", refreshInterval)
+							sleepWithContext(ctx, refreshInterval)
+							continue
+						}
+						log.Printf("[WARN] Unable to start passive scan, falling back to active scan: %s", err.Error())
+					} else {
+						adapt.stopPassiveScan()
+					}
+
+					log.Printf("[INFO] Beginning scan. Scan duration = %d", scanInterval)
 
 					stopScanLoopChannel = make(chan bool)
 
-					adapt.scanForDevices(stopDiscoveryChannel)
+					//Wait for running polls to complete and keep new polls from starting while
+					//scanning. Polls run alongside continuous discovery
+					scanLocked := scanInterval > 0
+					if scanLocked {
+						pollWindow.Lock()
+					}
+
+					setDiscoveryScanning(true)
+					adapt.scanForDevices(ctx, stopDiscoveryChannel)
 
 					//If a scan interval was specified wait until the interval elapses
 					var timer *time.Timer
@@ -129,52 +219,129 @@ func (adapt *BleAdapter) Start(devClient *cb.DeviceClient, theScanInterval int)
 					}
 
 					//Wait for the stop loop command
-					for stopLoop := range stopScanLoopChannel {
-						if timer != nil {
-							timer.Stop()
-						}
-						if stopLoop {
-							log.Printf("[DEBUG] Stopping the scan loop")
-							close(stopScanLoopChannel)
-						} else {
-							log.Printf("[DEBUG] Invalid value received for stoploop: %t", stopLoop)
+					for scanning := true; scanning; {
+						select {
+						case stopLoop := <-stopScanLoopChannel:
+							if timer != nil {
+								timer.Stop()
+							}
+							if stopLoop {
+								log.Printf("[DEBUG] Stopping the scan loop")
+								scanning = false
+							} else {
+								log.Printf("[DEBUG] Invalid value received for stoploop: %t", stopLoop)
+							}
+						case <-ctx.Done():
+							//The discovery goroutine stops discovery when the context is cancelled
+							if timer != nil {
+								timer.Stop()
+							}
+							log.Printf("[DEBUG] Scan cancelled, stopping the scan loop")
+							if err := adapt.removeDbusEvents(); err != nil {
+								log.Printf("[ERROR] Error removing DBUS events: %s", err.Error())
+							}
+							scanning = false
 						}
 					}
+					setDiscoveryScanning(false)
+					if scanLocked {
+						pollWindow.Unlock()
+					}
 
 					if scanInterval > 0 && pauseInterval > 0 {
 						// wait until the pause interval elapses
-						log.Printf("Beginning pause. Pause duration = %d", pauseInterval)
-						time.Sleep(time.Duration(int64(pauseInterval) * time.Second.Nanoseconds()))
+						log.Printf("[INFO] Beginning pause. Pause duration = %d", pauseInterval)
+						sleepWithContext(ctx, pauseInterval)
 					}
 				} else {
 					log.Printf("[DEBUG] Device ble adapter is STILL discovering.")
-					time.Sleep(time.Duration(5 * time.Second.Nanoseconds()))
+					sleepWithContext(ctx, 5)
 				}
 			}
 		} else {
 			log.Printf("[DEBUG] Cannot start BLE Scan, waiting 10 seconds for MQTT connection to be established.")
-			time.Sleep(time.Duration(10 * time.Second.Nanoseconds()))
+			sleepWithContext(ctx, 10)
 		}
 		log.Printf("[DEBUG] Starting next loop iteration")
 	}
 }
 
+//shutdown - Release the resources acquired by the adapter so that BlueZ is left in a clean state
+func (adapt *BleAdapter) shutdown() {
+	log.Printf("[DEBUG] Shutting down BLE adapter")
+
+	stopAllAdvertisements()
+	adapt.stopPassiveScan()
+	adapt.stopGattServer()
+
+	if err := adapt.connection.StopNotifications(); err != nil {
+		log.Printf("[ERROR] Error stopping notifications: %s", err.Error())
+	}
+
+	disconnectConnectedDevices(adapt.connection)
+
+	adapt.registry.saveAndLog()
+
+	log.Printf("[DEBUG] Disconnecting from MQTT broker")
+	mqttIsConnected = false
+	if err := adapt.transport.Disconnect(); err != nil {
+		log.Printf("[ERROR] Error disconnecting from MQTT broker: %s", err.Error())
+	}
+
+	log.Printf("[DEBUG] BLE adapter shut down")
+}
+
+//sleepWithContext - Sleep for the specified number of seconds. Returns false if ctx was cancelled before the time elapsed
+func sleepWithContext(ctx context.Context, seconds int64) bool {
+	timer := time.NewTimer(time.Duration(seconds * time.Second.Nanoseconds()))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 //stopDiscoveryScan - Stop the BLE discovery process
 func (adapt *BleAdapter) stopDiscoveryScan() {
+	if !setDiscoveryScanning(false) {
+		log.Printf("[DEBUG] No discovery scan running")
+		return
+	}
+
 	//Remove the dbus events prior to stopping discovery so that a write to
 	//a closed channel does not occurr
 	if err := adapt.removeDbusEvents(); err != nil {
 		log.Printf("[ERROR] Error removing DBUS events: %s", err.Error())
 	}
 
-	//End the existing goRoutines
+	//End the existing goRoutines. If the adapter is shutting down, the goroutines
+	//end on their own and will not receive the values
 	log.Printf("[DEBUG] Stopping BLE discovery")
-	stopDiscoveryChannel <- true
-	stopScanLoopChannel <- true
+	select {
+	case stopDiscoveryChannel <- true:
+	case <-adapt.ctx.Done():
+	}
+	select {
+	case stopScanLoopChannel <- true:
+	case <-adapt.ctx.Done():
+	}
 
 	log.Printf("[DEBUG] Returning from stopDiscoveryScan")
 }
 
+//setDiscoveryScanning - Record whether a discovery scan is running. Returns whether one was running
+func setDiscoveryScanning(scanning bool) bool {
+	discoveryScanningMutex.Lock()
+	defer discoveryScanningMutex.Unlock()
+
+	wasScanning := discoveryScanning
+	discoveryScanning = scanning
+	return wasScanning
+}
+
 //addDbusEvents - Add DBUS signals we wish to handle to the DBUS connection
 func (adapt *BleAdapter) addDbusEvents() error {
 	log.Printf("[DEBUG] Adding DBUS events")
@@ -226,24 +393,19 @@ func (adapt *BleAdapter) removeDbusEvents() error {
 	return nil
 }
 
-//scanForDevices - Scan for ble devices
-func (adapt *BleAdapter) scanForDevices(stopDiscoveryChannel <-chan bool) {
-	//Retrieve the UUID's to filter on.  If an error is encountered, use the filters that were previously specified
-	theFilters, err := adapt.getDeviceFilters()
-
-	if err != nil {
-		log.Printf("[ERROR] Error encountered while retrieving UUID Filters: %s", err.Error())
-	} else {
-		log.Printf("[DEBUG] UUID Filters retrieved = #%v", uuidFilters)
-		uuidFilters = theFilters
-	}
+//scanForDevices - Scan for ble devices until a value is received on stopDiscoveryChannel or ctx is cancelled
+func (adapt *BleAdapter) scanForDevices(ctx context.Context, stopDiscoveryChannel <-chan bool) {
+	adapt.updateFilters()
 
 	//Add the DBus events the adapter should listen for
 	if err := adapt.addDbusEvents(); err != nil {
 		log.Fatal("[ERROR] Error adding DBUS event: " + err.Error())
 	}
 
-	if adapt.deviceChannel = adapt.connection.StartDiscovery(stopDiscoveryChannel, uuidFilters...); adapt.deviceChannel == nil {
+	filter := discoveryFilter
+	filter.UUIDs = uuidFilters
+
+	if adapt.deviceChannel = adapt.connection.StartDiscovery(ctx, stopDiscoveryChannel, filter); adapt.deviceChannel == nil {
 		log.Fatal("[ERROR] Could not initiate discovery, shutting down BLE Adapter.")
 	}
 
@@ -251,29 +413,62 @@ func (adapt *BleAdapter) scanForDevices(stopDiscoveryChannel <-chan bool) {
 	go adapt.handleDBUSSignal()
 }
 
+//updateFilters - Retrieve the UUID and publish filters. If an error is encountered, the filters
+//that were previously specified are used
+func (adapt *BleAdapter) updateFilters() {
+	theFilters, err := adapt.getDeviceFilters()
+
+	if err != nil {
+		log.Printf("[ERROR] Error encountered while retrieving UUID Filters: %s", err.Error())
+	} else {
+		log.Printf("[DEBUG] UUID Filters retrieved = #%v", uuidFilters)
+		uuidFilters = theFilters
+	}
+
+	//Retrieve the client side publish filters
+	if thePublishFilters, err := adapt.getPublishFilters(); err != nil {
+		log.Printf("[WARN] Error encountered while retrieving publish filters: %s", err.Error())
+	} else {
+		publishFilters = thePublishFilters
+	}
+}
+
 //handleDBUSSignal - Wait for DBUS signals to be broadcasted from DBUS
 func (adapt *BleAdapter) handleDBUSSignal() {
-	log.Printf("Waiting for BLE Devices")
+	log.Printf("[INFO] Waiting for BLE Devices")
 
 	//Range over the device channel. When the channel is closed
 	//this goroutine will end. The channel is closed automatically
 	//when discovery is stopped
 	for dbussignal := range adapt.deviceChannel {
-		log.Printf("[DEBUG] DBUS signal received: %#v", dbussignal)
-		switch dbussignal.Name {
-		case cbble.InterfacesAdded:
-			HandleInterfaceAdded(*adapt, dbussignal)
-		case cbble.InterfacesRemoved:
-			HandleInterfaceRemoved(*adapt, dbussignal)
-		case cbble.PropertiesChanged:
-			HandlePropertyChanged(*adapt, dbussignal)
-		}
+		adapt.handleSignal(dbussignal)
 	}
 
 	log.Printf("[DEBUG] adapt.deviceChannel closed. Ending goroutine")
 	return
 }
 
+//handleSignal - Invoke the handler for a DBUS signal
+func (adapt *BleAdapter) handleSignal(dbussignal *dbus.Signal) {
+	log.Printf("[DEBUG] DBUS signal received: %#v", dbussignal)
+	switch dbussignal.Name {
+	case cbble.InterfacesAdded:
+		HandleInterfaceAdded(*adapt, dbussignal)
+	case cbble.InterfacesRemoved:
+		HandleInterfaceRemoved(*adapt, dbussignal)
+	case cbble.PropertiesChanged:
+		HandlePropertyChanged(*adapt, dbussignal)
+	case cbble.MonitorDeviceFound:
+		if path, ok := recordedMonitorDevice(dbussignal); ok {
+			adapt.handleMonitorDeviceFound(path)
+		}
+	case cbble.MonitorDeviceLost:
+		if path, ok := recordedMonitorDevice(dbussignal); ok {
+			adapt.handleMonitorDeviceLost(path)
+		}
+	}
+}
+
 //publishDevice
 //		1. Retrieve the BLE device from the DBUS object cache
 //		2. Verify the device contains the appropriate UUIDs
@@ -286,13 +481,18 @@ func (adapt *BleAdapter) publishDevice(address string) {
 	}
 
 	if device, geterr := adapt.connection.GetDeviceByAddress(address); geterr == nil {
+		//Every device seen is registered and evaluated by the rules engine, regardless of the publish filters
+		adapt.registry.update(adapt.connection, device)
+		markDeviceSeen(address)
+		adapt.evaluateAdvertisementRules(device)
+
 		if adapt.shouldPublishDevice(&device) == true {
 			if deviceJSON, jsonerr := adapt.createBleDeviceJSON(&device); jsonerr != nil {
 				log.Printf("[ERROR] error marshaling device into json: %s", jsonerr.Error())
 			} else {
-				log.Printf("Publishing message: %s", deviceJSON)
+				log.Printf("[DEBUG] Publishing message: %s", deviceJSON)
 
-				if puberr := adapt.cbDeviceClient.Publish(adapt.cbDeviceClient.DeviceName+"/"+publishTopic, deviceJSON, messagingQos); puberr != nil {
+				if puberr := adapt.transport.Publish(publishTopic, deviceJSON, messagingQos); puberr != nil {
 					log.Printf("[ERROR] Error occurred when publishing device to MQTT: %v", puberr)
 				}
 			}
@@ -304,9 +504,15 @@ func (adapt *BleAdapter) publishDevice(address string) {
 	}
 }
 
-//shouldPublishDevice - Ensure the device contains one of the UUIDs that are being filtered on
+//shouldPublishDevice - Ensure the device satisfies the publish filters and contains one of the UUIDs that are being filtered on
 func (adapt *BleAdapter) shouldPublishDevice(device *cbble.Device) bool {
 
+	//Evaluate the client side publish filters first
+	if !evaluatePublishFilters(*device, publishFilters, publishFilterMode) {
+		log.Printf("[DEBUG] Device does not satisfy the publish filters. shouldPublishDevice returning false")
+		return false
+	}
+
 	//If device uuid filters were specified, ensure one of the UUID's exists
 	//in the uuids property for the device.
 	if len(uuidFilters) == 0 {
@@ -324,7 +530,7 @@ func (adapt *BleAdapter) shouldPublishDevice(device *cbble.Device) bool {
 			return false
 		}
 		for _, deviceuuid := range deviceUuids {
-			if strings.ToUpper(deviceuuid) == strings.ToUpper(uuid) {
+			if cbble.EqualUUIDs(deviceuuid, uuid) {
 				log.Printf("[DEBUG] UUID found on device. shouldPublishDevice returning true")
 				return true
 			}
@@ -334,26 +540,42 @@ func (adapt *BleAdapter) shouldPublishDevice(device *cbble.Device) bool {
 	return false
 }
 
-//getDeviceFilters - Retrieve the UUIDs that should be filtered on
+//getDeviceFilters - Retrieve the UUIDs that should be filtered on. If the BLE_Device_Filters
+//collection cannot be retrieved, the device_filters setting of the local configuration is used.
 func (adapt *BleAdapter) getDeviceFilters() ([]string, error) {
 	//Retrieve the uuids that we wish to filter on
-	//var query cb.Query - A nil query results in all rows being returned
-	results, err := adapt.cbDeviceClient.GetDataByName(deviceFiltersCollectionName, &cb.Query{})
+	rows, err := adapt.transport.GetCollection(deviceFiltersCollectionName)
 
 	if err != nil {
+		if localFilters, ok := localAdapterConfig[deviceFiltersSetting].([]string); ok {
+			log.Printf("[WARN] Device filters could not be retrieved. Using local configuration. Error: %s", err.Error())
+			uuids := []string{}
+			for _, uuid := range localFilters {
+				if normalized, err := cbble.NormalizeUUID(uuid); err == nil {
+					uuids = append(uuids, normalized)
+				} else {
+					log.Printf("[WARN] Skipping device filter with invalid uuid: %s", uuid)
+				}
+			}
+			return uuids, nil
+		}
 		return nil, err
 	}
 
-	if len(results["DATA"].([]interface{})) == 0 {
+	if len(rows) == 0 {
 		log.Printf("[DEBUG] No device filters enabled.")
 	}
 
 	uuids := []string{}
 
-	for i, uuid := range results["DATA"].([]interface{}) {
-		if results["DATA"].([]interface{})[i].(map[string]interface{})["enabled"].(bool) == true {
-			//DBUS uses lowercase characters in the uuids. Ensure we convert them to lowercase
-			uuids = append(uuids, strings.ToLower(uuid.(map[string]interface{})["ble_uuid"].(string)))
+	for _, theRow := range rows {
+		uuid, _ := theRow["ble_uuid"].(string)
+		normalized, err := cbble.NormalizeUUID(uuid)
+		if enabled, _ := theRow["enabled"].(bool); enabled && err == nil {
+			//DBUS uses lowercase 128 bit uuids. Ensure 16 and 32 bit uuids are converted
+			uuids = append(uuids, normalized)
+		} else if enabled {
+			log.Printf("[WARN] Skipping device filter with invalid ble_uuid: %#v", theRow["ble_uuid"])
 		}
 	}
 
@@ -361,40 +583,135 @@ func (adapt *BleAdapter) getDeviceFilters() ([]string, error) {
 	return uuids, nil
 }
 
-//getAdapterConfig - Retrieve BLE Adapter configuration parameters from a platform data collection
+//getAdapterConfig - Retrieve BLE Adapter configuration parameters from a platform data collection.
+//Settings not specified in the collection are taken from the local configuration.
 func (adapt *BleAdapter) getAdapterConfig() error {
 	//Retrieve the adapter configuration row. Passing a nil query results in all rows being returned
-	results, err := adapt.cbDeviceClient.GetDataByName(adapterConfigCollectionName, &cb.Query{})
+	row, err := adapt.getConfigRow(adapterConfigCollectionName)
 	if err != nil {
-		log.Printf("[WARN] Adapter configuration could not be retrieved. Using defaults. Error: %s", err.Error())
-		return err
+		log.Printf("[WARN] Adapter configuration could not be retrieved. Using local configuration. Error: %s", err.Error())
+	} else if row == nil {
+		log.Printf("[DEBUG] %s contains no rows. Using local configuration", adapterConfigCollectionName)
+	}
+
+	platformConfig, errs := validateAdapterConfig(row)
+	for _, validationErr := range errs {
+		log.Printf("[ERROR] Invalid value in %s ignored. %s", adapterConfigCollectionName, validationErr.Error())
+	}
+
+	//Platform settings take precedence over the local configuration
+	config := map[string]interface{}{}
+	for name, value := range localAdapterConfig {
+		config[name] = value
+	}
+	for name, value := range platformConfig {
+		config[name] = value
 	}
 
-	publishTopic = results["DATA"].([]interface{})[0].(map[string]interface{})["publish_topic"].(string)
+	if topic, ok := config["publish_topic"].(string); ok {
+		publishTopic = topic
+	}
 
-	if results["DATA"].([]interface{})[0].(map[string]interface{})["discovery_scan_seconds"] != nil {
-		scanInterval = int64(results["DATA"].([]interface{})[0].(map[string]interface{})["discovery_scan_seconds"].(float64))
+	if scanSeconds, ok := config["discovery_scan_seconds"].(float64); ok {
+		scanInterval = int64(scanSeconds)
 	}
 
-	if results["DATA"].([]interface{})[0].(map[string]interface{})["discovery_pause_seconds"] != nil {
-		pauseInterval = int64(results["DATA"].([]interface{})[0].(map[string]interface{})["discovery_pause_seconds"].(float64))
+	if pauseSeconds, ok := config["discovery_pause_seconds"].(float64); ok {
+		pauseInterval = int64(pauseSeconds)
 	}
 
-	if results["DATA"].([]interface{})[0].(map[string]interface{})["handle_removed"] != nil &&
-		results["DATA"].([]interface{})[0].(map[string]interface{})["handle_removed"] == true {
-		handleRemoved = true
+	handleRemoved, _ = config["handle_removed"].(bool)
+	handleChanged, _ = config["handle_changed"].(bool)
+
+	if mode, ok := config["scan_mode"].(string); ok && strings.ToLower(mode) == scanModePassive {
+		scanMode = scanModePassive
 	} else {
-		handleRemoved = false
+		scanMode = scanModeActive
 	}
 
-	if results["DATA"].([]interface{})[0].(map[string]interface{})["handle_changed"] != nil &&
-		results["DATA"].([]interface{})[0].(map[string]interface{})["handle_changed"] == true {
-		handleChanged = true
+	gattServerEnabled, _ = config["gatt_server_enabled"].(bool)
+
+	monitorConfig = getMonitorConfig(config)
+
+	if mode, ok := config["publish_filter_mode"].(string); ok && strings.ToLower(mode) == filterModeAnd {
+		publishFilterMode = filterModeAnd
 	} else {
-		handleChanged = false
+		publishFilterMode = filterModeOr
 	}
 
-	return nil
+	discoveryFilter = getDiscoveryFilterConfig(config)
+
+	if minSeconds, ok := config["managed_reconnect_min_seconds"].(float64); ok && minSeconds > 0 {
+		managedReconnectMin = int64(minSeconds)
+	}
+	if maxSeconds, ok := config["managed_reconnect_max_seconds"].(float64); ok && maxSeconds > 0 {
+		managedReconnectMax = int64(maxSeconds)
+	}
+
+	setRetryPolicies(config)
+	setCallTimeouts(config)
+
+	return err
+}
+
+//setCallTimeouts - Set the timeouts of D-Bus method calls from the *_timeout_ms adapter configuration columns
+func setCallTimeouts(config map[string]interface{}) {
+	columns := map[string]string{
+		"call_timeout_ms":    "",
+		"connect_timeout_ms": "Connect",
+		"pair_timeout_ms":    "Pair",
+		"read_timeout_ms":    "ReadValue",
+		"write_timeout_ms":   "WriteValue",
+	}
+	for column, method := range columns {
+		if milliseconds, ok := config[column].(float64); ok && milliseconds > 0 {
+			cbble.SetCallTimeout(method, time.Duration(milliseconds)*time.Millisecond)
+		}
+	}
+}
+
+//getDiscoveryFilterConfig - Create the discovery filter from the discovery_* adapter configuration columns
+func getDiscoveryFilterConfig(config map[string]interface{}) cbble.DiscoveryFilter {
+	filter := cbble.DiscoveryFilter{}
+
+	//RSSI and pathloss values of 0 are the column defaults and are treated as not specified
+	if rssi, ok := config["discovery_rssi"].(float64); ok && rssi != 0 {
+		theRSSI := int16(rssi)
+		filter.RSSI = &theRSSI
+	}
+
+	if pathloss, ok := config["discovery_pathloss"].(float64); ok && pathloss != 0 {
+		if filter.RSSI != nil {
+			log.Printf("[WARN] discovery_rssi and discovery_pathloss cannot be combined. Ignoring discovery_pathloss")
+		} else {
+			thePathloss := uint16(pathloss)
+			filter.Pathloss = &thePathloss
+		}
+	}
+
+	if transport, ok := config["discovery_transport"].(string); ok && transport != "" {
+		switch strings.ToLower(transport) {
+		case cbble.TransportAuto, cbble.TransportLE, cbble.TransportBREDR:
+			filter.Transport = strings.ToLower(transport)
+		default:
+			log.Printf("[WARN] Invalid discovery_transport %s specified. Using %s", transport, cbble.TransportLE)
+		}
+	}
+
+	if duplicateData, ok := config["discovery_duplicate_data"].(bool); ok {
+		filter.DuplicateData = &duplicateData
+	}
+
+	if discoverable, ok := config["discovery_discoverable"].(bool); ok && discoverable {
+		filter.Discoverable = &discoverable
+	}
+
+	if pattern, ok := config["discovery_pattern"].(string); ok {
+		filter.Pattern = pattern
+	}
+
+	log.Printf("[DEBUG] Discovery filter retrieved from adapter config: %+v", filter)
+	return filter
 }
 
 //createBleDeviceJSON - Create a JSON representation of a BLE device
@@ -453,8 +770,8 @@ func (adapt *BleAdapter) createBleDeviceJSON(device *cbble.Device) ([]byte, erro
 	return json.Marshal(bleDevice)
 }
 
-//handleBLECommands - Goroutine used to listen for BLE commands sent from the platform
-func (adapt *BleAdapter) handleBLECommands() {
+//handleBLECommands - Goroutine used to listen for BLE commands sent from the platform until ctx is cancelled
+func (adapt *BleAdapter) handleBLECommands(ctx context.Context) {
 	//Wait for BLE Commands to be received from the platform.
 	//
 	// The structure of the command payload will need to resemble the following:
@@ -468,7 +785,7 @@ func (adapt *BleAdapter) handleBLECommands() {
 	//		"stayConnected" - true|false
 	// }
 	//
-	log.Printf("Waiting for BLE Commands")
+	log.Printf("[INFO] Waiting for BLE Commands")
 
 	//As a command comes in, we need to start a new goroutine to handle the command
 
@@ -485,6 +802,17 @@ func (adapt *BleAdapter) handleBLECommands() {
 				//Start a goroutine to process the command
 				go adapt.processBLECommand(message)
 			}
+		case message, ok := <-adapt.gattValuesChannel:
+			//Process local GATT server values sent from the platform
+			if ok {
+				log.Printf("[DEBUG] GATT server value received")
+				adapt.handleGattServerValue(message)
+			}
+		case message, ok := <-adapt.firmwareChunksChannel:
+			//Store firmware package chunks uploaded from the platform
+			if ok {
+				handleFirmwareChunk(message)
+			}
 		case stopChannel, ok := <-stopBleCommandsChannel:
 			log.Printf("[DEBUG] Stop handleBLECommands received, value = %t", stopChannel)
 			log.Printf("[DEBUG] Channel ok value = %t", ok)
@@ -493,12 +821,15 @@ func (adapt *BleAdapter) handleBLECommands() {
 				log.Printf("[DEBUG] Stopping BLE command handler")
 				return
 			}
+		case <-ctx.Done():
+			log.Printf("[DEBUG] Stopping BLE command handler")
+			return
 		}
 	}
 }
 
 //processBLECommand - Goroutine used to process individual BLE commands sent from the platform
-func (adapt *BleAdapter) processBLECommand(message *mqttTypes.Publish) {
+func (adapt *BleAdapter) processBLECommand(message *Message) {
 
 	//Separate goroutine to handle individual ble commands
 	log.Printf("[DEBUG] Processing BLE command")
@@ -518,28 +849,59 @@ func (adapt *BleAdapter) processBLECommand(message *mqttTypes.Publish) {
 		blecommand["sentCommand"] = string(message.Payload)
 
 		//Create a new BLECommand instance
-		bleCmd := NewBLECommand(adapt, blecommand)
-		bleCmd.sendError("Invalid JSON received for BLE Command")
+		bleCmd := &BLECommand{adapter: adapt, command: blecommand}
+		bleCmd.sendError("Invalid JSON received for BLE Command", invalidCommandError("Invalid JSON received for BLE Command: "+err.Error()))
 		return
 	}
 
-	log.Printf("[DEBUG] Received BLE %s Command", blecommand["command"])
+	adapt.executeBLECommand(blecommand)
+}
 
+//executeBLECommand - Execute a BLE command and publish its response. Used for commands sent from the
+//platform and commands run by rules
+func (adapt *BleAdapter) executeBLECommand(blecommand map[string]interface{}) {
 	//Refresh the list of managed objects
 	if err := adapt.connection.Update(); err != nil {
 		log.Printf("[Error]Error updating object cache: %#v", err)
 	}
 
-	//Create a new BLECommand instance
-	bleCmd := NewBLECommand(adapt, blecommand)
+	//Create a new BLECommand instance, validating the command
+	bleCmd, err := NewBLECommand(adapt, blecommand)
+	if err != nil {
+		log.Printf("[ERROR] Invalid BLE command received: %s%s", err.Error(), bleCmd.logFields())
+		bleCmd.sendError("BLE command failed. "+err.Error(), toCommandError(err))
+		return
+	}
+
+	log.Printf("[INFO] Received BLE %s Command%s", blecommand["command"], bleCmd.logFields())
+
+	//Commands and polls operating on the same device are run one at a time
+	if !bleCmd.adapterCommand {
+		unlock := lockDevice(bleCmd.request.DeviceAddress)
+		defer unlock()
+	}
 
 	if err := bleCmd.Execute(); err != nil {
-		log.Printf("[ERROR] Error while executing ble command: %s", err.Error())
-		bleCmd.sendError("BLE command failed. " + err.Error())
+		log.Printf("[ERROR] Error while executing ble command: %s%s", err.Error(), bleCmd.logFields())
+		bleCmd.sendError("BLE command failed. "+err.Error(), toCommandError(err))
 		return
 	}
 
-	log.Printf("[DEBUG] BLE command success")
+	//Record the state of the device after the command, ex. paired or with its services resolved
+	if !bleCmd.adapterCommand && adapt.registry != nil {
+		if err := adapt.connection.Update(); err == nil {
+			if device, err := getDevice(bleCmd); err == nil {
+				adapt.registry.update(adapt.connection, device)
+			}
+		}
+	}
+
+	//Values read by commands are evaluated by the rules engine
+	if value, ok := bleCmd.command["gattCharacteristicValue"].([]byte); ok && bleCmd.request.Command == "read" {
+		adapt.evaluateRules(ruleSourceRead, bleCmd.request.DeviceAddress, bleCmd.request.GattCharacteristic, value)
+	}
+
+	log.Printf("[INFO] BLE command success%s", bleCmd.logFields())
 	bleCmd.sendSuccess("BLE command " + bleCmd.command["command"].(string) + " executed successfully")
 	return
 }
@@ -547,7 +909,7 @@ func (adapt *BleAdapter) processBLECommand(message *mqttTypes.Publish) {
 //OnConnectLost - MQTT callback invoked when a connection to a broker is lost
 //If the connection to the broker is lost, we need to reconnect and
 //re-establish all of the subscriptions
-func (adapt *BleAdapter) OnConnectLost(client MQTT.Client, connerr error) {
+func (adapt *BleAdapter) OnConnectLost(connerr error) {
 	log.Printf("[WARN] Connection to broker was lost: %s", connerr.Error())
 
 	mqttIsConnected = false
@@ -555,9 +917,12 @@ func (adapt *BleAdapter) OnConnectLost(client MQTT.Client, connerr error) {
 	//Stop ble scanning
 	adapt.stopDiscoveryScan()
 
-	//End the existing goRoutines
+	//End the existing goRoutines. The BLE command handler has already returned if the adapter is shutting down
 	log.Printf("[DEBUG] Stopping BLE commands channel")
-	stopBleCommandsChannel <- true
+	select {
+	case stopBleCommandsChannel <- true:
+	case <-adapt.ctx.Done():
+	}
 
 	//Close the existing channels
 	log.Printf("[DEBUG] Closing BLE commands channel")
@@ -569,29 +934,41 @@ func (adapt *BleAdapter) OnConnectLost(client MQTT.Client, connerr error) {
 
 //OnConnect - MQTT callback invoked when a connection is established with a broker
 //When the connection to the broker is complete, set up the subscriptions
-func (adapt *BleAdapter) OnConnect(client MQTT.Client) {
-	log.Printf("Connected to ClearBlade Platform MQTT broker")
+func (adapt *BleAdapter) OnConnect() {
+	log.Printf("[INFO] Connected to MQTT broker")
 	mqttIsConnected = true
 
 	log.Printf("[DEBUG] Begin Configuring Subscription(s)")
 
 	var err error
-	log.Printf("[DEBUG] device client: %#v", adapt.cbDeviceClient)
-	log.Printf("[DEBUG] topic: %s", adapt.cbDeviceClient.DeviceName+"/"+subscribeTopic)
+	log.Printf("[DEBUG] topic: %s", subscribeTopic)
 	log.Printf("[DEBUG] qos: %d", messagingQos)
 
-	for adapt.bleCommandsChannel, err = adapt.cbDeviceClient.Subscribe(adapt.cbDeviceClient.DeviceName+"/"+subscribeTopic, messagingQos); err != nil; {
+	for adapt.bleCommandsChannel, err = adapt.transport.Subscribe(subscribeTopic, messagingQos); err != nil; {
 		log.Printf("[WARN] Error subscribing to topics: %s", err.Error())
 
-		//Wait 30 seconds and retry
+		//Wait 30 seconds and retry, unless the adapter is shutting down
 		log.Printf("[DEBUG] Waiting 30 seconds to retry subscriptions")
-		time.Sleep(time.Duration(30 * time.Second))
-		adapt.bleCommandsChannel, err = adapt.cbDeviceClient.Subscribe(adapt.cbDeviceClient.DeviceName+"/"+subscribeTopic, messagingQos)
+		if !sleepWithContext(adapt.ctx, 30) {
+			log.Printf("[DEBUG] Adapter stopped, no longer retrying subscriptions")
+			return
+		}
+		adapt.bleCommandsChannel, err = adapt.transport.Subscribe(subscribeTopic, messagingQos)
+	}
+
+	log.Printf("[DEBUG] topic: %s", gattServerValueTopic)
+	if adapt.gattValuesChannel, err = adapt.transport.Subscribe(gattServerValueTopic, messagingQos); err != nil {
+		log.Printf("[WARN] Error subscribing to GATT server values: %s", err.Error())
+	}
+
+	log.Printf("[DEBUG] topic: %s", firmwareChunkTopic)
+	if adapt.firmwareChunksChannel, err = adapt.transport.Subscribe(firmwareChunkTopic, messagingQos); err != nil {
+		log.Printf("[WARN] Error subscribing to firmware package chunks: %s", err.Error())
 	}
 
 	stopBleCommandsChannel = make(chan bool)
 
 	//Start the goRoutine to listen for ble commands published to the Platform
 	log.Printf("[DEBUG] Starting ble command listener")
-	go adapt.handleBLECommands()
+	go adapt.handleBLECommands(adapt.ctx)
 }
@@ -1,10 +1,12 @@
 package bleadapter
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"log"
-	"strings"
+	"sync"
+	"time"
 
 	cbble "github.com/clearblade/ble-adapter-go/ble"
 )
@@ -15,9 +17,16 @@ import (
 //  Remove (unpair)
 // 	Connect
 //  Disconnect
+//  ConnectProfile
+//  DisconnectProfile
 // 	Read
 // 	Write
 //  CancelPairing
+//  StartAdvertising
+//  StopAdvertising
+//  ListDevices
+//  FirmwareUpdate
+//  SMP
 
 type commandProcessor interface {
 	Process(*BLECommand) error
@@ -39,6 +48,12 @@ type Connect struct{}
 //Disconnect - A struct used to encapsulate a BLE device "disconnect" subcommand
 type Disconnect struct{}
 
+//ConnectProfile - A struct used to encapsulate a BLE device "connect profile" subcommand
+type ConnectProfile struct{}
+
+//DisconnectProfile - A struct used to encapsulate a BLE device "disconnect profile" subcommand
+type DisconnectProfile struct{}
+
 //Read - A struct used to encapsulate a BLE device "read" subcommand
 type Read struct{}
 
@@ -49,21 +64,46 @@ type Write struct{}
 type BLECommand struct {
 	adapter     *BleAdapter            //Provides access to the DBUS connection and CbClient
 	command     map[string]interface{} //The command that was received, will have command, device address, device path,
+	request     *commandRequest        //The validated fields of the command
 	subCommands []commandProcessor
 	device      *cbble.Device
+	ctx         context.Context //Cancelled when the adapter stops. Overrides the D-Bus call timeouts when timeoutMs is specified
+
+	//Adapter level commands, such as advertising, do not operate on a BLE device
+	adapterCommand bool
 }
 
 var (
-	pair          = Pair{}
-	cancelPairing = CancelPairing{}
-	remove        = Remove{}
-	connect       = Connect{}
-	disconnect    = Disconnect{}
-	read          = Read{}
-	write         = Write{}
+	pair              = Pair{}
+	cancelPairing     = CancelPairing{}
+	remove            = Remove{}
+	connect           = Connect{}
+	disconnect        = Disconnect{}
+	connectProfile    = ConnectProfile{}
+	disconnectProfile = DisconnectProfile{}
+	read              = Read{}
+	write             = Write{}
+	startAdvertising  = StartAdvertising{}
+	stopAdvertising   = StopAdvertising{}
+)
+
+//Devices connected by BLE commands, keyed by address. Used to disconnect devices on shutdown
+var (
+	connectedDevices      = make(map[string]bool)
+	connectedDevicesMutex sync.Mutex
+)
+
+//Locks held while a BLE command or poll operates on a device, keyed by address
+var (
+	deviceLocks      = make(map[string]*sync.Mutex)
+	deviceLocksMutex sync.Mutex
 )
 
-func NewBLECommand(theBleAdapter *BleAdapter, jsoncommand map[string]interface{}) *BLECommand {
+//The amount of time to wait for GATT service discovery after a device connects
+const servicesResolvedTimeout = 30 * time.Second
+
+//NewBLECommand - Validate a command received from the platform and build the subcommands needed to execute it
+func NewBLECommand(theBleAdapter *BleAdapter, jsoncommand map[string]interface{}) (*BLECommand, error) {
 
 	bleCommand := &BLECommand{
 		adapter:     theBleAdapter,
@@ -71,8 +111,15 @@ func NewBLECommand(theBleAdapter *BleAdapter, jsoncommand map[string]interface{}
 		subCommands: []commandProcessor{},
 	}
 
+	request, err := parseCommandRequest(jsoncommand)
+	if err != nil {
+		return bleCommand, err
+	}
+	bleCommand.request = request
+	bleCommand.adapterCommand = request.adapterCommand
+
 	//Build the array of sub-commands that are needed to handle the entire ble command
-	switch strings.ToLower(jsoncommand["command"].(string)) {
+	switch request.Command {
 	case "pair":
 		bleCommand.subCommands = append(bleCommand.subCommands, pair)
 	case "remove":
@@ -81,44 +128,79 @@ func NewBLECommand(theBleAdapter *BleAdapter, jsoncommand map[string]interface{}
 		bleCommand.subCommands = append(bleCommand.subCommands, connect)
 	case "disconnect":
 		bleCommand.subCommands = append(bleCommand.subCommands, disconnect)
+	case "connectprofile":
+		bleCommand.subCommands = append(bleCommand.subCommands, connectProfile)
+	case "disconnectprofile":
+		bleCommand.subCommands = append(bleCommand.subCommands, disconnectProfile)
 	case "read":
 		bleCommand.subCommands = append(bleCommand.subCommands, connect, read)
 	case "write":
 		bleCommand.subCommands = append(bleCommand.subCommands, connect, write)
 	case "cancelpairing":
 		bleCommand.subCommands = append(bleCommand.subCommands, cancelPairing)
+	case "startadvertising":
+		bleCommand.subCommands = append(bleCommand.subCommands, startAdvertising)
+		return bleCommand, nil
+	case "stopadvertising":
+		bleCommand.subCommands = append(bleCommand.subCommands, stopAdvertising)
+		return bleCommand, nil
+	case "firmwareupdate":
+		//The device restarts once its firmware is updated, so it is not disconnected
+		bleCommand.subCommands = append(bleCommand.subCommands, firmwareUpdate)
+		return bleCommand, nil
+	case "smp":
+		bleCommand.subCommands = append(bleCommand.subCommands, connect, smp)
+	case "listdevices":
+		bleCommand.subCommands = append(bleCommand.subCommands, listDevices)
+		return bleCommand, nil
 	default:
-		return bleCommand
+		//Every command with a schema must be handled above
+		return bleCommand, invalidCommandError("Unable to execute BLE command \"" + request.Command + "\". Unknown command.")
 	}
 
 	log.Printf("[DEBUG] bleCommand.subCommands: %#v", bleCommand.subCommands)
 
-	if (jsoncommand["stayConnected"] == nil || jsoncommand["stayConnected"] != true) &&
-		(strings.ToLower(jsoncommand["command"].(string)) != "disconnect" && strings.ToLower(jsoncommand["command"].(string)) != "remove") {
+	if !request.StayConnected &&
+		(request.Command != "disconnect" && request.Command != "remove" && request.Command != "disconnectprofile") {
+		//Managed devices stay connected
+		if isManagedDevice(request.DeviceAddress) {
+			log.Printf("[DEBUG] Device %s is managed, not adding disconnect command", request.DeviceAddress)
+			return bleCommand, nil
+		}
+
 		log.Printf("[DEBUG] Adding disconnect command")
 		bleCommand.subCommands = append(bleCommand.subCommands, disconnect)
 	}
 
-	return bleCommand
+	return bleCommand, nil
 }
 
 //Execute - Retrieve the BLE device from the object cache and execute the subcommands
 //against the device
 func (cmd BLECommand) Execute() error {
 
-	dev, err := getDevice(&cmd)
-	if err != nil {
-		log.Printf("[ERROR] Unable to execute BLE command \"" + cmd.command["command"].(string) + "\". Error received when retrieving BLE device from DBUS object cache: " + err.Error())
-		return errors.New("Unable to execute BLE command \"" + cmd.command["command"].(string) + "\". Error received when retrieving BLE device from DBUS object cache: " + err.Error())
+	cmd.ctx = cmd.adapter.ctx
+	if cmd.request.Timeout > 0 {
+		cmd.ctx = cbble.WithCallTimeout(cmd.ctx, cmd.request.Timeout)
 	}
 
-	cmd.device = &dev
+	var err error
+	if !cmd.adapterCommand {
+		var dev cbble.Device
+		dev, err = getDevice(&cmd)
+		if err != nil {
+			log.Printf("[ERROR] Unable to execute BLE command \"" + cmd.request.Command + "\". Error received when retrieving BLE device from DBUS object cache: " + err.Error())
+			return newCommandError("", errorCodeDeviceNotFound, "Unable to execute BLE command \""+cmd.request.Command+"\". Error received when retrieving BLE device from DBUS object cache: "+err.Error(), err)
+		}
+
+		cmd.device = &dev
+	}
 
 	for _, subcmd := range cmd.subCommands {
-		log.Printf("[DEBUG] Executing subcommand %s", subcmd.Name())
+		log.Printf("[DEBUG] Executing subcommand %s%s", subcmd.Name(), cmd.logFields())
 		err = subcmd.Process(&cmd)
 		if err != nil {
-			log.Printf("[ERROR] Error executing subcommand %s", subcmd.Name())
+			log.Printf("[ERROR] Error executing subcommand %s%s", subcmd.Name(), cmd.logFields())
 			break
 		}
 	}
@@ -133,9 +215,9 @@ func (cmd Pair) Name() string {
 
 //Process - Execute the subcommand
 func (cmd Pair) Process(blecmd *BLECommand) error {
-	if err := (*blecmd.device).Pair(); err != nil {
+	if err := blecmd.retry(retryPair, (*blecmd.device).PairContext); err != nil {
 		log.Printf("[ERROR] Error while pairing: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to pair with BLE device. Error received when attempting to pair with BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to pair with BLE device. Error received when attempting to pair with BLE device: "+err.Error(), err)
 	}
 	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
 	return nil
@@ -150,7 +232,7 @@ func (cmd CancelPairing) Name() string {
 func (cmd CancelPairing) Process(blecmd *BLECommand) error {
 	if err := (*blecmd.device).CancelPairing(); err != nil {
 		log.Printf("[ERROR] Error while attempting to cancel pairing: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to cancel pairing with BLE device. Error received when attempting to cancel pairing with BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to cancel pairing with BLE device. Error received when attempting to cancel pairing with BLE device: "+err.Error(), err)
 	}
 	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
 	return nil
@@ -166,13 +248,14 @@ func (cmd Remove) Process(blecmd *BLECommand) error {
 	adapter, err := blecmd.adapter.connection.GetAdapter()
 	if err != nil {
 		log.Printf("[ERROR] Error while retrieving adapter: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to remove BLE device. Error received when retrieving Bluetooth adapter: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to remove BLE device. Error received when retrieving Bluetooth adapter: "+err.Error(), err)
 	}
 
 	if err = adapter.RemoveDevice(blecmd.device); err != nil {
 		log.Printf("[ERROR] Error while removing BLE device: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to remove BLE device. Error received when attempting to remove the BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to remove BLE device. Error received when attempting to remove the BLE device: "+err.Error(), err)
 	}
+	setDeviceConnected(blecmd.request.DeviceAddress, false)
 	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
 	return nil
 }
@@ -184,10 +267,19 @@ func (cmd Connect) Name() string {
 
 //Process - Execute the subcommand
 func (cmd Connect) Process(blecmd *BLECommand) error {
-	if err := (*blecmd.device).Connect(); err != nil {
+	if err := blecmd.retry(retryConnect, (*blecmd.device).ConnectContext); err != nil {
 		log.Printf("[ERROR] Error while connecting to BLE device: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to connect to BLE device. Error received when attempting to connect to the BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to connect to BLE device. Error received when attempting to connect to the BLE device: "+err.Error(), err)
+	}
+	setDeviceConnected(blecmd.request.DeviceAddress, true)
+
+	//The characteristics of a device are not in the object cache until service discovery completes
+	dev, err := blecmd.adapter.connection.WaitForServicesResolved(blecmd.ctx, (*blecmd.device).Address(), servicesResolvedTimeout)
+	if err != nil {
+		log.Printf("[ERROR] Error while resolving the services of BLE device: %s", err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to connect to BLE device. Error received when waiting for the services of the BLE device to be resolved: "+err.Error(), err)
 	}
+	*blecmd.device = dev
 	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
 	return nil
 }
@@ -199,9 +291,42 @@ func (cmd Disconnect) Name() string {
 
 //Process - Execute the subcommand
 func (cmd Disconnect) Process(blecmd *BLECommand) error {
-	if err := (*blecmd.device).Disconnect(); err != nil {
+	if err := (*blecmd.device).DisconnectContext(blecmd.ctx); err != nil {
 		log.Printf("[ERROR] Error while disconnecting from BLE device: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to disconnect from BLE device. Error received when attempting to disconnect from the BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to disconnect from BLE device. Error received when attempting to disconnect from the BLE device: "+err.Error(), err)
+	}
+	setDeviceConnected(blecmd.request.DeviceAddress, false)
+	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	return nil
+}
+
+//Name - Return the name of the subcommand
+func (cmd ConnectProfile) Name() string {
+	return "ConnectProfile"
+}
+
+//Process - Execute the subcommand
+func (cmd ConnectProfile) Process(blecmd *BLECommand) error {
+	profile := blecmd.request.ProfileUUID
+	if err := (*blecmd.device).ConnectProfile(profile); err != nil {
+		log.Printf("[ERROR] Error while connecting profile %s: %s", profile, err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to connect profile. Error received when attempting to connect the BLE device profile: "+err.Error(), err)
+	}
+	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	return nil
+}
+
+//Name - Return the name of the subcommand
+func (cmd DisconnectProfile) Name() string {
+	return "DisconnectProfile"
+}
+
+//Process - Execute the subcommand
+func (cmd DisconnectProfile) Process(blecmd *BLECommand) error {
+	profile := blecmd.request.ProfileUUID
+	if err := (*blecmd.device).DisconnectProfile(profile); err != nil {
+		log.Printf("[ERROR] Error while disconnecting profile %s: %s", profile, err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to disconnect profile. Error received when attempting to disconnect the BLE device profile: "+err.Error(), err)
 	}
 	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
 	return nil
@@ -214,17 +339,21 @@ func (cmd Read) Name() string {
 
 //Process - Execute the subcommand
 func (cmd Read) Process(blecmd *BLECommand) error {
-
-	gattChar := strings.ToLower(blecmd.command["gattCharacteristic"].(string))
-	if gattChar == "" {
-		log.Printf("[ERROR] Unable to read BLE data. GATT characteristic UUID not provided.")
-		return errors.New(cmd.Name() + ":Process - Unable to read BLE data. GATT characteristic UUID not provided.")
+	gattChar := blecmd.request.GattCharacteristic
+	char, err := blecmd.adapter.connection.GetDeviceCharacteristic(*blecmd.device, gattChar)
+	if err != nil {
+		log.Printf("[ERROR] Unable to read BLE data. GATT characteristic %s not found: %s", gattChar, err.Error())
+		return newCommandError(cmd.Name(), errorCodeCharNotFound, "Unable to read BLE data. GATT characteristic "+gattChar+" not found.", err)
 	}
 
-	val, err := blecmd.adapter.connection.ReadCharacteristic(gattChar)
+	var val []byte
+	err = blecmd.retry(retryRead, func(ctx context.Context) (err error) {
+		val, err = char.ReadValueContext(ctx)
+		return err
+	})
 	if err != nil {
 		log.Printf("[ERROR] Error while reading from BLE device: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to read data from BLE device. Error received when attempting to read from the BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to read data from BLE device. Error received when attempting to read from the BLE device: "+err.Error()+pairingHint(*blecmd.device, err), err)
 	}
 	if val != nil {
 		log.Printf("[DEBUG] Value read from BLE device: %#v", val)
@@ -241,43 +370,89 @@ func (cmd Write) Name() string {
 
 //Process - Execute the subcommand
 func (cmd Write) Process(blecmd *BLECommand) error {
-	var gattValue = blecmd.command["gattCharacteristicValue"]
-	var gattChar = strings.ToLower(blecmd.command["gattCharacteristic"].(string))
-
-	if gattChar == "" {
-		log.Printf("[ERROR] Unable to write BLE data to BLE device. GATT characteristic UUID not provided.")
-		return errors.New(cmd.Name() + ":Process - Unable to write BLE data to BLE device. GATT characteristic UUID not provided.")
-	}
-
-	if gattValue == nil {
-		log.Printf("[ERROR] Unable to write BLE data to BLE device. Gatt characteristic value not provided.")
-		return errors.New(cmd.Name() + ":Process - Unable to write BLE data to BLE device. Gatt characteristic value not provided.")
-	}
+	gattChar := blecmd.request.GattCharacteristic
+	gattValueBytes := blecmd.request.GattCharacteristicValue
+	log.Printf("[DEBUG] gattValueBytes = %#v", gattValueBytes)
 
-	//The array of bytes passed in json will be passed as []interface{float, float, ...}
-	//We need to convert the json value to a byte array
-	gattValueBytes := make([]byte, len(gattValue.([]interface{})))
-	for i, elem := range gattValue.([]interface{}) {
-		gattValueBytes[i] = byte(elem.(float64))
+	char, err := blecmd.adapter.connection.GetDeviceCharacteristic(*blecmd.device, gattChar)
+	if err != nil {
+		log.Printf("[ERROR] Unable to write BLE data to BLE device. GATT characteristic %s not found: %s", gattChar, err.Error())
+		return newCommandError(cmd.Name(), errorCodeCharNotFound, "Unable to write BLE data to BLE device. GATT characteristic "+gattChar+" not found.", err)
 	}
-	log.Printf("[DEBUG] gattValueBytes = %#v", gattValueBytes)
 
-	if err := blecmd.adapter.connection.WriteCharacteristic(strings.ToLower(gattChar), gattValueBytes); err != nil {
+	err = blecmd.retry(retryWrite, func(ctx context.Context) error {
+		return char.WriteValueContext(ctx, gattValueBytes)
+	})
+	if err != nil {
 		log.Printf("[ERROR] Error while writing: %s", err.Error())
-		return errors.New(cmd.Name() + ":Process - Unable to write BLE data to BLE device. Error received when attempting to write to the BLE device: " + err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to write BLE data to BLE device. Error received when attempting to write to the BLE device: "+err.Error()+pairingHint(*blecmd.device, err), err)
 	}
 	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
 	return nil
 }
 
 func getDevice(blecmd *BLECommand) (cbble.Device, error) {
-	log.Printf("[DEBUG] Retrieving BLE Device from DBUS object cache. Device address = %s", blecmd.command["deviceAddress"].(string))
-	return blecmd.adapter.connection.GetDeviceByAddress(blecmd.command["deviceAddress"].(string))
+	log.Printf("[DEBUG] Retrieving BLE Device from DBUS object cache. Device address = %s", blecmd.request.DeviceAddress)
+	return blecmd.adapter.connection.GetDeviceByAddress(blecmd.request.DeviceAddress)
+}
+
+//setDeviceConnected - Record whether a BLE command left the device with the specified address connected
+func setDeviceConnected(address string, connected bool) {
+	connectedDevicesMutex.Lock()
+	defer connectedDevicesMutex.Unlock()
+
+	if connected {
+		connectedDevices[address] = true
+	} else {
+		delete(connectedDevices, address)
+	}
 }
 
-func getCharacteristic(blecmd *BLECommand) (cbble.Characteristic, error) {
-	log.Printf("[DEBUG] Retrieving GATT characteristic from DBUS object cache. Characteristic uuid = %s", blecmd.command["gattCharacteristic"].(string))
-	return blecmd.adapter.connection.GetCharacteristic(blecmd.command["gattCharacteristic"].(string))
+//disconnectConnectedDevices - Disconnect every device left connected by BLE commands
+func disconnectConnectedDevices(conn *cbble.Connection) {
+	connectedDevicesMutex.Lock()
+	defer connectedDevicesMutex.Unlock()
+
+	for address := range connectedDevices {
+		log.Printf("[DEBUG] Disconnecting BLE device %s", address)
+		device, err := conn.GetDeviceByAddress(address)
+		if err != nil {
+			log.Printf("[ERROR] Unable to retrieve BLE device %s: %s", address, err.Error())
+		} else if err := device.Disconnect(); err != nil {
+			log.Printf("[ERROR] Error while disconnecting from BLE device %s: %s", address, err.Error())
+		}
+		delete(connectedDevices, address)
+	}
+}
+
+//lockDevice - Wait until no other BLE command or poll is operating on the device with the specified
+//address, then lock it. The returned function releases the lock
+func lockDevice(address string) func() {
+	address = normalizeAddress(address)
+
+	deviceLocksMutex.Lock()
+	lock, ok := deviceLocks[address]
+	if !ok {
+		lock = &sync.Mutex{}
+		deviceLocks[address] = lock
+	}
+	deviceLocksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+//logFields - Fields appended to log messages so that structured logs can be correlated with the command.
+//The optional commandId is specified by the platform when the command is sent
+func (cmd BLECommand) logFields() string {
+	fields := ""
+	if commandID, ok := cmd.command["commandId"]; ok && commandID != nil {
+		fields += fmt.Sprintf(" commandId=%v", commandID)
+	}
+	if address, ok := cmd.command["deviceAddress"].(string); ok && address != "" {
+		fields += " address=" + address
+	}
+	return fields
 }
 
 func (cmd BLECommand) sendSuccess(msg string) {
@@ -288,10 +463,11 @@ func (cmd BLECommand) sendSuccess(msg string) {
 	cmd.endCommand()
 }
 
-func (cmd BLECommand) sendError(msg string) {
+func (cmd BLECommand) sendError(msg string, err *commandError) {
 	log.Printf("[DEBUG] Sending error response to platform")
 	cmd.command["err"] = true
 	cmd.command["response"] = msg
+	cmd.command["error"] = err
 
 	cmd.endCommand()
 }
@@ -307,7 +483,7 @@ func sendCommandResponse(blecommand *BLECommand) {
 	resp, err := json.Marshal(blecommand.command)
 	if err == nil {
 		log.Printf("[DEBUG] Publishing response to platform")
-		blecommand.adapter.cbDeviceClient.Publish(blecommand.adapter.cbDeviceClient.DeviceName+"/"+deviceSubscribeTopic+"/response", resp, messagingQos)
+		blecommand.adapter.transport.Publish(deviceSubscribeTopic+"/response", resp, messagingQos)
 	} else {
 		log.Printf("[ERROR] Error marshalling response to platform: %s", err.Error())
 	}
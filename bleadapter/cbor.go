@@ -0,0 +1,323 @@
+package bleadapter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+//A minimal CBOR (RFC 7049) encoder and decoder, sufficient for the SMP protocol
+//
+//Encoded values may be maps with string keys, arrays, strings, byte strings, integers, booleans
+//and nil. Decoded maps with string keys are returned as map[string]interface{}, integers as int64
+//or uint64 and byte strings as []byte. Indefinite length maps, arrays and strings, used by older
+//versions of mcumgr, are supported.
+
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborString   = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+//cborEncode - Encode a value as CBOR
+func cborEncode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := cborEncodeValue(&buffer, value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func cborEncodeValue(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if v {
+			buffer.WriteByte(cborSimple<<5 | 21)
+		} else {
+			buffer.WriteByte(cborSimple<<5 | 20)
+		}
+	case int:
+		cborEncodeInt(buffer, int64(v))
+	case int64:
+		cborEncodeInt(buffer, v)
+	case uint32:
+		cborEncodeHead(buffer, cborUnsigned, uint64(v))
+	case uint64:
+		cborEncodeHead(buffer, cborUnsigned, v)
+	case string:
+		cborEncodeHead(buffer, cborString, uint64(len(v)))
+		buffer.WriteString(v)
+	case []byte:
+		cborEncodeHead(buffer, cborBytes, uint64(len(v)))
+		buffer.Write(v)
+	case []interface{}:
+		cborEncodeHead(buffer, cborArray, uint64(len(v)))
+		for _, elem := range v {
+			if err := cborEncodeValue(buffer, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		//Keys are sorted so that the encoding is deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		cborEncodeHead(buffer, cborMap, uint64(len(v)))
+		for _, key := range keys {
+			cborEncodeHead(buffer, cborString, uint64(len(key)))
+			buffer.WriteString(key)
+			if err := cborEncodeValue(buffer, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unable to encode %T as CBOR", value)
+	}
+	return nil
+}
+
+func cborEncodeInt(buffer *bytes.Buffer, value int64) {
+	if value < 0 {
+		cborEncodeHead(buffer, cborNegative, uint64(-(value + 1)))
+	} else {
+		cborEncodeHead(buffer, cborUnsigned, uint64(value))
+	}
+}
+
+//cborEncodeHead - Encode the major type and argument of a data item
+func cborEncodeHead(buffer *bytes.Buffer, majorType byte, argument uint64) {
+	head := majorType << 5
+	switch {
+	case argument < 24:
+		buffer.WriteByte(head | byte(argument))
+	case argument <= math.MaxUint8:
+		buffer.Write([]byte{head | 24, byte(argument)})
+	case argument <= math.MaxUint16:
+		buffer.WriteByte(head | 25)
+		binary.Write(buffer, binary.BigEndian, uint16(argument)) // nolint
+	case argument <= math.MaxUint32:
+		buffer.WriteByte(head | 26)
+		binary.Write(buffer, binary.BigEndian, uint32(argument)) // nolint
+	default:
+		buffer.WriteByte(head | 27)
+		binary.Write(buffer, binary.BigEndian, argument) // nolint
+	}
+}
+
+//cborHeadSize - Return the number of bytes cborEncodeHead writes for an argument
+func cborHeadSize(argument uint64) int {
+	switch {
+	case argument < 24:
+		return 1
+	case argument <= math.MaxUint8:
+		return 2
+	case argument <= math.MaxUint16:
+		return 3
+	case argument <= math.MaxUint32:
+		return 5
+	}
+	return 9
+}
+
+//cborDecoder - Decodes CBOR data items from a byte slice
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+//cborDecode - Decode a single CBOR data item
+func cborDecode(data []byte) (interface{}, error) {
+	decoder := &cborDecoder{data: data}
+	value, err := decoder.decode()
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(data) {
+		return nil, errors.New("unexpected data after CBOR value")
+	}
+	return value, nil
+}
+
+func (decoder *cborDecoder) next(count int) ([]byte, error) {
+	if count < 0 || count > len(decoder.data)-decoder.offset {
+		return nil, errors.New("truncated CBOR data")
+	}
+	value := decoder.data[decoder.offset : decoder.offset+count]
+	decoder.offset += count
+	return value, nil
+}
+
+//head - Decode the major type, additional information and argument of a data item
+func (decoder *cborDecoder) head() (majorType byte, additional byte, argument uint64, err error) {
+	initial, err := decoder.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	majorType, additional = initial[0]>>5, initial[0]&0x1f
+
+	switch {
+	case additional < 24:
+		return majorType, additional, uint64(additional), nil
+	case additional == cborIndefinite:
+		return majorType, additional, 0, nil
+	case additional > 27:
+		return 0, 0, 0, fmt.Errorf("invalid CBOR additional information %d", additional)
+	}
+
+	size := 1 << (additional - 24)
+	bytes, err := decoder.next(size)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, b := range bytes {
+		argument = argument<<8 | uint64(b)
+	}
+	return majorType, additional, argument, nil
+}
+
+//isBreak - Consume the break stop code ending an indefinite length item, if it is next
+func (decoder *cborDecoder) isBreak() bool {
+	if decoder.offset < len(decoder.data) && decoder.data[decoder.offset] == cborBreak {
+		decoder.offset++
+		return true
+	}
+	return false
+}
+
+func (decoder *cborDecoder) decode() (interface{}, error) {
+	majorType, additional, argument, err := decoder.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := additional == cborIndefinite
+
+	//Every byte of a string, and every item of an array or map, takes at least one byte, so a
+	//length larger than the remaining data is invalid. Checking before the length is converted
+	//to an int keeps lengths near 2^64 from overflowing
+	if !indefinite && majorType >= cborBytes && majorType <= cborMap && argument > uint64(len(decoder.data)-decoder.offset) {
+		return nil, errors.New("truncated CBOR data")
+	}
+
+	switch majorType {
+	case cborUnsigned:
+		return argument, nil
+	case cborNegative:
+		if argument > math.MaxInt64 {
+			return nil, errors.New("CBOR negative integer out of range")
+		}
+		return -1 - int64(argument), nil
+	case cborBytes, cborString:
+		var value []byte
+		if indefinite {
+			//Indefinite length strings are a series of definite length chunks
+			value = []byte{}
+			for !decoder.isBreak() {
+				chunk, err := decoder.decode()
+				if err != nil {
+					return nil, err
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					value = append(value, c...)
+				case string:
+					value = append(value, c...)
+				default:
+					return nil, errors.New("invalid CBOR string chunk")
+				}
+			}
+		} else if value, err = decoder.next(int(argument)); err != nil {
+			return nil, err
+		}
+		if majorType == cborString {
+			return string(value), nil
+		}
+		return append([]byte{}, value...), nil
+	case cborArray:
+		array := []interface{}{}
+		for i := uint64(0); indefinite || i < argument; i++ {
+			if indefinite && decoder.isBreak() {
+				break
+			}
+			elem, err := decoder.decode()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, elem)
+		}
+		return array, nil
+	case cborMap:
+		object := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < argument; i++ {
+			if indefinite && decoder.isBreak() {
+				break
+			}
+			key, err := decoder.decode()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decoder.decode()
+			if err != nil {
+				return nil, err
+			}
+			//Keys other than strings are converted to strings
+			object[fmt.Sprint(key)] = value
+		}
+		return object, nil
+	case cborTag:
+		//Tags are ignored
+		return decoder.decode()
+	case cborSimple:
+		switch additional {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return float64(halfToFloat(uint16(argument))), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(argument))), nil
+		case 27:
+			return math.Float64frombits(argument), nil
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value %d", argument)
+	}
+	return nil, fmt.Errorf("unsupported CBOR major type %d", majorType)
+}
+
+//halfToFloat - Convert an IEEE 754 half precision value to a float32
+func halfToFloat(half uint16) float32 {
+	sign := uint32(half>>15) << 31
+	exponent := uint32(half>>10) & 0x1f
+	mantissa := uint32(half) & 0x3ff
+
+	switch exponent {
+	case 0:
+		//Subnormal numbers
+		value := float32(mantissa) / 1024 / 16384
+		if sign != 0 {
+			return -value
+		}
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exponent+112)<<23 | mantissa<<13)
+}
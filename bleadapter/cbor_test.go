@@ -0,0 +1,211 @@
+package bleadapter
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCBOREncode(t *testing.T) {
+	//Expected encodings from RFC 7049 Appendix A
+	tests := []struct {
+		name    string
+		value   interface{}
+		encoded string
+	}{
+		{"zero", 0, "00"},
+		{"largest immediate", 23, "17"},
+		{"one byte argument", 24, "1818"},
+		{"one byte argument 100", 100, "1864"},
+		{"two byte argument", 1000, "1903e8"},
+		{"four byte argument", 1000000, "1a000f4240"},
+		{"eight byte argument", uint64(1000000000000), "1b000000e8d4a51000"},
+		{"uint32", uint32(65536), "1a00010000"},
+		{"negative", -1, "20"},
+		{"negative one byte argument", -100, "3863"},
+		{"negative two byte argument", int64(-1000), "3903e7"},
+		{"false", false, "f4"},
+		{"true", true, "f5"},
+		{"null", nil, "f6"},
+		{"empty string", "", "60"},
+		{"string", "IETF", "6449455446"},
+		{"byte string", []byte{1, 2, 3, 4}, "4401020304"},
+		{"array", []interface{}{1, []interface{}{2, 3}}, "8201820203"},
+		{"map with sorted keys", map[string]interface{}{"b": []interface{}{2, 3}, "a": 1}, "a26161016162820203"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := cborEncode(test.value)
+			if err != nil {
+				t.Fatalf("cborEncode(%#v) returned error: %s", test.value, err.Error())
+			}
+			if hex.EncodeToString(encoded) != test.encoded {
+				t.Errorf("cborEncode(%#v) = %x, expected %s", test.value, encoded, test.encoded)
+			}
+		})
+	}
+}
+
+func TestCBORHeadSize(t *testing.T) {
+	for _, argument := range []uint64{0, 23, 24, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64} {
+		var buffer bytes.Buffer
+		cborEncodeHead(&buffer, cborBytes, argument)
+		if size := cborHeadSize(argument); size != buffer.Len() {
+			t.Errorf("cborHeadSize(%d) = %d, expected %d", argument, size, buffer.Len())
+		}
+	}
+}
+
+func TestCBOREncodeUnsupportedType(t *testing.T) {
+	if _, err := cborEncode(map[string]interface{}{"value": 1.5}); err == nil {
+		t.Error("cborEncode of a float did not return an error")
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	//Integers are decoded as uint64 or int64
+	tests := []struct {
+		name    string
+		value   interface{}
+		decoded interface{}
+	}{
+		{"null", nil, nil},
+		{"boolean", true, true},
+		{"small integer", 10, uint64(10)},
+		{"uint8 boundary", 255, uint64(255)},
+		{"uint16 boundary", 65535, uint64(65535)},
+		{"uint32 boundary", 4294967295, uint64(4294967295)},
+		{"uint64", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"negative integer", -24, int64(-24)},
+		{"negative uint8 boundary", -256, int64(-256)},
+		{"min int64", int64(math.MinInt64), int64(math.MinInt64)},
+		{"string", "mcumgr", "mcumgr"},
+		{"empty byte string", []byte{}, []byte{}},
+		{"byte string", []byte{0xde, 0xad, 0xbe, 0xef}, []byte{0xde, 0xad, 0xbe, 0xef}},
+		{"empty array", []interface{}{}, []interface{}{}},
+		{
+			"image upload request",
+			map[string]interface{}{"image": 0, "len": 70000, "off": 0, "sha": []byte{1, 2}, "data": []byte{3, 4}},
+			map[string]interface{}{"image": uint64(0), "len": uint64(70000), "off": uint64(0), "sha": []byte{1, 2}, "data": []byte{3, 4}},
+		},
+		{
+			"nested",
+			map[string]interface{}{"images": []interface{}{map[string]interface{}{"slot": 1, "active": false, "version": "1.0.0"}}},
+			map[string]interface{}{"images": []interface{}{map[string]interface{}{"slot": uint64(1), "active": false, "version": "1.0.0"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := cborEncode(test.value)
+			if err != nil {
+				t.Fatalf("cborEncode(%#v) returned error: %s", test.value, err.Error())
+			}
+			decoded, err := cborDecode(encoded)
+			if err != nil {
+				t.Fatalf("cborDecode(%x) returned error: %s", encoded, err.Error())
+			}
+			if !reflect.DeepEqual(decoded, test.decoded) {
+				t.Errorf("cborDecode(cborEncode(%#v)) = %#v, expected %#v", test.value, decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	//Encodings from RFC 7049 Appendix A that cborEncode does not produce
+	tests := []struct {
+		name    string
+		encoded string
+		decoded interface{}
+	}{
+		{"indefinite byte string", "5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"indefinite text string", "7f657374726561646d696e67ff", "streaming"},
+		{"empty indefinite array", "9fff", []interface{}{}},
+		{"indefinite array", "9f018202039f0405ffff", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+		{"indefinite map", "bf61610161629f0203ffff", map[string]interface{}{"a": uint64(1), "b": []interface{}{uint64(2), uint64(3)}}},
+		{"integer map keys", "a201020304", map[string]interface{}{"1": uint64(2), "3": uint64(4)}},
+		{"half float zero", "f90000", float64(0)},
+		{"half float negative zero", "f98000", math.Copysign(0, -1)},
+		{"half float one", "f93c00", float64(1)},
+		{"half float", "f93e00", float64(1.5)},
+		{"half float largest", "f97bff", float64(65504)},
+		{"half float smallest normal", "f90400", 6.103515625e-05},
+		{"half float smallest subnormal", "f90001", 5.960464477539063e-08},
+		{"half float negative", "f9c400", float64(-4)},
+		{"half float infinity", "f97c00", math.Inf(1)},
+		{"half float negative infinity", "f9fc00", math.Inf(-1)},
+		{"single float", "fa47c35000", float64(100000)},
+		{"double float", "fb3ff199999999999a", 1.1},
+		{"undefined", "f7", nil},
+		{"tag", "c11a514b67b0", uint64(1363896240)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.encoded)
+			decoded, err := cborDecode(data)
+			if err != nil {
+				t.Fatalf("cborDecode(%s) returned error: %s", test.encoded, err.Error())
+			}
+			if !reflect.DeepEqual(decoded, test.decoded) {
+				t.Errorf("cborDecode(%s) = %#v, expected %#v", test.encoded, decoded, test.decoded)
+			}
+			if f, ok := test.decoded.(float64); ok && math.Signbit(f) != math.Signbit(decoded.(float64)) {
+				t.Errorf("cborDecode(%s) = %#v, expected the sign of %#v", test.encoded, decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestCBORDecodeHalfFloatNaN(t *testing.T) {
+	decoded, err := cborDecode([]byte{0xf9, 0x7e, 0x00})
+	if err != nil {
+		t.Fatalf("cborDecode returned error: %s", err.Error())
+	}
+	if f, ok := decoded.(float64); !ok || !math.IsNaN(f) {
+		t.Errorf("cborDecode(f97e00) = %#v, expected NaN", decoded)
+	}
+}
+
+func TestCBORDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"truncated argument", "1903"},
+		{"truncated eight byte argument", "1b000000e8d4a510"},
+		{"truncated string", "64494554"},
+		{"truncated byte string", "4401"},
+		{"string longer than the data", "7bffffffffffffffff"},
+		{"byte string length near 2^63", "5b7fffffffffffffff"},
+		{"byte string length overflowing int", "5b8000000000000000"},
+		{"array longer than the data", "9b7fffffffffffffff"},
+		{"map longer than the data", "bb7fffffffffffffff00"},
+		{"truncated array", "830102"},
+		{"truncated map", "a16161"},
+		{"truncated half float", "f93c"},
+		{"indefinite array without break", "9f0102"},
+		{"indefinite map without break", "bf616101"},
+		{"indefinite string without break", "5f4101"},
+		{"indefinite string with invalid chunk", "5f01ff"},
+		{"negative integer out of range", "3bffffffffffffffff"},
+		{"reserved additional information", "1c"},
+		{"unsupported simple value", "f0"},
+		{"trailing data", "0000"},
+		{"unexpected break", "ff"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.encoded)
+			if decoded, err := cborDecode(data); err == nil {
+				t.Errorf("cborDecode(%s) = %#v, expected an error", test.encoded, decoded)
+			}
+		})
+	}
+}
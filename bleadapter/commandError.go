@@ -0,0 +1,129 @@
+package bleadapter
+
+import (
+	"context"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to the errors returned by BLE commands
+//
+//When a command fails, its response contains an error object in addition to the err flag and
+//response message:
+//
+// "error": {
+//		"code": "NOT_CONNECTED",
+//		"subcommand": "Read",
+//		"dbusError": "org.bluez.Error.NotConnected",
+//		"message": "Read:Process - Unable to read data from BLE device. ..."
+// }
+//
+//The code is one of the errorCode constants below and does not change between releases, so that
+//platform code can branch on it. dbusError is only present when BlueZ returned the error.
+
+const (
+	errorCodeDeviceNotFound    = "DEVICE_NOT_FOUND"
+	errorCodeNotConnected      = "NOT_CONNECTED"
+	errorCodeConnectionAborted = "CONNECTION_ABORTED"
+	errorCodeAuthFailed        = "AUTH_FAILED"
+	errorCodeCharNotFound      = "CHAR_NOT_FOUND"
+	errorCodeNotPermitted      = "NOT_PERMITTED"
+	errorCodeNotSupported      = "NOT_SUPPORTED"
+	errorCodeInProgress        = "IN_PROGRESS"
+	errorCodeNotReady          = "NOT_READY"
+	errorCodeAlreadyExists     = "ALREADY_EXISTS"
+	errorCodeTimeout           = "TIMEOUT"
+	errorCodeCancelled         = "CANCELLED"
+	errorCodeInvalidCommand    = "INVALID_COMMAND"
+	errorCodeFailed            = "FAILED"
+)
+
+//The error codes of classified BlueZ errors
+var bluezErrorCodes = map[cbble.ErrorKind]string{
+	cbble.ErrorInProgress:        errorCodeInProgress,
+	cbble.ErrorNotReady:          errorCodeNotReady,
+	cbble.ErrorConnectionAborted: errorCodeConnectionAborted,
+	cbble.ErrorTimeout:           errorCodeTimeout,
+	cbble.ErrorNotConnected:      errorCodeNotConnected,
+	cbble.ErrorAlreadyExists:     errorCodeAlreadyExists,
+	cbble.ErrorNotAuthorized:     errorCodeAuthFailed,
+	cbble.ErrorNotPermitted:      errorCodeNotPermitted,
+	cbble.ErrorNotSupported:      errorCodeNotSupported,
+	cbble.ErrorInvalidArguments:  errorCodeInvalidCommand,
+	cbble.ErrorDoesNotExist:      errorCodeDeviceNotFound,
+	cbble.ErrorFailed:            errorCodeFailed,
+}
+
+//commandError - An error that caused a BLE command to fail
+type commandError struct {
+	Code       string   `json:"code"`
+	Subcommand string   `json:"subcommand,omitempty"`
+	DBusError  string   `json:"dbusError,omitempty"`
+	Message    string   `json:"message"`
+	Details    []string `json:"details,omitempty"` //The problems found when a command fails validation
+}
+
+//Error - Return the message of the error
+func (err *commandError) Error() string {
+	return err.Message
+}
+
+//newCommandError - Create the error returned when a subcommand fails. When code is empty, the code is
+//determined from cause, the error that caused the failure
+func newCommandError(subcommand string, code string, message string, cause error) *commandError {
+	err := &commandError{Code: code, Subcommand: subcommand, Message: message}
+	if subcommand != "" {
+		err.Message = subcommand + ":Process - " + message
+	}
+
+	switch theCause := cause.(type) {
+	case *cbble.Error:
+		err.DBusError = theCause.Name
+		if err.Code == "" {
+			err.Code = bluezErrorCodes[theCause.Kind]
+		}
+	case *commandError:
+		err.DBusError = theCause.DBusError
+		if err.Code == "" {
+			err.Code = theCause.Code
+		}
+	}
+
+	if err.Code == "" {
+		switch cause {
+		case context.Canceled:
+			err.Code = errorCodeCancelled
+		case context.DeadlineExceeded:
+			err.Code = errorCodeTimeout
+		default:
+			err.Code = errorCodeFailed
+		}
+	}
+	return err
+}
+
+//invalidCommandError - Create the error returned when a command is missing an option or specifies an invalid value
+func invalidCommandError(message string) *commandError {
+	return &commandError{Code: errorCodeInvalidCommand, Message: message}
+}
+
+//invalidCommandDetails - Create the error returned when a command fails validation, listing each problem found
+func invalidCommandDetails(message string, details []string) *commandError {
+	return &commandError{Code: errorCodeInvalidCommand, Message: message, Details: details}
+}
+
+//pairingHint - Explain how to resolve an error returned because an operation requires a paired device
+func pairingHint(device cbble.Device, err error) string {
+	if cbble.ErrorKindOf(err) == cbble.ErrorNotAuthorized && !device.Paired() {
+		return " The characteristic requires encryption or authentication, pair with the BLE device before retrying the command."
+	}
+	return ""
+}
+
+//toCommandError - Convert the error returned by a command to a commandError
+func toCommandError(err error) *commandError {
+	if theErr, ok := err.(*commandError); ok {
+		return theErr
+	}
+	return newCommandError("", "", err.Error(), err)
+}
@@ -0,0 +1,305 @@
+package bleadapter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to validating BLE commands
+//
+//Each command received from the platform is validated against the schema of the command before
+//any of it is executed. A command is rejected with an INVALID_COMMAND error, listing every
+//problem found in the details of the error, when:
+//
+//  - The command is unknown
+//  - The version of the command is not supported
+//  - A required field is missing or empty
+//  - A field has the wrong data type or an invalid value
+//
+//Fields that are not part of the schema are ignored. The fields common to every command are
+//decoded into a commandRequest, which the subcommands use rather than the raw command.
+
+const (
+	//The version of the command format. Commands that do not specify a version are version 1
+	commandVersion = 1
+
+	fieldString  = "string"
+	fieldBoolean = "boolean"
+	fieldNumber  = "number"
+	fieldInteger = "integer"
+	fieldBytes   = "bytes" //An array of integers between 0 and 255
+	fieldUUID    = "uuid"  //A 16, 32 or 128 bit UUID, ex. 180d, 0x180D or 0000180d-0000-1000-8000-00805f9b34fb
+	fieldObject  = "object"
+	fieldArray   = "array"
+	fieldAny     = "any"
+)
+
+//schemaField - A field of a command schema
+type schemaField struct {
+	dataType string
+	required bool
+}
+
+//commandSchema - The fields accepted by a command
+type commandSchema struct {
+	fields map[string]schemaField
+
+	//Adapter level commands do not operate on a device, so they do not require a deviceAddress
+	adapterCommand bool
+}
+
+//The fields accepted by every command
+var commonSchemaFields = map[string]schemaField{
+	"command":       {dataType: fieldString, required: true},
+	"version":       {dataType: fieldInteger},
+	"commandId":     {dataType: fieldAny},
+	"deviceAddress": {dataType: fieldString},
+	"devicePath":    {dataType: fieldString},
+	"stayConnected": {dataType: fieldBoolean},
+	"timeoutMs":     {dataType: fieldNumber},
+}
+
+//The schemas of the BLE commands, keyed by the lower case command name
+var commandSchemas = map[string]commandSchema{
+	"pair":          {},
+	"remove":        {},
+	"connect":       {},
+	"disconnect":    {},
+	"cancelpairing": {},
+	"connectprofile": {fields: map[string]schemaField{
+		"profileUUID": {dataType: fieldUUID, required: true},
+	}},
+	"disconnectprofile": {fields: map[string]schemaField{
+		"profileUUID": {dataType: fieldUUID, required: true},
+	}},
+	"read": {fields: map[string]schemaField{
+		"gattCharacteristic": {dataType: fieldUUID, required: true},
+	}},
+	"write": {fields: map[string]schemaField{
+		"gattCharacteristic":      {dataType: fieldUUID, required: true},
+		"gattCharacteristicValue": {dataType: fieldBytes, required: true},
+	}},
+	"startadvertising": {adapterCommand: true, fields: map[string]schemaField{
+		"advertisementId":   {dataType: fieldString, required: true},
+		"advertisementType": {dataType: fieldString},
+		"ibeacon":           {dataType: fieldObject},
+		"eddystone":         {dataType: fieldObject},
+		"manufacturerData":  {dataType: fieldObject},
+		"serviceData":       {dataType: fieldObject},
+		"serviceUUIDs":      {dataType: fieldArray},
+		"localName":         {dataType: fieldString},
+		"connectable":       {dataType: fieldBoolean},
+		"minIntervalMs":     {dataType: fieldNumber},
+		"maxIntervalMs":     {dataType: fieldNumber},
+		"txPower":           {dataType: fieldNumber},
+		"durationSeconds":   {dataType: fieldNumber},
+	}},
+	"stopadvertising": {adapterCommand: true, fields: map[string]schemaField{
+		"advertisementId": {dataType: fieldString},
+	}},
+	"listdevices": {adapterCommand: true, fields: map[string]schemaField{
+		"address":   {dataType: fieldString},
+		"name":      {dataType: fieldString},
+		"uuid":      {dataType: fieldUUID},
+		"paired":    {dataType: fieldBoolean},
+		"minRssi":   {dataType: fieldNumber},
+		"seenSince": {dataType: fieldString},
+		"offset":    {dataType: fieldInteger},
+		"limit":     {dataType: fieldInteger},
+	}},
+	"firmwareupdate": {fields: map[string]schemaField{
+		"packageUrl":        {dataType: fieldString},
+		"packageId":         {dataType: fieldString},
+		"bootloaderAddress": {dataType: fieldString},
+		"chunkSize":         {dataType: fieldInteger},
+	}},
+	"smp": {fields: map[string]schemaField{
+		"operation":  {dataType: fieldString, required: true},
+		"hash":       {dataType: fieldString},
+		"imageUrl":   {dataType: fieldString},
+		"packageId":  {dataType: fieldString},
+		"message":    {dataType: fieldString},
+		"statsGroup": {dataType: fieldString},
+		"fileName":   {dataType: fieldString},
+		"chunkSize":  {dataType: fieldInteger},
+		"reassembly": {dataType: fieldBoolean},
+	}},
+}
+
+//commandRequest - The fields common to BLE commands, decoded from a validated command
+type commandRequest struct {
+	Version                 int
+	Command                 string //The lower case command name
+	CommandID               interface{}
+	DeviceAddress           string //The upper case device address, as used by BlueZ
+	GattCharacteristic      string //The lower case 128 bit characteristic UUID
+	GattCharacteristicValue []byte
+	ProfileUUID             string //The lower case 128 bit profile UUID
+	StayConnected           bool
+	Timeout                 time.Duration //Overrides the D-Bus call timeouts when not 0
+
+	adapterCommand bool
+}
+
+//parseCommandRequest - Validate a command against its schema and decode the fields common to BLE commands
+func parseCommandRequest(command map[string]interface{}) (*commandRequest, error) {
+	name, ok := command["command"].(string)
+	if !ok || name == "" {
+		return nil, invalidCommandDetails("command not provided", []string{"command is required"})
+	}
+
+	schema, ok := commandSchemas[strings.ToLower(name)]
+	if !ok {
+		return nil, invalidCommandDetails("unknown command \""+name+"\"", []string{"command must be one of " + strings.Join(commandNames(), ", ")})
+	}
+
+	fields := map[string]schemaField{}
+	for field, definition := range commonSchemaFields {
+		fields[field] = definition
+	}
+	for field, definition := range schema.fields {
+		fields[field] = definition
+	}
+	if !schema.adapterCommand {
+		fields["deviceAddress"] = schemaField{dataType: fieldString, required: true}
+	}
+
+	details := validateCommandFields(command, fields)
+	if version, ok := command["version"].(float64); ok && version != commandVersion {
+		details = append(details, fmt.Sprintf("version %v is not supported, the supported version is %d", version, commandVersion))
+	}
+	if timeout, ok := command["timeoutMs"].(float64); ok && timeout <= 0 {
+		details = append(details, "timeoutMs must be greater than 0")
+	}
+	if len(details) > 0 {
+		return nil, invalidCommandDetails("invalid "+name+" command", details)
+	}
+
+	request := &commandRequest{
+		Version:        commandVersion,
+		Command:        strings.ToLower(name),
+		CommandID:      command["commandId"],
+		adapterCommand: schema.adapterCommand,
+	}
+	address, _ := command["deviceAddress"].(string)
+	request.DeviceAddress = strings.ToUpper(address)
+	gattChar, _ := command["gattCharacteristic"].(string)
+	request.GattCharacteristic = cbble.ConvertUUID(gattChar)
+	profile, _ := command["profileUUID"].(string)
+	request.ProfileUUID = cbble.ConvertUUID(profile)
+	request.StayConnected, _ = command["stayConnected"].(bool)
+	if timeout, ok := command["timeoutMs"].(float64); ok {
+		request.Timeout = time.Duration(timeout) * time.Millisecond
+	}
+	if value, ok := command["gattCharacteristicValue"].([]interface{}); ok && fields["gattCharacteristicValue"].dataType == fieldBytes {
+		request.GattCharacteristicValue = make([]byte, len(value))
+		for i, elem := range value {
+			request.GattCharacteristicValue[i] = byte(elem.(float64))
+		}
+	}
+	return request, nil
+}
+
+//validateCommandFields - Return a description of each field of a command that does not match its definition
+func validateCommandFields(command map[string]interface{}, fields map[string]schemaField) []string {
+	//Sort the names so that errors are reported in a consistent order
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	details := []string{}
+	for _, name := range names {
+		definition := fields[name]
+		value, ok := command[name]
+		if !ok || value == nil {
+			if definition.required {
+				details = append(details, name+" is required")
+			}
+			continue
+		}
+
+		if !isFieldType(value, definition.dataType) {
+			details = append(details, fmt.Sprintf("%s must be %s", name, fieldTypeDescription(definition.dataType)))
+		} else if theString, ok := value.(string); ok && theString == "" && definition.required {
+			details = append(details, name+" must not be empty")
+		}
+	}
+	return details
+}
+
+//isFieldType - Returns true if a value decoded from JSON is of the specified field type
+func isFieldType(value interface{}, dataType string) bool {
+	switch dataType {
+	case fieldString:
+		_, ok := value.(string)
+		return ok
+	case fieldUUID:
+		uuid, ok := value.(string)
+		if _, err := cbble.NormalizeUUID(uuid); !ok || err != nil {
+			return false
+		}
+		return true
+	case fieldBoolean:
+		_, ok := value.(bool)
+		return ok
+	case fieldNumber:
+		_, ok := value.(float64)
+		return ok
+	case fieldInteger:
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case fieldBytes:
+		array, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, elem := range array {
+			number, ok := elem.(float64)
+			if !ok || number < 0 || number > 255 || number != math.Trunc(number) {
+				return false
+			}
+		}
+		return true
+	case fieldObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case fieldArray:
+		_, ok := value.([]interface{})
+		return ok
+	}
+	return true
+}
+
+//fieldTypeDescription - Describe a field type in validation errors
+func fieldTypeDescription(dataType string) string {
+	switch dataType {
+	case fieldInteger:
+		return "an integer"
+	case fieldBytes:
+		return "an array of integers between 0 and 255"
+	case fieldUUID:
+		return "a 16, 32 or 128 bit UUID"
+	case fieldObject:
+		return "an object"
+	case fieldArray:
+		return "an array"
+	}
+	return "a " + dataType
+}
+
+//commandNames - The sorted names of the BLE commands
+func commandNames() []string {
+	names := []string{}
+	for name := range commandSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,295 @@
+package bleadapter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to the adapter configuration
+//
+//Adapter settings are resolved with the following precedence, lowest first:
+//
+//  1. The adapterConfig section of the local configuration file
+//  2. BLE_ADAPTER_<COLUMN NAME> environment variables, ex. BLE_ADAPTER_PUBLISH_TOPIC
+//  3. Command line flags (-scanInterval)
+//  4. The row of the BLE_Adapter_Config collection
+//
+//When the BLE_Adapter_Config collection does not exist or contains no rows, the adapter
+//runs from the local configuration alone.
+
+const (
+	configString  = "string"
+	configInteger = "integer"
+	configBoolean = "boolean"
+	configList    = "list"
+
+	//Local only setting providing the UUIDs normally read from BLE_Device_Filters
+	deviceFiltersSetting = "device_filters"
+
+	adapterConfigEnvPrefix = "BLE_ADAPTER_"
+)
+
+//adapterConfigColumns - The adapter settings and their data types
+var adapterConfigColumns = map[string]string{
+	"publish_topic":                 configString,
+	"discovery_scan_seconds":        configInteger,
+	"discovery_pause_seconds":       configInteger,
+	"handle_removed":                configBoolean,
+	"handle_changed":                configBoolean,
+	"discovery_rssi":                configInteger,
+	"discovery_pathloss":            configInteger,
+	"discovery_transport":           configString,
+	"discovery_duplicate_data":      configBoolean,
+	"discovery_discoverable":        configBoolean,
+	"discovery_pattern":             configString,
+	"gatt_server_enabled":           configBoolean,
+	"scan_mode":                     configString,
+	"monitor_rssi_low_threshold":    configInteger,
+	"monitor_rssi_high_threshold":   configInteger,
+	"monitor_rssi_low_timeout":      configInteger,
+	"monitor_rssi_high_timeout":     configInteger,
+	"monitor_rssi_sampling_period":  configInteger,
+	"publish_filter_mode":           configString,
+	"managed_reconnect_min_seconds": configInteger,
+	"managed_reconnect_max_seconds": configInteger,
+	"connect_retry_attempts":        configInteger,
+	"connect_retry_delay_ms":        configInteger,
+	"pair_retry_attempts":           configInteger,
+	"pair_retry_delay_ms":           configInteger,
+	"read_retry_attempts":           configInteger,
+	"read_retry_delay_ms":           configInteger,
+	"write_retry_attempts":          configInteger,
+	"write_retry_delay_ms":          configInteger,
+	"call_timeout_ms":               configInteger,
+	"connect_timeout_ms":            configInteger,
+	"pair_timeout_ms":               configInteger,
+	"read_timeout_ms":               configInteger,
+	"write_timeout_ms":              configInteger,
+	deviceFiltersSetting:            configList,
+}
+
+//Adapter settings from the local configuration file and environment variables
+var localAdapterConfig = map[string]interface{}{}
+
+//SetLocalConfig - Set the adapter settings used when the BLE_Adapter_Config collection does not specify them.
+//Settings specified in BLE_ADAPTER_<COLUMN NAME> environment variables override the values in settings.
+func SetLocalConfig(settings map[string]interface{}) error {
+	merged := map[string]interface{}{}
+	for name, value := range settings {
+		if _, ok := adapterConfigColumns[name]; !ok {
+			return errors.New("SetLocalConfig - Unknown adapter setting \"" + name + "\"")
+		}
+		merged[name] = value
+	}
+
+	for name, dataType := range adapterConfigColumns {
+		envValue, ok := os.LookupEnv(adapterConfigEnvPrefix + strings.ToUpper(name))
+		if !ok {
+			continue
+		}
+		value, err := parseConfigString(envValue, dataType)
+		if err != nil {
+			return fmt.Errorf("SetLocalConfig - Invalid value for environment variable %s: %s", adapterConfigEnvPrefix+strings.ToUpper(name), err.Error())
+		}
+		merged[name] = value
+	}
+
+	config, errs := validateAdapterConfig(merged)
+	if len(errs) > 0 {
+		messages := []string{}
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return errors.New("SetLocalConfig - Invalid adapter configuration: " + strings.Join(messages, "; "))
+	}
+
+	localAdapterConfig = config
+	log.Printf("[DEBUG] Local adapter configuration: %#v", localAdapterConfig)
+	return nil
+}
+
+//validateAdapterConfig - Validate the adapter settings, converting them to the types used by the platform
+//(string, float64, bool and []string). Invalid and unknown settings are omitted from the returned config.
+func validateAdapterConfig(settings map[string]interface{}) (map[string]interface{}, []error) {
+	config := map[string]interface{}{}
+	errs := []error{}
+
+	//Sort the names so that errors are reported in a consistent order
+	names := []string{}
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := settings[name]
+		if value == nil {
+			continue
+		}
+
+		dataType, ok := adapterConfigColumns[name]
+		if !ok {
+			//The platform row includes item_id and other columns that are not settings
+			continue
+		}
+
+		theValue, err := convertConfigValue(value, dataType)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err.Error()))
+			continue
+		}
+
+		if err := validateConfigSetting(name, theValue); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err.Error()))
+			continue
+		}
+		config[name] = theValue
+	}
+
+	return config, errs
+}
+
+//convertConfigValue - Convert a value decoded from JSON, YAML or an environment variable to the specified type
+func convertConfigValue(value interface{}, dataType string) (interface{}, error) {
+	if theString, ok := value.(string); ok && dataType != configString {
+		return parseConfigString(theString, dataType)
+	}
+
+	switch dataType {
+	case configString:
+		if theString, ok := value.(string); ok {
+			return theString, nil
+		}
+	case configBoolean:
+		if theBool, ok := value.(bool); ok {
+			return theBool, nil
+		}
+	case configInteger:
+		var number float64
+		switch theNumber := value.(type) {
+		case float64:
+			number = theNumber
+		case int:
+			number = float64(theNumber)
+		case int64:
+			number = float64(theNumber)
+		case uint64:
+			number = float64(theNumber)
+		default:
+			return nil, fmt.Errorf("expected an integer, received %#v", value)
+		}
+		if number != math.Trunc(number) {
+			return nil, fmt.Errorf("expected an integer, received %v", number)
+		}
+		return number, nil
+	case configList:
+		if theList, ok := value.([]interface{}); ok {
+			list := []string{}
+			for _, elem := range theList {
+				theString, ok := elem.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected a list of strings, received %#v", value)
+				}
+				list = append(list, theString)
+			}
+			return list, nil
+		}
+		if theList, ok := value.([]string); ok {
+			return theList, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expected a %s, received %#v", dataType, value)
+}
+
+//parseConfigString - Parse a setting specified as a string, ex. in an environment variable
+func parseConfigString(value string, dataType string) (interface{}, error) {
+	switch dataType {
+	case configBoolean:
+		theBool, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("expected a boolean, received \"%s\"", value)
+		}
+		return theBool, nil
+	case configInteger:
+		theInt, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected an integer, received \"%s\"", value)
+		}
+		return float64(theInt), nil
+	case configList:
+		//Lists are specified as comma separated values
+		list := []string{}
+		for _, elem := range strings.Split(value, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				list = append(list, elem)
+			}
+		}
+		return list, nil
+	}
+	return value, nil
+}
+
+//validateConfigSetting - Validate the value of settings that only accept specific values
+func validateConfigSetting(name string, value interface{}) error {
+	switch name {
+	case "discovery_scan_seconds", "discovery_pause_seconds", "monitor_rssi_low_timeout",
+		"monitor_rssi_high_timeout", "monitor_rssi_sampling_period", "discovery_pathloss",
+		"connect_retry_delay_ms", "pair_retry_delay_ms", "read_retry_delay_ms", "write_retry_delay_ms":
+		if value.(float64) < 0 {
+			return fmt.Errorf("expected a value greater than or equal to 0, received %v", value)
+		}
+	case "discovery_rssi", "monitor_rssi_low_threshold", "monitor_rssi_high_threshold":
+		if value.(float64) < -127 || value.(float64) > 20 {
+			return fmt.Errorf("expected a value between -127 and 20, received %v", value)
+		}
+	case "discovery_transport":
+		if !stringInList(strings.ToLower(value.(string)), "", cbble.TransportAuto, cbble.TransportLE, cbble.TransportBREDR) {
+			return fmt.Errorf("expected auto, le or bredr, received \"%s\"", value)
+		}
+	case "scan_mode":
+		if !stringInList(strings.ToLower(value.(string)), "", scanModeActive, scanModePassive) {
+			return fmt.Errorf("expected %s or %s, received \"%s\"", scanModeActive, scanModePassive, value)
+		}
+	case "publish_filter_mode":
+		if !stringInList(strings.ToLower(value.(string)), "", filterModeOr, filterModeAnd) {
+			return fmt.Errorf("expected %s or %s, received \"%s\"", filterModeOr, filterModeAnd, value)
+		}
+	case "connect_retry_attempts", "pair_retry_attempts", "read_retry_attempts", "write_retry_attempts",
+		"call_timeout_ms", "connect_timeout_ms", "pair_timeout_ms", "read_timeout_ms", "write_timeout_ms":
+		if value.(float64) < 1 {
+			return fmt.Errorf("expected a value greater than or equal to 1, received %v", value)
+		}
+	case "publish_topic":
+		if value.(string) == "" {
+			return errors.New("expected a non-empty topic")
+		}
+	}
+	return nil
+}
+
+//getConfigRow - Retrieve the first row of a configuration collection. A nil row is returned if the collection has no rows
+func (adapt *BleAdapter) getConfigRow(collectionName string) (map[string]interface{}, error) {
+	rows, err := adapt.transport.GetCollection(collectionName)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows[0], nil
+}
+
+func stringInList(value string, list ...string) bool {
+	for _, elem := range list {
+		if value == elem {
+			return true
+		}
+	}
+	return false
+}
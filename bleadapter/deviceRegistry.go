@@ -0,0 +1,420 @@
+package bleadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to the persistent device registry and the listDevices command
+//
+//The registry contains every device seen by the adapter, regardless of the publish filters. It is
+//kept in memory and, when a registry file is specified, saved to the file every
+//registrySaveInterval and when the adapter shuts down so that the state of devices is not lost
+//when the adapter restarts.
+//
+//The registry is a single JSON file rather than an embedded database. It holds one entry per
+//device, at most a few thousand even in busy environments, is rewritten atomically in one write
+//every registrySaveInterval, and is only read when the adapter starts. A JSON file needs no
+//additional dependency or migration and can be inspected and edited by hand on the gateway.
+//
+//If the file cannot be written, ex. on a read only root file system, the failure is logged once
+//and the registry continues to be kept in memory.
+
+const (
+	registrySaveInterval = 30 * time.Second
+
+	listDevicesDefaultLimit = 100
+	listDevicesMaxLimit     = 1000
+)
+
+//ListDevices - A struct used to encapsulate the "list devices" subcommand
+type ListDevices struct{}
+
+var listDevices = ListDevices{}
+
+//deviceRegistry - The devices seen by the adapter, keyed by address
+type deviceRegistry struct {
+	fileName string
+	maxAge   time.Duration //Devices not seen within maxAge are removed. 0 keeps devices forever
+
+	mutex      sync.Mutex
+	devices    map[string]*registryDevice
+	dirty      bool
+	saveFailed bool //Set while the registry cannot be saved, so that the failure is only logged once
+}
+
+//registryDevice - The last known state of a device
+type registryDevice struct {
+	Address          string                 `json:"address"`
+	Path             string                 `json:"path"`
+	FirstSeen        time.Time              `json:"firstSeen"`
+	LastSeen         time.Time              `json:"lastSeen"`
+	LastRSSI         *int16                 `json:"lastRssi,omitempty"`
+	Name             string                 `json:"name"`
+	NameHistory      []string               `json:"nameHistory"` //Every name and alias seen, oldest first
+	UUIDs            []string               `json:"uuids"`
+	ManufacturerData map[string]interface{} `json:"manufacturerData,omitempty"`
+	Paired           bool                   `json:"paired"`
+	Trusted          bool                   `json:"trusted"`
+	Connected        bool                   `json:"connected"`
+	GattCache        []registryService      `json:"gattCache,omitempty"` //Updated each time the device's services are resolved
+	GattCacheTime    *time.Time             `json:"gattCacheTime,omitempty"`
+}
+
+//registryService - A GATT service contained in the GATT cache of a device
+type registryService struct {
+	UUID            string                   `json:"uuid"`
+	Characteristics []registryCharacteristic `json:"characteristics"`
+}
+
+//registryCharacteristic - A GATT characteristic contained in the GATT cache of a device
+type registryCharacteristic struct {
+	UUID  string   `json:"uuid"`
+	Flags []string `json:"flags"`
+}
+
+//newDeviceRegistry - Create a registry, loading the devices saved to fileName. A registry that cannot be
+//loaded is logged and replaced, so that a corrupt file does not prevent the adapter from starting.
+//When fileName is empty, the registry is only kept in memory
+func newDeviceRegistry(fileName string, maxAge time.Duration) *deviceRegistry {
+	registry := &deviceRegistry{
+		fileName: fileName,
+		maxAge:   maxAge,
+		devices:  make(map[string]*registryDevice),
+	}
+	if fileName == "" {
+		log.Printf("[INFO] No device registry file specified, the device registry is kept in memory only")
+		return registry
+	}
+
+	contents, err := ioutil.ReadFile(fileName)
+	switch {
+	case os.IsNotExist(err):
+		log.Printf("[INFO] Creating device registry %s", fileName)
+	case err != nil:
+		log.Printf("[ERROR] Unable to read device registry %s: %s", fileName, err.Error())
+	default:
+		devices := []*registryDevice{}
+		if err := json.Unmarshal(contents, &devices); err != nil {
+			log.Printf("[ERROR] Invalid device registry %s, starting with an empty registry: %s", fileName, err.Error())
+			break
+		}
+		for _, device := range devices {
+			registry.devices[device.Address] = device
+		}
+		log.Printf("[INFO] Loaded %d devices from device registry %s", len(registry.devices), fileName)
+	}
+
+	return registry
+}
+
+//update - Record the current state of a device
+func (registry *deviceRegistry) update(conn *cbble.Connection, device cbble.Device) {
+	if registry == nil {
+		return
+	}
+
+	//Retrieve the GATT cache before locking the registry
+	var gattCache []registryService
+	if device.ServicesResolved() {
+		gattCache = getGattCache(conn, device)
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := registry.devices[device.Address()]
+	if !ok {
+		entry = &registryDevice{Address: device.Address(), FirstSeen: now}
+		registry.devices[device.Address()] = entry
+	}
+
+	entry.Path = string(device.Path())
+	entry.LastSeen = now
+	if rssi := device.RSSI(); rssi != -1 {
+		entry.LastRSSI = &rssi
+	}
+	entry.Name = device.Name()
+	for _, name := range []string{device.Name(), device.Alias()} {
+		if name != "" && !stringInList(name, entry.NameHistory...) {
+			entry.NameHistory = append(entry.NameHistory, name)
+		}
+	}
+	entry.UUIDs = device.UUIDs()
+	if manufacturerData := device.ManufacturerData(); len(manufacturerData) > 0 {
+		entry.ManufacturerData = manufacturerData
+	}
+	entry.Paired = device.Paired()
+	entry.Trusted = device.Trusted()
+	entry.Connected = device.Connected()
+	if len(gattCache) > 0 {
+		entry.GattCache = gattCache
+		entry.GattCacheTime = &now
+	}
+
+	registry.dirty = true
+}
+
+//getGattCache - Retrieve the GATT services and characteristics of a device from the object cache
+func getGattCache(conn *cbble.Connection, device cbble.Device) []registryService {
+	services, err := conn.GetDeviceServices(device)
+	if err != nil {
+		return nil
+	}
+	chars, _ := conn.GetDeviceCharacteristics(device)
+
+	gattCache := []registryService{}
+	for _, service := range services {
+		cachedService := registryService{UUID: service.UUID(), Characteristics: []registryCharacteristic{}}
+		for _, char := range chars {
+			if char.Service() == service.Path() {
+				cachedService.Characteristics = append(cachedService.Characteristics, registryCharacteristic{UUID: char.UUID(), Flags: char.Flags()})
+			}
+		}
+		gattCache = append(gattCache, cachedService)
+	}
+	return gattCache
+}
+
+//save - Write the registry to its file, if it has changed. The file is replaced atomically
+//so that the registry is not corrupted if the adapter stops while saving
+func (registry *deviceRegistry) save() error {
+	if registry == nil {
+		return nil
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.prune()
+	if !registry.dirty || registry.fileName == "" {
+		return nil
+	}
+
+	devices := make([]*registryDevice, 0, len(registry.devices))
+	for _, device := range registry.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+
+	contents, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(registry.fileName), 0755); err != nil {
+		return err
+	}
+	tmpFile := registry.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, contents, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, registry.fileName); err != nil {
+		return err
+	}
+
+	registry.dirty = false
+	return nil
+}
+
+//prune - Remove devices that have not been seen within maxAge. The registry must be locked
+func (registry *deviceRegistry) prune() {
+	if registry.maxAge <= 0 {
+		return
+	}
+
+	for address, device := range registry.devices {
+		if time.Since(device.LastSeen) > registry.maxAge {
+			delete(registry.devices, address)
+			registry.dirty = true
+		}
+	}
+}
+
+//saveAndLog - Save the registry, logging the first of consecutive failures as a warning and the
+//rest at debug level, so that an unwritable registry file does not flood the log
+func (registry *deviceRegistry) saveAndLog() {
+	if registry == nil {
+		return
+	}
+
+	err := registry.save()
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	switch {
+	case err != nil && !registry.saveFailed:
+		log.Printf("[WARN] Unable to save device registry %s, the registry is kept in memory only: %s", registry.fileName, err.Error())
+		registry.saveFailed = true
+	case err != nil:
+		log.Printf("[DEBUG] Unable to save device registry %s: %s", registry.fileName, err.Error())
+	case registry.saveFailed:
+		log.Printf("[INFO] Device registry %s saved", registry.fileName)
+		registry.saveFailed = false
+	}
+}
+
+//saveRegistry - Save the device registry every registrySaveInterval until the adapter shuts down
+func (adapt *BleAdapter) saveRegistry() {
+	ticker := time.NewTicker(registrySaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			adapt.registry.saveAndLog()
+		case <-adapt.ctx.Done():
+			return
+		}
+	}
+}
+
+//list - Return the devices matching filter, most recently seen first, along with the total number of matching devices
+func (registry *deviceRegistry) list(filter func(*registryDevice) bool, offset int, limit int) ([]registryDevice, int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	matches := []registryDevice{}
+	for _, device := range registry.devices {
+		if filter(device) {
+			matches = append(matches, *device)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].LastSeen.Equal(matches[j].LastSeen) {
+			return matches[i].Address < matches[j].Address
+		}
+		return matches[i].LastSeen.After(matches[j].LastSeen)
+	})
+
+	total := len(matches)
+	if offset >= total {
+		return []registryDevice{}, total
+	}
+	if offset+limit > total {
+		limit = total - offset
+	}
+	return matches[offset : offset+limit], total
+}
+
+//Name - Return the name of the subcommand
+func (cmd ListDevices) Name() string {
+	return "ListDevices"
+}
+
+//Process - Execute the subcommand
+//
+//Optional filters:
+//
+//  address - Devices whose address starts with the value
+//  name - Devices whose current or previous names contain the value
+//  uuid - Devices advertising the service uuid
+//  paired - Devices whose pairing state matches the value
+//  minRssi - Devices whose last RSSI is greater than or equal to the value
+//  seenSince - Devices seen at or after the time, in RFC 3339 format
+//
+//Paging is controlled with offset and limit
+func (cmd ListDevices) Process(blecmd *BLECommand) error {
+	registry := blecmd.adapter.registry
+	if registry == nil {
+		log.Printf("[ERROR] Unable to list devices. The device registry is not enabled.")
+		return newCommandError(cmd.Name(), errorCodeNotSupported, "Unable to list devices. The device registry is not enabled.", nil)
+	}
+
+	filter, err := createListDevicesFilter(blecmd.command)
+	if err != nil {
+		log.Printf("[ERROR] Unable to list devices: %s", err.Error())
+		return newCommandError(cmd.Name(), errorCodeInvalidCommand, "Unable to list devices. "+err.Error(), err)
+	}
+
+	offset, _ := blecmd.command["offset"].(float64)
+	limit, ok := blecmd.command["limit"].(float64)
+	if !ok {
+		limit = listDevicesDefaultLimit
+	}
+	if offset < 0 || limit <= 0 || limit > listDevicesMaxLimit {
+		log.Printf("[ERROR] Unable to list devices. Invalid offset or limit.")
+		return newCommandError(cmd.Name(), errorCodeInvalidCommand, "Unable to list devices. offset must be 0 or greater and limit must be between 1 and 1000.", nil)
+	}
+
+	devices, total := registry.list(filter, int(offset), int(limit))
+	blecmd.command["devices"] = devices
+	blecmd.command["totalDevices"] = total
+	blecmd.command["offset"] = int(offset)
+	blecmd.command["limit"] = int(limit)
+
+	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	return nil
+}
+
+//createListDevicesFilter - Create the function used to select devices from the filters specified in a listDevices command
+func createListDevicesFilter(command map[string]interface{}) (func(*registryDevice) bool, error) {
+	address, _ := command["address"].(string)
+	name, _ := command["name"].(string)
+	uuid, _ := command["uuid"].(string)
+	paired, pairedOk := command["paired"].(bool)
+	minRssi, minRssiOk := command["minRssi"].(float64)
+
+	var seenSince time.Time
+	if since, ok := command["seenSince"].(string); ok && since != "" {
+		var err error
+		if seenSince, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, errors.New("seenSince must be in RFC 3339 format, ex. 2020-06-01T00:00:00Z")
+		}
+	}
+
+	address = strings.ToUpper(address)
+	name = strings.ToLower(name)
+	uuid = cbble.ConvertUUID(uuid)
+
+	return func(device *registryDevice) bool {
+		if address != "" && !strings.HasPrefix(device.Address, address) {
+			return false
+		}
+		if name != "" {
+			found := false
+			for _, theName := range device.NameHistory {
+				if strings.Contains(strings.ToLower(theName), name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		if uuid != "" {
+			found := false
+			for _, theUUID := range device.UUIDs {
+				if cbble.EqualUUIDs(theUUID, uuid) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		if pairedOk && device.Paired != paired {
+			return false
+		}
+		if minRssiOk && (device.LastRSSI == nil || float64(*device.LastRSSI) < minRssi) {
+			return false
+		}
+		if !seenSince.IsZero() && device.LastSeen.Before(seenSince) {
+			return false
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,282 @@
+package bleadapter
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+//Helper methods related to firmware packages
+//
+//Firmware packages are Nordic DFU zip packages, as created by nrfutil pkg generate. A package is
+//either downloaded from the packageUrl specified in a firmwareUpdate command or uploaded beforehand,
+//in chunks, to the bleadapter/firmware/chunk topic:
+//
+// {
+//		"packageId": "sensor-1.2.0",
+//		"index": 0,
+//		"totalChunks": 12,
+//		"data": base64 encoded chunk
+// }
+//
+//Uploaded packages are kept in memory until they are used by a firmwareUpdate command or
+//firmwarePackageExpiry elapses without a chunk being received. When more than
+//firmwareMaxPendingUploads packages are pending, or they exceed firmwareMaxPendingSize bytes in
+//total, the package that least recently received a chunk is discarded.
+
+const (
+	firmwareChunkTopic    = "bleadapter/firmware/chunk"
+	firmwarePackageExpiry = time.Hour
+
+	//The largest package that is downloaded or uploaded
+	firmwarePackageMaxSize = 16 * 1024 * 1024
+
+	//The most chunks a package can be uploaded in. The slice of chunks is allocated when the
+	//first chunk is received, so the number must be bounded before the chunks are
+	firmwarePackageMaxChunks = 64 * 1024
+
+	//The most packages, and bytes, kept in memory while they are uploaded
+	firmwareMaxPendingUploads = 4
+	firmwareMaxPendingSize    = 32 * 1024 * 1024
+)
+
+var (
+	firmwareUploads      = make(map[string]*firmwareUpload)
+	firmwareUploadsMutex sync.Mutex
+)
+
+//firmwareUpload - A package being uploaded in chunks
+type firmwareUpload struct {
+	chunks   [][]byte
+	received int
+	size     int
+	updated  time.Time
+}
+
+//firmwareImage - An image contained in a firmware package. Each image is transferred separately
+type firmwareImage struct {
+	name       string //application, bootloader, softdevice or softdevice_bootloader
+	initPacket []byte
+	firmware   []byte
+}
+
+//firmwareManifest - The manifest.json of a firmware package
+type firmwareManifest struct {
+	Manifest map[string]struct {
+		BinFile string `json:"bin_file"`
+		DatFile string `json:"dat_file"`
+	} `json:"manifest"`
+}
+
+//Images are transferred in the order used by nrfutil. The SoftDevice and bootloader must be
+//updated before an application that depends on them
+var firmwareImageOrder = []string{"softdevice_bootloader", "softdevice", "bootloader", "application"}
+
+//handleFirmwareChunk - Store a chunk of a firmware package published to the platform
+func handleFirmwareChunk(message *Message) {
+	var chunk struct {
+		PackageID   string `json:"packageId"`
+		Index       int    `json:"index"`
+		TotalChunks int    `json:"totalChunks"`
+		Data        string `json:"data"`
+	}
+
+	if err := json.Unmarshal(message.Payload, &chunk); err != nil {
+		log.Printf("[ERROR] Invalid JSON received for firmware chunk: %s", err.Error())
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil || chunk.PackageID == "" || chunk.TotalChunks <= 0 || chunk.Index < 0 || chunk.Index >= chunk.TotalChunks {
+		log.Printf("[ERROR] Invalid firmware chunk %d of package %s", chunk.Index, chunk.PackageID)
+		return
+	}
+	if chunk.TotalChunks > firmwarePackageMaxChunks {
+		log.Printf("[ERROR] Firmware package %s exceeds %d chunks, discarding chunk", chunk.PackageID, firmwarePackageMaxChunks)
+		return
+	}
+
+	firmwareUploadsMutex.Lock()
+	defer firmwareUploadsMutex.Unlock()
+
+	//Discard packages that were never used
+	for packageID, upload := range firmwareUploads {
+		if time.Since(upload.updated) > firmwarePackageExpiry {
+			log.Printf("[WARN] Discarding expired firmware package %s", packageID)
+			delete(firmwareUploads, packageID)
+		}
+	}
+
+	upload, ok := firmwareUploads[chunk.PackageID]
+	if !ok || len(upload.chunks) != chunk.TotalChunks {
+		upload = &firmwareUpload{chunks: make([][]byte, chunk.TotalChunks)}
+		firmwareUploads[chunk.PackageID] = upload
+	}
+
+	if upload.chunks[chunk.Index] == nil {
+		upload.received++
+		upload.size += len(data)
+	}
+	upload.chunks[chunk.Index] = data
+	upload.updated = time.Now()
+
+	if upload.size > firmwarePackageMaxSize {
+		log.Printf("[ERROR] Firmware package %s exceeds %d bytes, discarding", chunk.PackageID, firmwarePackageMaxSize)
+		delete(firmwareUploads, chunk.PackageID)
+		return
+	}
+	discardPendingUploads(chunk.PackageID)
+
+	log.Printf("[DEBUG] Received chunk %d of %d of firmware package %s", chunk.Index+1, chunk.TotalChunks, chunk.PackageID)
+}
+
+//discardPendingUploads - Discard the packages that least recently received a chunk, other than
+//current, until the pending uploads are within firmwareMaxPendingUploads and firmwareMaxPendingSize.
+//firmwareUploadsMutex must be held
+func discardPendingUploads(current string) {
+	for {
+		total := 0
+		oldestID := ""
+		for packageID, upload := range firmwareUploads {
+			total += upload.size
+			if packageID != current && (oldestID == "" || upload.updated.Before(firmwareUploads[oldestID].updated)) {
+				oldestID = packageID
+			}
+		}
+
+		if oldestID == "" || (len(firmwareUploads) <= firmwareMaxPendingUploads && total <= firmwareMaxPendingSize) {
+			return
+		}
+		log.Printf("[WARN] Too many firmware packages are being uploaded, discarding firmware package %s", oldestID)
+		delete(firmwareUploads, oldestID)
+	}
+}
+
+//getUploadedPackage - Retrieve and remove a completely uploaded firmware package
+func getUploadedPackage(packageID string) ([]byte, error) {
+	firmwareUploadsMutex.Lock()
+	defer firmwareUploadsMutex.Unlock()
+
+	upload, ok := firmwareUploads[packageID]
+	if !ok {
+		return nil, errors.New("firmware package " + packageID + " has not been uploaded")
+	}
+	if upload.received != len(upload.chunks) {
+		return nil, fmt.Errorf("firmware package %s is incomplete, %d of %d chunks received", packageID, upload.received, len(upload.chunks))
+	}
+
+	delete(firmwareUploads, packageID)
+	return bytes.Join(upload.chunks, nil), nil
+}
+
+//downloadPackage - Download a firmware package
+func downloadPackage(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to download firmware package: " + response.Status)
+	}
+
+	contents, err := ioutil.ReadAll(io.LimitReader(response.Body, firmwarePackageMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > firmwarePackageMaxSize {
+		return nil, fmt.Errorf("firmware package exceeds %d bytes", firmwarePackageMaxSize)
+	}
+	return contents, nil
+}
+
+//parsePackage - Extract the images contained in a firmware package
+func parsePackage(contents []byte) ([]firmwareImage, error) {
+	archive, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		return nil, errors.New("invalid firmware package: " + err.Error())
+	}
+
+	files := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[path.Clean(file.Name)] = file
+	}
+
+	manifestFile, ok := files["manifest.json"]
+	if !ok {
+		return nil, errors.New("invalid firmware package: manifest.json not found")
+	}
+	manifestJSON, err := readZipFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest firmwareManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, errors.New("invalid firmware package manifest: " + err.Error())
+	}
+
+	images := []firmwareImage{}
+	for _, name := range firmwareImageOrder {
+		entry, ok := manifest.Manifest[name]
+		if !ok {
+			continue
+		}
+
+		image := firmwareImage{name: name}
+		for fileName, contents := range map[string]*[]byte{entry.DatFile: &image.initPacket, entry.BinFile: &image.firmware} {
+			file, ok := files[path.Clean(fileName)]
+			if !ok {
+				return nil, errors.New("invalid firmware package: " + fileName + " not found")
+			}
+			if *contents, err = readZipFile(file); err != nil {
+				return nil, err
+			}
+		}
+		if len(image.initPacket) == 0 || len(image.firmware) == 0 {
+			return nil, errors.New("invalid firmware package: the " + name + " image is empty")
+		}
+		images = append(images, image)
+	}
+
+	if len(images) == 0 {
+		return nil, errors.New("invalid firmware package: the manifest contains no images")
+	}
+	return images, nil
+}
+
+//readZipFile - Read a file contained in a zip archive
+func readZipFile(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	//The uncompressed size in the zip header cannot be trusted, so limit what is read
+	contents, err := ioutil.ReadAll(io.LimitReader(reader, firmwarePackageMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > firmwarePackageMaxSize {
+		return nil, fmt.Errorf("%s exceeds %d bytes", file.Name, firmwarePackageMaxSize)
+	}
+	return contents, nil
+}
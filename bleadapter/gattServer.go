@@ -0,0 +1,227 @@
+package bleadapter
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+	"github.com/godbus/dbus"
+)
+
+//Helper methods related to the peripheral role
+//
+//When gatt_server_enabled is true, the services and characteristics defined in the
+//BLE_Gatt_Server collection are registered with GattManager1 so that phones can
+//connect to the gateway. Values read by phones are set over MQTT, while values written
+//by phones and notification subscriptions are published to MQTT.
+
+const (
+	gattServerCollectionName = "BLE_Gatt_Server"
+	gattServerAppPath        = dbus.ObjectPath("/com/clearblade/bleadapter/gatt")
+	gattServerValueTopic     = "bleadapter/gattserver/value"
+	gattServerWriteTopic     = "bleadapter/gattserver/write"
+	gattServerNotifyTopic    = "bleadapter/gattserver/notify"
+)
+
+var (
+	gattServerEnabled = false //Should the local GATT server be registered
+
+	//Guards adapt.gattServer and adapt.gattServices, which are updated by the discovery loop and
+	//used by the goroutine handling GATT server values
+	gattServerMutex sync.Mutex
+)
+
+//updateGattServer - Register, re-register or unregister the local GATT server based on the current configuration
+func (adapt *BleAdapter) updateGattServer() {
+	gattServerMutex.Lock()
+	defer gattServerMutex.Unlock()
+
+	if !gattServerEnabled {
+		adapt.unregisterGattServer()
+		return
+	}
+
+	services, err := adapt.getGattServerServices()
+	if err != nil {
+		log.Printf("[ERROR] Error encountered while retrieving GATT server services: %s", err.Error())
+		return
+	}
+
+	if adapt.gattServer != nil {
+		if reflect.DeepEqual(adapt.gattServices, services) {
+			return
+		}
+		adapt.unregisterGattServer()
+	}
+
+	if len(services) == 0 {
+		log.Printf("[WARN] GATT server enabled but no characteristics are defined in %s", gattServerCollectionName)
+		return
+	}
+
+	if adapt.gattServer, err = adapt.connection.RegisterGattServer(gattServerAppPath, services, adapt.handleGattServerWrite, adapt.handleGattServerNotify); err != nil {
+		log.Printf("[ERROR] Unable to register GATT server: %s", err.Error())
+		return
+	}
+	adapt.gattServices = services
+	log.Printf("[DEBUG] GATT server registered with %d services", len(services))
+}
+
+//stopGattServer - Unregister the local GATT server, if one is registered
+func (adapt *BleAdapter) stopGattServer() {
+	gattServerMutex.Lock()
+	defer gattServerMutex.Unlock()
+	adapt.unregisterGattServer()
+}
+
+//unregisterGattServer - Unregister the local GATT server, if one is registered. gattServerMutex must be locked
+func (adapt *BleAdapter) unregisterGattServer() {
+	if adapt.gattServer == nil {
+		return
+	}
+
+	if err := adapt.gattServer.Unregister(); err != nil {
+		log.Printf("[ERROR] Error unregistering GATT server: %s", err.Error())
+	}
+	adapt.gattServer = nil
+	adapt.gattServices = nil
+}
+
+//handleGattServerValue - Set the value of a local characteristic from a message published to the platform
+//
+// The structure of the message payload will need to resemble the following:
+//
+// {
+//		"gattService": (uuid)
+//		"gattCharacteristic": (uuid)
+//		"gattCharacteristicValue": [12, 23, 43, 45]
+// }
+func (adapt *BleAdapter) handleGattServerValue(message *Message) {
+	var value struct {
+		Service        string `json:"gattService"`
+		Characteristic string `json:"gattCharacteristic"`
+		Value          []int  `json:"gattCharacteristicValue"`
+	}
+
+	if err := json.Unmarshal(message.Payload, &value); err != nil {
+		log.Printf("[ERROR] Invalid JSON received for GATT server value: %s", err.Error())
+		return
+	}
+
+	//The array of bytes passed in json needs to be converted to a byte array
+	valueBytes := make([]byte, len(value.Value))
+	for i, elem := range value.Value {
+		if elem < 0 || elem > 255 {
+			log.Printf("[ERROR] Invalid GATT server value for characteristic %s: %d is not between 0 and 255", value.Characteristic, elem)
+			return
+		}
+		valueBytes[i] = byte(elem)
+	}
+
+	gattServerMutex.Lock()
+	defer gattServerMutex.Unlock()
+
+	if adapt.gattServer == nil {
+		log.Printf("[WARN] GATT server value received but the GATT server is not registered")
+		return
+	}
+
+	if err := adapt.gattServer.SetValue(value.Service, value.Characteristic, valueBytes); err != nil {
+		log.Printf("[ERROR] Unable to set GATT server value: %s", err.Error())
+	}
+}
+
+//handleGattServerWrite - Publish values written to local characteristics by remote devices
+func (adapt *BleAdapter) handleGattServerWrite(service string, characteristic string, value []byte, device dbus.ObjectPath) {
+	adapt.publishGattServerEvent(gattServerWriteTopic, map[string]interface{}{
+		"gattService":             service,
+		"gattCharacteristic":      characteristic,
+		"gattCharacteristicValue": cbble.JSONableSlice(value),
+		"devicePath":              device,
+		"deviceAddress":           cbble.ParseAddressFromPath(string(device)),
+	})
+}
+
+//handleGattServerNotify - Publish notification subscription changes made by remote devices
+func (adapt *BleAdapter) handleGattServerNotify(service string, characteristic string, notifying bool) {
+	adapt.publishGattServerEvent(gattServerNotifyTopic, map[string]interface{}{
+		"gattService":        service,
+		"gattCharacteristic": characteristic,
+		"notifying":          notifying,
+	})
+}
+
+func (adapt *BleAdapter) publishGattServerEvent(topic string, event map[string]interface{}) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] error marshaling GATT server event into json: %s", err.Error())
+		return
+	}
+
+	if puberr := adapt.transport.Publish(topic, eventJSON, messagingQos); puberr != nil {
+		log.Printf("[ERROR] Error occurred when publishing GATT server event to MQTT: %v", puberr)
+	}
+}
+
+//getGattServerServices - Retrieve the local GATT services and characteristics from the platform
+func (adapt *BleAdapter) getGattServerServices() ([]cbble.LocalService, error) {
+	rows, err := adapt.transport.GetCollection(gattServerCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []cbble.LocalService{}
+	serviceIndex := map[string]int{}
+
+	for _, theRow := range rows {
+		if enabled, _ := theRow["enabled"].(bool); !enabled {
+			continue
+		}
+
+		serviceUUID, _ := theRow["service_uuid"].(string)
+		charUUID, _ := theRow["characteristic_uuid"].(string)
+		flags, _ := theRow["flags"].(string)
+		value, _ := theRow["value"].(string)
+
+		normalizedService, serviceErr := cbble.NormalizeUUID(serviceUUID)
+		normalizedChar, charErr := cbble.NormalizeUUID(charUUID)
+		if serviceErr != nil || charErr != nil {
+			log.Printf("[WARN] Skipping GATT server characteristic with invalid uuid: service %s, characteristic %s", serviceUUID, charUUID)
+			continue
+		}
+		serviceUUID, charUUID = normalizedService, normalizedChar
+
+		//Initial values are specified as a hex string, ex. 0c172b2d
+		valueBytes, err := hex.DecodeString(value)
+		if err != nil {
+			log.Printf("[WARN] Skipping GATT server characteristic %s with invalid value \"%s\"", charUUID, value)
+			continue
+		}
+
+		char := cbble.LocalCharacteristic{
+			UUID:  charUUID,
+			Flags: []string{},
+			Value: valueBytes,
+		}
+		for _, flag := range strings.Split(flags, ",") {
+			if flag = strings.TrimSpace(strings.ToLower(flag)); flag != "" {
+				char.Flags = append(char.Flags, flag)
+			}
+		}
+
+		ndx, ok := serviceIndex[serviceUUID]
+		if !ok {
+			ndx = len(services)
+			serviceIndex[serviceUUID] = ndx
+			services = append(services, cbble.LocalService{UUID: serviceUUID, Primary: true})
+		}
+		services[ndx].Characteristics = append(services[ndx].Characteristics, char)
+	}
+
+	log.Printf("[DEBUG] Returning GATT server services: %#v", services)
+	return services, nil
+}
@@ -0,0 +1,286 @@
+package bleadapter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+	"github.com/godbus/dbus"
+)
+
+//Helper methods related to managed devices
+//
+//Managed devices are devices that must stay connected permanently. They are configured in the
+//BLE_Managed_Devices collection, connected when the adapter starts and monitored through the
+//PropertiesChanged signal. When a managed device disconnects, it is reconnected with an exponential
+//backoff between managed_reconnect_min_seconds and managed_reconnect_max_seconds. After each
+//connection, notifications are enabled for the device's notify_characteristics and the values
+//received are published to the bleadapter/bledevice/notification topic.
+
+const (
+	managedDevicesCollectionName = "BLE_Managed_Devices"
+	notificationPublishTopic     = "bleadapter/bledevice/notification"
+)
+
+var (
+	managedReconnectMin int64 = 1   //seconds
+	managedReconnectMax int64 = 300 //seconds
+
+	managedDevices      = make(map[string]*managedDevice)
+	managedDevicesMutex sync.Mutex
+)
+
+//managedDevice - A device the adapter keeps connected
+type managedDevice struct {
+	address               string
+	notifyCharacteristics []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan bool //Closed when the goroutine managing the device returns
+}
+
+//isManagedDevice - Return true if the device with the specified address is a managed device
+func isManagedDevice(address string) bool {
+	managedDevicesMutex.Lock()
+	defer managedDevicesMutex.Unlock()
+
+	_, ok := managedDevices[strings.ToUpper(address)]
+	return ok
+}
+
+//getManagedDevices - Retrieve the enabled managed devices from the BLE_Managed_Devices collection, keyed by address
+func (adapt *BleAdapter) getManagedDevices() (map[string]*managedDevice, error) {
+	rows, err := adapt.transport.GetCollection(managedDevicesCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]*managedDevice)
+	for _, theRow := range rows {
+		if enabled, _ := theRow["enabled"].(bool); !enabled {
+			continue
+		}
+
+		address, ok := theRow["device_address"].(string)
+		if !ok || address == "" {
+			log.Printf("[WARN] Skipping managed device with invalid device_address: %#v", theRow["device_address"])
+			continue
+		}
+
+		device := &managedDevice{address: strings.ToUpper(address), notifyCharacteristics: []string{}}
+		if chars, ok := theRow["notify_characteristics"].(string); ok {
+			for _, uuid := range strings.Split(chars, ",") {
+				if uuid = strings.TrimSpace(uuid); uuid == "" {
+					continue
+				}
+				if normalized, err := cbble.NormalizeUUID(uuid); err == nil {
+					device.notifyCharacteristics = append(device.notifyCharacteristics, normalized)
+				} else {
+					log.Printf("[WARN] Skipping invalid notify characteristic %s of managed device %s", uuid, device.address)
+				}
+			}
+		}
+		devices[device.address] = device
+	}
+
+	return devices, nil
+}
+
+//updateManagedDevices - Start managing the devices added to the BLE_Managed_Devices collection and
+//release the devices removed from it. If the collection cannot be retrieved, the current managed
+//devices are left unchanged
+func (adapt *BleAdapter) updateManagedDevices() {
+	devices, err := adapt.getManagedDevices()
+	if err != nil {
+		log.Printf("[DEBUG] Managed devices could not be retrieved: %s", err.Error())
+		return
+	}
+
+	managedDevicesMutex.Lock()
+	defer managedDevicesMutex.Unlock()
+
+	for address, current := range managedDevices {
+		if device, ok := devices[address]; ok && sameStrings(device.notifyCharacteristics, current.notifyCharacteristics) {
+			continue
+		}
+		current.cancel()
+		delete(managedDevices, address)
+
+		//Devices whose notify characteristics changed are reconnected with the new configuration
+		if _, ok := devices[address]; !ok {
+			log.Printf("[INFO] Releasing managed device %s", address)
+			go adapt.releaseManagedDevice(current)
+		}
+	}
+
+	for address, device := range devices {
+		if _, ok := managedDevices[address]; ok {
+			continue
+		}
+		log.Printf("[INFO] Managing device %s. Notify characteristics = %v", address, device.notifyCharacteristics)
+		device.ctx, device.cancel = context.WithCancel(adapt.ctx)
+		device.done = make(chan bool)
+		go adapt.manageDevice(device)
+		managedDevices[address] = device
+	}
+}
+
+//manageDevice - Keep a managed device connected until its context is cancelled
+func (adapt *BleAdapter) manageDevice(device *managedDevice) {
+	defer close(device.done)
+
+	backoff := managedReconnectMin
+	for device.ctx.Err() == nil {
+		//Cancelled after each connection, so that the device is no longer watched
+		attemptCtx, cancelAttempt := context.WithCancel(device.ctx)
+		disconnected := make(chan bool, 1)
+
+		if err := adapt.connectManagedDevice(attemptCtx, device, disconnected); err != nil {
+			cancelAttempt()
+			log.Printf("[WARN] Unable to connect managed device %s: %s. Retrying in %d seconds", device.address, err.Error(), backoff)
+			if !sleepWithContext(device.ctx, backoff) {
+				break
+			}
+			if backoff *= 2; backoff > managedReconnectMax {
+				backoff = managedReconnectMax
+			}
+			continue
+		}
+
+		log.Printf("[INFO] Managed device %s connected", device.address)
+		backoff = managedReconnectMin
+
+		select {
+		case <-disconnected:
+			log.Printf("[WARN] Managed device %s disconnected", device.address)
+			setDeviceConnected(device.address, false)
+		case <-device.ctx.Done():
+		}
+		cancelAttempt()
+	}
+
+	log.Printf("[DEBUG] Stopped managing device %s", device.address)
+}
+
+//connectManagedDevice - Connect a managed device, wait for its services to be resolved and enable
+//its notifications. A value is sent on disconnected when the device disconnects
+func (adapt *BleAdapter) connectManagedDevice(ctx context.Context, device *managedDevice, disconnected chan<- bool) error {
+	if err := adapt.connection.Update(); err != nil {
+		return err
+	}
+
+	//The device must have been discovered before it can be connected
+	dev, err := adapt.connection.GetDeviceByAddress(device.address)
+	if err != nil {
+		return err
+	}
+
+	//Watch the device before connecting so that a disconnect is never missed
+	err = adapt.connection.WatchDevice(ctx, dev, func(changed map[string]dbus.Variant) {
+		if connected, ok := changed[cbble.BluezConnected].Value().(bool); ok && !connected {
+			select {
+			case disconnected <- true:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if !dev.Connected() {
+		if err := dev.ConnectContext(ctx); err != nil {
+			return err
+		}
+	}
+	setDeviceConnected(device.address, true)
+
+	if dev, err = adapt.connection.WaitForServicesResolved(ctx, device.address, servicesResolvedTimeout); err != nil {
+		return err
+	}
+
+	for _, uuid := range device.notifyCharacteristics {
+		char, err := adapt.connection.GetDeviceCharacteristic(dev, uuid)
+		if err != nil {
+			log.Printf("[ERROR] Unable to enable notifications for managed device %s, characteristic %s: %s", device.address, uuid, err.Error())
+			continue
+		}
+		if err := char.HandleNotify(adapt.notificationHandler(device, uuid)); err != nil {
+			log.Printf("[ERROR] Unable to enable notifications for managed device %s, characteristic %s: %s", device.address, uuid, err.Error())
+		}
+	}
+
+	//The device may have disconnected before it was watched
+	if err := adapt.connection.Update(); err == nil {
+		if dev, err := adapt.connection.GetDeviceByAddress(device.address); err == nil && !dev.Connected() {
+			return errors.New("device disconnected while connecting")
+		}
+	}
+
+	return nil
+}
+
+//notificationHandler - Create the handler that publishes the notifications received from a managed device
+func (adapt *BleAdapter) notificationHandler(device *managedDevice, uuid string) cbble.NotifyHandler {
+	return func(data []byte) {
+		//Handlers remain registered after a device is released
+		if device.ctx.Err() != nil {
+			return
+		}
+
+		adapt.evaluateRules(ruleSourceNotification, device.address, uuid, data)
+
+		notification := map[string]interface{}{
+			"deviceAddress":           device.address,
+			"gattCharacteristic":      uuid,
+			"gattCharacteristicValue": cbble.JSONableSlice(data),
+			"timestamp":               time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		notificationJSON, err := json.Marshal(notification)
+		if err != nil {
+			log.Printf("[ERROR] error marshaling notification into json: %s", err.Error())
+			return
+		}
+
+		log.Printf("[DEBUG] Publishing notification: %s", notificationJSON)
+		if err := adapt.transport.Publish(notificationPublishTopic, notificationJSON, messagingQos); err != nil {
+			log.Printf("[ERROR] Error occurred when publishing notification to MQTT: %v", err)
+		}
+	}
+}
+
+//releaseManagedDevice - Disconnect a device that is no longer managed
+func (adapt *BleAdapter) releaseManagedDevice(device *managedDevice) {
+	<-device.done
+
+	//Devices are disconnected by shutdown when the adapter stops
+	if adapt.ctx.Err() != nil {
+		return
+	}
+
+	if dev, err := adapt.connection.GetDeviceByAddress(device.address); err == nil && dev.Connected() {
+		if err := dev.Disconnect(); err != nil {
+			log.Printf("[ERROR] Error while disconnecting from BLE device %s: %s", device.address, err.Error())
+		}
+	}
+	setDeviceConnected(device.address, false)
+}
+
+//sameStrings - Return true if a and b contain the same strings in the same order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
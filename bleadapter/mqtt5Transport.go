@@ -0,0 +1,262 @@
+package bleadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+//Helper methods related to the MQTT 5 transport
+//
+//The MQTT 5 transport is selected with an MQTT protocol version of 5. It behaves exactly like
+//the MQTT 3 transport, reading the adapter configuration from the retained messages published to
+//the config topic, but uses the paho.golang MQTT 5 client. The connection is managed by autopaho,
+//which reconnects automatically.
+
+const (
+	//The time to wait for the initial connection to the broker
+	mqtt5ConnectTimeout = 30 * time.Second
+
+	//The time to wait for in-flight messages to be delivered when disconnecting
+	mqtt5DisconnectTimeout = time.Second
+)
+
+//mqtt5Transport - A Transport that uses a generic MQTT 5 broker. The configuration collections
+//and topics are handled by the embedded mqttTransport, whose MQTT 3 client is not used
+type mqtt5Transport struct {
+	*mqttTransport
+
+	manager *autopaho.ConnectionManager
+	cancel  context.CancelFunc
+
+	//Set by each connection and cleared when the connection is lost. autopaho may report the loss
+	//of a connection more than once, ex. a server disconnect followed by a client error, but the
+	//adapter must only be told once
+	connected bool
+
+	//The functions messages are delivered to, keyed by topic filter
+	handlers      map[string]func(*paho.Publish)
+	handlersMutex sync.Mutex
+}
+
+//newMQTT5Transport - Create a Transport that connects to an MQTT 5 broker
+func newMQTT5Transport(options MQTTOptions) Transport {
+	return &mqtt5Transport{
+		mqttTransport: &mqttTransport{
+			options:     options,
+			collections: make(map[string][]map[string]interface{}),
+		},
+		handlers: make(map[string]func(*paho.Publish)),
+	}
+}
+
+func (transport *mqtt5Transport) Connect(onConnect func(), onConnectLost func(error)) error {
+	brokerURL, err := url.Parse(transport.options.BrokerURL)
+	if err != nil {
+		return errors.New("Invalid MQTT broker URL: " + err.Error())
+	}
+
+	config := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{brokerURL},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectTimeout:                mqtt5ConnectTimeout,
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+			transport.handlersMutex.Lock()
+			transport.manager = manager
+			transport.connected = true
+			transport.handlersMutex.Unlock()
+
+			//Subscriptions are not retained across connections. Subscribe to the configuration
+			//before the adapter starts using it
+			if err := transport.subscribeConfig(); err != nil {
+				log.Printf("[ERROR] Error subscribing to adapter configuration: %s", err.Error())
+			}
+			onConnect()
+		},
+		OnConnectError: func(err error) {
+			log.Printf("[WARN] Unable to connect to MQTT broker %s: %s", transport.options.BrokerURL, err.Error())
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          transport.options.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){transport.route},
+			OnClientError: func(err error) {
+				transport.connectionLost(onConnectLost, err)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				transport.connectionLost(onConnectLost, fmt.Errorf("Disconnected by the MQTT broker, reason code %d", disconnect.ReasonCode))
+			},
+		},
+	}
+
+	if transport.options.Username != "" {
+		config.ConnectUsername = transport.options.Username
+		config.ConnectPassword = []byte(transport.options.Password)
+	}
+
+	if brokerURL.Scheme == "ssl" || brokerURL.Scheme == "tls" || brokerURL.Scheme == "mqtts" ||
+		transport.options.CACertFile != "" || transport.options.CertFile != "" {
+		if config.TlsCfg, err = transport.tlsConfig(); err != nil {
+			return err
+		}
+	}
+
+	//The connection is managed until Disconnect is called
+	ctx, cancel := context.WithCancel(context.Background())
+	log.Printf("[DEBUG] Connecting to MQTT 5 broker %s", transport.options.BrokerURL)
+	manager, err := autopaho.NewConnection(ctx, config)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, mqtt5ConnectTimeout)
+	defer awaitCancel()
+	if err := manager.AwaitConnection(awaitCtx); err != nil {
+		cancel()
+		return errors.New("Unable to connect to MQTT broker " + transport.options.BrokerURL + ": " + err.Error())
+	}
+
+	transport.handlersMutex.Lock()
+	transport.manager = manager
+	transport.cancel = cancel
+	transport.handlersMutex.Unlock()
+	return nil
+}
+
+func (transport *mqtt5Transport) Disconnect() error {
+	manager := transport.getManager()
+	if manager == nil {
+		return nil
+	}
+
+	//Wait for in-flight messages to be delivered, then stop reconnecting
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5DisconnectTimeout)
+	defer cancel()
+	err := manager.Disconnect(ctx)
+	if transport.cancel != nil {
+		transport.cancel()
+	}
+	return err
+}
+
+func (transport *mqtt5Transport) Publish(topic string, payload []byte, qos int) error {
+	manager := transport.getManager()
+	if manager == nil {
+		return errors.New("Not connected to the MQTT broker")
+	}
+
+	_, err := manager.Publish(context.Background(), &paho.Publish{
+		Topic:   transport.topic(topic),
+		QoS:     byte(qos),
+		Payload: payload,
+	})
+	return err
+}
+
+func (transport *mqtt5Transport) Subscribe(topic string, qos int) (<-chan *Message, error) {
+	messageChannel := make(chan *Message, mqttMessageBufferSize)
+
+	err := transport.subscribe(transport.topic(topic), byte(qos), func(publish *paho.Publish) {
+		messageChannel <- &Message{Topic: publish.Topic, Payload: publish.Payload}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messageChannel, nil
+}
+
+//subscribeConfig - Subscribe to the retained messages containing the adapter configuration and filter collections
+func (transport *mqtt5Transport) subscribeConfig() error {
+	return transport.subscribe(transport.topic(mqttConfigTopic+"/+"), 1, func(publish *paho.Publish) {
+		transport.storeCollection(publish.Topic, publish.Payload)
+	})
+}
+
+//subscribe - Subscribe to a topic filter, delivering the messages received to handler. A handler
+//registered by an earlier subscription to the same filter is replaced
+func (transport *mqtt5Transport) subscribe(filter string, qos byte, handler func(*paho.Publish)) error {
+	manager := transport.getManager()
+	if manager == nil {
+		return errors.New("Not connected to the MQTT broker")
+	}
+
+	transport.handlersMutex.Lock()
+	transport.handlers[filter] = handler
+	transport.handlersMutex.Unlock()
+
+	suback, err := manager.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos}},
+	})
+	if err != nil {
+		return err
+	}
+
+	//Reason codes of 0x80 and greater indicate that the subscription failed
+	if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("Subscription to %s refused by the MQTT broker, reason code %d", filter, suback.Reasons[0])
+	}
+	return nil
+}
+
+//route - Deliver a message received from the broker to the handlers of the matching topic filters
+func (transport *mqtt5Transport) route(received paho.PublishReceived) (bool, error) {
+	transport.handlersMutex.Lock()
+	handlers := []func(*paho.Publish){}
+	for filter, handler := range transport.handlers {
+		if mqttTopicMatches(filter, received.Packet.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	transport.handlersMutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(received.Packet)
+	}
+	return len(handlers) > 0, nil
+}
+
+//connectionLost - Call onConnectLost, unless the loss of the current connection was already reported
+func (transport *mqtt5Transport) connectionLost(onConnectLost func(error), err error) {
+	transport.handlersMutex.Lock()
+	wasConnected := transport.connected
+	transport.connected = false
+	transport.handlersMutex.Unlock()
+
+	if !wasConnected {
+		log.Printf("[DEBUG] MQTT connection already reported lost: %s", err.Error())
+		return
+	}
+	onConnectLost(err)
+}
+
+//getManager - Return the connection manager, or nil if the transport has never connected
+func (transport *mqtt5Transport) getManager() *autopaho.ConnectionManager {
+	transport.handlersMutex.Lock()
+	defer transport.handlersMutex.Unlock()
+	return transport.manager
+}
+
+//mqttTopicMatches - Returns true if a topic matches a topic filter containing + and # wildcards
+func mqttTopicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
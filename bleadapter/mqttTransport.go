@@ -0,0 +1,245 @@
+package bleadapter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/clearblade/paho.mqtt.golang"
+)
+
+//Helper methods related to the generic MQTT transport
+//
+//The generic MQTT transport allows the adapter to run against any MQTT 3.1, 3.1.1 or 5 broker,
+//ex. Mosquitto or EMQX. MQTT 5 brokers are used through the mqtt5Transport. As there are no data collections, the adapter configuration and the
+//filter collections are read from retained JSON messages published to
+//<topicPrefix>/bleadapter/config/<collection name>, ex. gateway1/bleadapter/config/BLE_Device_Filters.
+//Each message contains an array of rows, or a single row, using the collection's column names.
+
+const (
+	mqttConfigTopic = "bleadapter/config"
+
+	//The size of the channels returned by Subscribe
+	mqttMessageBufferSize = 100
+)
+
+//MQTTOptions - The settings used to connect to a generic MQTT broker
+type MQTTOptions struct {
+	BrokerURL       string //ex. tcp://localhost:1883 or ssl://localhost:8883
+	ClientID        string
+	Username        string
+	Password        string
+	ProtocolVersion uint   //3 (MQTT 3.1), 4 (MQTT 3.1.1) or 5 (MQTT 5)
+	TopicPrefix     string //Prepended to every topic, ex. the device name
+
+	CACertFile         string //PEM encoded CA certificates used to verify the broker
+	CertFile           string //PEM encoded client certificate
+	KeyFile            string //PEM encoded client private key
+	InsecureSkipVerify bool
+}
+
+//mqttTransport - A Transport that uses a generic MQTT broker
+type mqttTransport struct {
+	options MQTTOptions
+	client  MQTT.Client
+
+	//Collections received on the config topic, keyed by collection name
+	collections      map[string][]map[string]interface{}
+	collectionsMutex sync.Mutex
+}
+
+//NewMQTTTransport - Create a Transport that connects to a generic MQTT broker
+func NewMQTTTransport(options MQTTOptions) (Transport, error) {
+	if options.BrokerURL == "" {
+		return nil, errors.New("NewMQTTTransport - A broker URL is required")
+	}
+
+	if options.ProtocolVersion != 3 && options.ProtocolVersion != 4 && options.ProtocolVersion != 5 {
+		return nil, fmt.Errorf("NewMQTTTransport - Unsupported MQTT protocol version %d. Use 3 (MQTT 3.1), 4 (MQTT 3.1.1) or 5 (MQTT 5)", options.ProtocolVersion)
+	}
+
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, errors.New("NewMQTTTransport - A client certificate and private key must be specified together")
+	}
+
+	//The MQTT 3 client cannot speak MQTT 5
+	if options.ProtocolVersion == 5 {
+		return newMQTT5Transport(options), nil
+	}
+
+	return &mqttTransport{
+		options:     options,
+		collections: make(map[string][]map[string]interface{}),
+	}, nil
+}
+
+func (transport *mqttTransport) Connect(onConnect func(), onConnectLost func(error)) error {
+	clientOptions := MQTT.NewClientOptions().
+		AddBroker(transport.options.BrokerURL).
+		SetClientID(transport.options.ClientID).
+		SetProtocolVersion(transport.options.ProtocolVersion).
+		SetKeepAlive(30 * time.Second).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(client MQTT.Client, err error) {
+			onConnectLost(err)
+		}).
+		SetOnConnectHandler(func(client MQTT.Client) {
+			//Subscriptions are not retained across connections. Subscribe to the configuration
+			//before the adapter starts using it
+			if err := transport.subscribeConfig(); err != nil {
+				log.Printf("[ERROR] Error subscribing to adapter configuration: %s", err.Error())
+			}
+			onConnect()
+		})
+
+	if transport.options.Username != "" {
+		clientOptions.SetUsername(transport.options.Username)
+		clientOptions.SetPassword(transport.options.Password)
+	}
+
+	if strings.HasPrefix(transport.options.BrokerURL, "ssl://") || strings.HasPrefix(transport.options.BrokerURL, "tls://") ||
+		transport.options.CACertFile != "" || transport.options.CertFile != "" {
+		tlsConfig, err := transport.tlsConfig()
+		if err != nil {
+			return err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+
+	transport.client = MQTT.NewClient(clientOptions)
+
+	log.Printf("[DEBUG] Connecting to MQTT broker %s", transport.options.BrokerURL)
+	if token := transport.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (transport *mqttTransport) Disconnect() error {
+	if transport.client == nil {
+		return nil
+	}
+
+	//Wait up to 250 milliseconds for in-flight messages to be delivered
+	transport.client.Disconnect(250)
+	return nil
+}
+
+func (transport *mqttTransport) Publish(topic string, payload []byte, qos int) error {
+	token := transport.client.Publish(transport.topic(topic), byte(qos), false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (transport *mqttTransport) Subscribe(topic string, qos int) (<-chan *Message, error) {
+	messageChannel := make(chan *Message, mqttMessageBufferSize)
+
+	token := transport.client.Subscribe(transport.topic(topic), byte(qos), func(client MQTT.Client, message MQTT.Message) {
+		messageChannel <- &Message{Topic: message.Topic(), Payload: message.Payload()}
+	})
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return messageChannel, nil
+}
+
+func (transport *mqttTransport) GetCollection(collectionName string) ([]map[string]interface{}, error) {
+	transport.collectionsMutex.Lock()
+	defer transport.collectionsMutex.Unlock()
+
+	rows, ok := transport.collections[collectionName]
+	if !ok {
+		return nil, errors.New(collectionName + " has not been published to " + transport.topic(mqttConfigTopic+"/"+collectionName))
+	}
+	return rows, nil
+}
+
+//subscribeConfig - Subscribe to the retained messages containing the adapter configuration and filter collections
+func (transport *mqttTransport) subscribeConfig() error {
+	token := transport.client.Subscribe(transport.topic(mqttConfigTopic+"/+"), 1, func(client MQTT.Client, message MQTT.Message) {
+		transport.storeCollection(message.Topic(), message.Payload())
+	})
+	token.Wait()
+	return token.Error()
+}
+
+//storeCollection - Store the rows of a collection received on the config topic
+func (transport *mqttTransport) storeCollection(topic string, payload []byte) {
+	collectionName := topic[strings.LastIndex(topic, "/")+1:]
+
+	rows, err := parseCollectionJSON(payload)
+	if err != nil {
+		log.Printf("[ERROR] Invalid JSON received for %s: %s", collectionName, err.Error())
+		return
+	}
+
+	log.Printf("[DEBUG] Received %d rows for %s", len(rows), collectionName)
+	transport.collectionsMutex.Lock()
+	defer transport.collectionsMutex.Unlock()
+
+	//An empty retained message clears the collection
+	if len(payload) == 0 {
+		delete(transport.collections, collectionName)
+		return
+	}
+	transport.collections[collectionName] = rows
+}
+
+//topic - Prefix a topic with the topic prefix
+func (transport *mqttTransport) topic(topic string) string {
+	if transport.options.TopicPrefix == "" {
+		return topic
+	}
+	return transport.options.TopicPrefix + "/" + topic
+}
+
+//tlsConfig - Create the TLS configuration used to connect to the broker
+func (transport *mqttTransport) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: transport.options.InsecureSkipVerify}
+
+	if transport.options.CACertFile != "" {
+		caCerts, err := ioutil.ReadFile(transport.options.CACertFile)
+		if err != nil {
+			return nil, errors.New("Unable to read CA certificates: " + err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, errors.New("No CA certificates found in " + transport.options.CACertFile)
+		}
+	}
+
+	if transport.options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(transport.options.CertFile, transport.options.KeyFile)
+		if err != nil {
+			return nil, errors.New("Unable to load client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+//parseCollectionJSON - Parse the rows of a collection published as a JSON array of rows or as a single row
+func parseCollectionJSON(payload []byte) ([]map[string]interface{}, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	rows := []map[string]interface{}{}
+	if err := json.Unmarshal(payload, &rows); err == nil {
+		return rows, nil
+	}
+
+	row := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &row); err != nil {
+		return nil, err
+	}
+	return []map[string]interface{}{row}, nil
+}
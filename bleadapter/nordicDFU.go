@@ -0,0 +1,550 @@
+package bleadapter
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"strings"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to Nordic Secure DFU firmware updates
+//
+//The firmwareUpdate command updates nRF5 devices running the Nordic Secure DFU bootloader:
+//
+//  1. The firmware package is downloaded or retrieved from the uploaded packages
+//  2. If the device is running its application, it is switched into the bootloader through the
+//     buttonless DFU characteristic. Unbonded devices advertise the bootloader at their address + 1
+//  3. For each image in the package, the init packet (command object) and the firmware (data objects)
+//     are transferred through the DFU control point and packet characteristics. The CRC-32 of the data
+//     received by the device is verified before each object is executed
+//
+//Progress events are published to the bleadapter/bledevice/firmware/progress topic.
+
+const (
+	dfuControlPointUUID       = "8ec90001-f315-4f60-9fb8-838830daea50"
+	dfuPacketUUID             = "8ec90002-f315-4f60-9fb8-838830daea50"
+	dfuButtonlessUUID         = "8ec90003-f315-4f60-9fb8-838830daea50"
+	dfuButtonlessBondedUUID   = "8ec90004-f315-4f60-9fb8-838830daea50"
+	firmwareProgressTopic     = "bleadapter/bledevice/firmware/progress"
+	dfuDefaultChunkSize       = 20
+	dfuResponseTimeout        = 10 * time.Second
+	dfuCreateResponseTimeout  = 30 * time.Second //Creating a data object erases flash
+	dfuBootloaderFindTimeout  = 60 * time.Second
+	dfuObjectRetries          = 3
+	dfuButtonlessEnterOpCode  = 0x01
+	dfuButtonlessResponseCode = 0x20
+
+	dfuOpCreate            = 0x01
+	dfuOpSetPRN            = 0x02
+	dfuOpCalculateChecksum = 0x03
+	dfuOpExecute           = 0x04
+	dfuOpSelect            = 0x06
+	dfuOpResponse          = 0x60
+
+	dfuObjectCommand = 0x01
+	dfuObjectData    = 0x02
+
+	dfuResultSuccess       = 0x01
+	dfuResultExtendedError = 0x0B
+)
+
+//FirmwareUpdate - A struct used to encapsulate the "firmware update" subcommand
+type FirmwareUpdate struct{}
+
+var firmwareUpdate = FirmwareUpdate{}
+
+//Descriptions of the DFU result codes
+var dfuResults = map[byte]string{
+	0x00: "invalid opcode",
+	0x02: "opcode not supported",
+	0x03: "invalid parameter",
+	0x04: "insufficient resources",
+	0x05: "invalid object",
+	0x07: "unsupported type",
+	0x08: "operation not permitted",
+	0x0A: "operation failed",
+}
+
+//Descriptions of the DFU extended error codes
+var dfuExtendedErrors = map[byte]string{
+	0x02: "wrong command format",
+	0x03: "unknown command",
+	0x04: "init command invalid",
+	0x05: "firmware version failure",
+	0x06: "hardware version failure",
+	0x07: "SoftDevice version failure",
+	0x08: "signature missing",
+	0x09: "wrong hash type",
+	0x0A: "hash failed",
+	0x0B: "wrong signature type",
+	0x0C: "verification failed",
+	0x0D: "insufficient space",
+}
+
+//dfuClient - Performs the Secure DFU protocol with a device running the bootloader
+type dfuClient struct {
+	controlPoint cbble.Characteristic
+	packet       cbble.Characteristic
+	responses    chan []byte
+	chunkSize    int
+}
+
+//firmwareProgress - Publishes the progress of a firmware update
+type firmwareProgress struct {
+	adapter   *BleAdapter
+	address   string
+	commandID interface{}
+}
+
+//Name - Return the name of the subcommand
+func (cmd FirmwareUpdate) Name() string {
+	return "FirmwareUpdate"
+}
+
+//Process - Execute the subcommand
+//
+//  packageUrl or packageId - The URL of the firmware package, or the packageId of an uploaded package
+//  bootloaderAddress - Optional. The address the bootloader advertises at. Determined automatically when not specified
+//  chunkSize - Optional. The number of bytes written to the packet characteristic at a time. Defaults to 20
+func (cmd FirmwareUpdate) Process(blecmd *BLECommand) error {
+	adapt := blecmd.adapter
+	address := strings.ToUpper((*blecmd.device).Address())
+	progress := firmwareProgress{adapter: adapt, address: address, commandID: blecmd.request.CommandID}
+
+	err := cmd.update(adapt.ctx, blecmd, progress)
+	if err != nil {
+		log.Printf("[ERROR] Firmware update of device %s failed: %s", address, err.Error())
+		progress.publish("failed", "", 0, 0, err)
+		return newCommandError(cmd.Name(), "", "Unable to update firmware. "+err.Error(), err)
+	}
+
+	progress.publish("completed", "", 0, 0, nil)
+	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	return nil
+}
+
+//update - Perform each step of the firmware update
+func (cmd FirmwareUpdate) update(ctx context.Context, blecmd *BLECommand, progress firmwareProgress) error {
+	adapt := blecmd.adapter
+	conn := adapt.connection
+
+	chunkSize := dfuDefaultChunkSize
+	if size, ok := blecmd.command["chunkSize"].(float64); ok {
+		if size < 1 || size > 512 {
+			return invalidCommandError("chunkSize must be between 1 and 512")
+		}
+		chunkSize = int(size)
+	}
+
+	progress.publish("downloading", "", 0, 0, nil)
+	var contents []byte
+	var err error
+	if url, ok := blecmd.command["packageUrl"].(string); ok && url != "" {
+		contents, err = downloadPackage(ctx, url)
+	} else if packageID, ok := blecmd.command["packageId"].(string); ok && packageID != "" {
+		contents, err = getUploadedPackage(packageID)
+	} else {
+		err = invalidCommandError("packageUrl or packageId must be specified")
+	}
+	if err != nil {
+		return err
+	}
+
+	images, err := parsePackage(contents)
+	if err != nil {
+		return err
+	}
+
+	bootloaderAddress, _ := blecmd.command["bootloaderAddress"].(string)
+	bootloaderAddress = strings.ToUpper(bootloaderAddress)
+
+	//Switch the device into the bootloader, unless it is already running it
+	progress.publish("connecting", "", 0, 0, nil)
+	dev, err := connectDFUDevice(ctx, conn, progress.address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.GetDeviceCharacteristic(dev, dfuControlPointUUID); err != nil {
+		progress.publish("enteringBootloader", "", 0, 0, nil)
+		address, err := enterBootloader(ctx, conn, dev)
+		if err != nil {
+			return err
+		}
+		if bootloaderAddress == "" {
+			bootloaderAddress = address
+		}
+	} else if bootloaderAddress == "" {
+		bootloaderAddress = progress.address
+	}
+
+	for _, image := range images {
+		log.Printf("[INFO] Updating %s image of device %s through bootloader %s", image.name, progress.address, bootloaderAddress)
+
+		//The bootloader restarts after each image
+		if _, err := findDevice(ctx, conn, bootloaderAddress, dfuBootloaderFindTimeout); err != nil {
+			return errors.New("bootloader not found: " + err.Error())
+		}
+		dev, err := connectDFUDevice(ctx, conn, bootloaderAddress)
+		if err != nil {
+			return err
+		}
+
+		if err := cmd.transferImage(ctx, conn, dev, image, chunkSize, progress); err != nil {
+			dev.Disconnect() // nolint
+			return err
+		}
+
+		//The bootloader activates the image and resets once the last object is executed
+		dev.Disconnect() // nolint
+	}
+
+	return nil
+}
+
+//transferImage - Transfer the init packet and firmware of an image to the bootloader
+func (cmd FirmwareUpdate) transferImage(ctx context.Context, conn *cbble.Connection, dev cbble.Device, image firmwareImage, chunkSize int, progress firmwareProgress) error {
+	dfu, err := newDFUClient(conn, dev, chunkSize)
+	if err != nil {
+		return err
+	}
+
+	//Packet receipt notifications are not used. The checksum is verified after each object
+	if _, err := dfu.request(ctx, []byte{dfuOpSetPRN, 0, 0}, dfuResponseTimeout); err != nil {
+		return err
+	}
+
+	progress.publish("initPacket", image.name, 0, len(image.initPacket), nil)
+	if err := dfu.transfer(ctx, dfuObjectCommand, image.initPacket, nil); err != nil {
+		return errors.New("init packet rejected: " + err.Error())
+	}
+
+	progress.publish("firmware", image.name, 0, len(image.firmware), nil)
+	return dfu.transfer(ctx, dfuObjectData, image.firmware, func(sent int) {
+		progress.publish("firmware", image.name, sent, len(image.firmware), nil)
+	})
+}
+
+//connectDFUDevice - Connect to a device and wait for its services to be resolved
+func connectDFUDevice(ctx context.Context, conn *cbble.Connection, address string) (cbble.Device, error) {
+	if err := conn.Update(); err != nil {
+		return nil, err
+	}
+	dev, err := conn.GetDeviceByAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if !dev.Connected() {
+		if err := dev.Connect(); err != nil {
+			return nil, err
+		}
+	}
+	return conn.WaitForServicesResolved(ctx, address, servicesResolvedTimeout)
+}
+
+//enterBootloader - Switch a device into the bootloader through the buttonless DFU characteristic.
+//Returns the address the bootloader advertises at
+func enterBootloader(ctx context.Context, conn *cbble.Connection, dev cbble.Device) (string, error) {
+	address := strings.ToUpper(dev.Address())
+
+	//Bonded devices keep their address, unbonded devices advertise the bootloader at address + 1
+	char, err := conn.GetDeviceCharacteristic(dev, dfuButtonlessBondedUUID)
+	if err != nil {
+		if char, err = conn.GetDeviceCharacteristic(dev, dfuButtonlessUUID); err != nil {
+			return "", errors.New("the device does not support buttonless DFU")
+		}
+		if address, err = incrementAddress(address); err != nil {
+			return "", err
+		}
+	}
+
+	responses := make(chan []byte, 1)
+	if err := char.HandleNotify(func(data []byte) {
+		select {
+		case responses <- data:
+		default:
+		}
+	}); err != nil {
+		return "", err
+	}
+
+	if err := char.WriteValue([]byte{dfuButtonlessEnterOpCode}); err != nil {
+		return "", err
+	}
+
+	select {
+	case response := <-responses:
+		if len(response) < 3 || response[0] != dfuButtonlessResponseCode || response[1] != dfuButtonlessEnterOpCode {
+			return "", errors.New("invalid buttonless DFU response " + hex.EncodeToString(response))
+		}
+		if response[2] != dfuResultSuccess {
+			return "", fmt.Errorf("the device refused to enter the bootloader, result %d", response[2])
+		}
+	case <-time.After(dfuResponseTimeout):
+		return "", errors.New("timed out waiting for the device to enter the bootloader")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	//The device disconnects and restarts in the bootloader
+	dev.Disconnect() // nolint
+	return address, nil
+}
+
+//incrementAddress - Add 1 to a MAC address
+func incrementAddress(address string) (string, error) {
+	bytes, err := hex.DecodeString(strings.Replace(address, ":", "", -1))
+	if err != nil || len(bytes) != 6 {
+		return "", errors.New("invalid device address " + address)
+	}
+
+	for i := len(bytes) - 1; i >= 0; i-- {
+		bytes[i]++
+		if bytes[i] != 0 {
+			break
+		}
+	}
+
+	parts := make([]string, len(bytes))
+	for i, b := range bytes {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+//findDevice - Wait for a device to be discovered. If the adapter is not discovering, discovery
+//is started, without a filter, until the device is found
+func findDevice(ctx context.Context, conn *cbble.Connection, address string, timeout time.Duration) (cbble.Device, error) {
+	if err := conn.Update(); err != nil {
+		return nil, err
+	}
+	if dev, err := conn.GetDeviceByAddress(address); err == nil {
+		return dev, nil
+	}
+
+	adapter, err := conn.GetAdapter()
+	if err != nil {
+		return nil, err
+	}
+	if !adapter.Discovering() {
+		if err := adapter.SetDiscoveryFilter(cbble.DiscoveryFilter{}); err != nil {
+			log.Printf("[WARN] Unable to clear the discovery filter: %s", err.Error())
+		}
+		if err := adapter.StartDiscovery(); err != nil {
+			return nil, err
+		}
+		defer adapter.StopDiscovery() // nolint
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.Update(); err != nil {
+				return nil, err
+			}
+			if dev, err := conn.GetDeviceByAddress(address); err == nil {
+				return dev, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("device %s not found", address)
+		}
+	}
+}
+
+//newDFUClient - Enable notifications from the DFU control point of a device running the bootloader
+func newDFUClient(conn *cbble.Connection, dev cbble.Device, chunkSize int) (*dfuClient, error) {
+	controlPoint, err := conn.GetDeviceCharacteristic(dev, dfuControlPointUUID)
+	if err != nil {
+		return nil, errors.New("DFU control point not found. The device is not running the Secure DFU bootloader")
+	}
+	packet, err := conn.GetDeviceCharacteristic(dev, dfuPacketUUID)
+	if err != nil {
+		return nil, errors.New("DFU packet characteristic not found")
+	}
+
+	dfu := &dfuClient{controlPoint: controlPoint, packet: packet, responses: make(chan []byte, 10), chunkSize: chunkSize}
+	err = controlPoint.HandleNotify(func(data []byte) {
+		select {
+		case dfu.responses <- data:
+		default:
+			log.Printf("[WARN] Discarding unexpected DFU response %s", hex.EncodeToString(data))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dfu, nil
+}
+
+//request - Write a request to the control point and wait for its response. Returns the response parameters
+func (dfu *dfuClient) request(ctx context.Context, request []byte, timeout time.Duration) ([]byte, error) {
+	//Discard responses to earlier requests that timed out
+	for len(dfu.responses) > 0 {
+		<-dfu.responses
+	}
+
+	if err := dfu.controlPoint.WriteValue(request); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-dfu.responses:
+		if len(response) < 3 || response[0] != dfuOpResponse || response[1] != request[0] {
+			return nil, errors.New("invalid DFU response " + hex.EncodeToString(response))
+		}
+		switch response[2] {
+		case dfuResultSuccess:
+			return response[3:], nil
+		case dfuResultExtendedError:
+			if len(response) > 3 {
+				return nil, fmt.Errorf("DFU request %02x failed: %s", request[0], describeDFUError(dfuExtendedErrors, response[3]))
+			}
+		}
+		return nil, fmt.Errorf("DFU request %02x failed: %s", request[0], describeDFUError(dfuResults, response[2]))
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for the response to DFU request %02x", request[0])
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//describeDFUError - Return the description of a DFU result or extended error code
+func describeDFUError(descriptions map[byte]string, code byte) string {
+	if description, ok := descriptions[code]; ok {
+		return description
+	}
+	return fmt.Sprintf("error code %d", code)
+}
+
+//transfer - Transfer data as a series of objects of the specified type, calling progress after each object
+func (dfu *dfuClient) transfer(ctx context.Context, objectType byte, data []byte, progress func(sent int)) error {
+	response, err := dfu.request(ctx, []byte{dfuOpSelect, objectType}, dfuResponseTimeout)
+	if err != nil {
+		return err
+	}
+	if len(response) < 12 {
+		return errors.New("invalid DFU select response " + hex.EncodeToString(response))
+	}
+	maxSize := int(binary.LittleEndian.Uint32(response[0:4]))
+	if maxSize == 0 {
+		return errors.New("the bootloader reported a maximum object size of 0")
+	}
+
+	for offset := 0; offset < len(data); offset += maxSize {
+		end := offset + maxSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		var err error
+		for attempt := 1; attempt <= dfuObjectRetries; attempt++ {
+			if err = dfu.sendObject(ctx, objectType, data, offset, end); err == nil || ctx.Err() != nil {
+				break
+			}
+			log.Printf("[WARN] DFU object transfer failed, attempt %d of %d: %s", attempt, dfuObjectRetries, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := dfu.request(ctx, []byte{dfuOpExecute}, dfuResponseTimeout); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(end)
+		}
+	}
+	return nil
+}
+
+//sendObject - Create an object containing data[offset:end], write it to the packet characteristic and
+//verify the checksum of the data received by the bootloader
+func (dfu *dfuClient) sendObject(ctx context.Context, objectType byte, data []byte, offset int, end int) error {
+	create := []byte{dfuOpCreate, objectType, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(create[2:], uint32(end-offset))
+	if _, err := dfu.request(ctx, create, dfuCreateResponseTimeout); err != nil {
+		return err
+	}
+
+	for chunk := offset; chunk < end; chunk += dfu.chunkSize {
+		chunkEnd := chunk + dfu.chunkSize
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+		if err := dfu.packet.WriteValue(data[chunk:chunkEnd]); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	response, err := dfu.request(ctx, []byte{dfuOpCalculateChecksum}, dfuResponseTimeout)
+	if err != nil {
+		return err
+	}
+	if len(response) < 8 {
+		return errors.New("invalid DFU checksum response " + hex.EncodeToString(response))
+	}
+
+	//The offset and CRC cover every object of the type received so far
+	receivedOffset := int(binary.LittleEndian.Uint32(response[0:4]))
+	receivedCRC := binary.LittleEndian.Uint32(response[4:8])
+	if receivedOffset != end {
+		return fmt.Errorf("the bootloader received %d bytes, expected %d", receivedOffset, end)
+	}
+	if expectedCRC := crc32.ChecksumIEEE(data[:end]); receivedCRC != expectedCRC {
+		return fmt.Errorf("CRC mismatch, the bootloader calculated %08x, expected %08x", receivedCRC, expectedCRC)
+	}
+	return nil
+}
+
+//publish - Publish a firmware update progress event
+func (progress firmwareProgress) publish(stage string, image string, sent int, total int, updateErr error) {
+	event := map[string]interface{}{
+		"deviceAddress": progress.address,
+		"stage":         stage,
+		"timestamp":     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if progress.commandID != nil {
+		event["commandId"] = progress.commandID
+	}
+	if image != "" {
+		event["image"] = image
+		event["bytesSent"] = sent
+		event["totalBytes"] = total
+		if total > 0 {
+			event["percent"] = sent * 100 / total
+		}
+	}
+	if updateErr != nil {
+		event["error"] = updateErr.Error()
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] error marshaling firmware progress into json: %s", err.Error())
+		return
+	}
+
+	log.Printf("[DEBUG] Publishing firmware progress: %s", eventJSON)
+	if err := progress.adapter.transport.Publish(firmwareProgressTopic, eventJSON, messagingQos); err != nil {
+		log.Printf("[ERROR] Error occurred when publishing firmware progress to MQTT: %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+package bleadapter
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to scheduled characteristic polling
+//
+//Devices that do not support notifications are polled on the schedules defined in the
+//BLE_Poll_Schedules collection. A schedule applies either to a single device_address or to
+//every discovered device advertising service_uuid. When a poll is due, the adapter connects to
+//the device, reads each characteristic, publishes the values to the bleadapter/bledevice/poll
+//topic and disconnects.
+//
+//Up to pollMaxConcurrent polls run at the same time, each on its own goroutine, so a device that
+//is slow to connect does not delay the polls of other devices. A poll and a BLE command never
+//operate on the same device at the same time, see lockDevice. Devices left connected by a command
+//or managed by the adapter are not disconnected after the poll.
+//
+//Connecting to devices while discovering is unreliable on many controllers, so polls only start
+//while the discovery loop is paused, and the discovery loop waits for running polls to complete
+//before it starts the next scan, see pollWindow. When discovery runs continuously (a
+//discovery_scan_seconds of 0) or scanning is passive, polls run alongside discovery.
+//
+//Only devices found by the discovery loop are polled. Schedules with a service_uuid only apply to
+//devices seen within pollDeviceSeenWindow, or the last two discovery cycles if they are longer,
+//rather than to every device BlueZ has ever cached.
+
+const (
+	pollSchedulesCollectionName = "BLE_Poll_Schedules"
+	pollPublishTopic            = "bleadapter/bledevice/poll"
+
+	//How often the scheduler checks for polls that are due
+	pollSchedulerInterval = time.Second
+
+	//The most polls run at the same time
+	pollMaxConcurrent = 3
+
+	//How recently a device must have been seen for service_uuid schedules to apply to it
+	pollDeviceSeenWindow = 5 * time.Minute
+
+	decodeHex     = "hex"
+	decodeUTF8    = "utf8"
+	decodeUint8   = "uint8"
+	decodeInt8    = "int8"
+	decodeUint16  = "uint16"
+	decodeInt16   = "int16"
+	decodeUint32  = "uint32"
+	decodeInt32   = "int32"
+	decodeFloat32 = "float32"
+)
+
+var (
+	pollSchedules      []pollSchedule
+	pollSchedulesMutex sync.Mutex
+
+	//Held for reading by each running poll and for writing by the discovery loop while it scans
+	pollWindow sync.RWMutex
+
+	//The time each device was last seen by discovery, keyed by device address
+	seenDevices      = make(map[string]time.Time)
+	seenDevicesMutex sync.Mutex
+
+	decodeFormats = []string{decodeHex, decodeUTF8, decodeUint8, decodeInt8, decodeUint16, decodeInt16, decodeUint32, decodeInt32, decodeFloat32}
+)
+
+//pollSchedule - The characteristics to read from a device, or devices advertising a service, at an interval
+type pollSchedule struct {
+	deviceAddress   string
+	serviceUUID     string
+	characteristics []string
+	interval        time.Duration
+	decode          string
+}
+
+//key - Identifies the schedule when tracking the time of the next poll
+func (schedule pollSchedule) key() string {
+	return schedule.deviceAddress + "|" + schedule.serviceUUID + "|" + strings.Join(schedule.characteristics, ",") + "|" + schedule.interval.String()
+}
+
+//getPollSchedules - Retrieve the enabled schedules from the BLE_Poll_Schedules collection
+func (adapt *BleAdapter) getPollSchedules() ([]pollSchedule, error) {
+	rows, err := adapt.transport.GetCollection(pollSchedulesCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := []pollSchedule{}
+	for _, theRow := range rows {
+		if enabled, _ := theRow["enabled"].(bool); !enabled {
+			continue
+		}
+
+		schedule, err := newPollSchedule(theRow)
+		if err != nil {
+			log.Printf("[WARN] Skipping invalid poll schedule: %s", err.Error())
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+//newPollSchedule - Create a poll schedule from a row of the BLE_Poll_Schedules collection
+func newPollSchedule(row map[string]interface{}) (pollSchedule, error) {
+	schedule := pollSchedule{characteristics: []string{}}
+
+	address, _ := row["device_address"].(string)
+	uuid, _ := row["service_uuid"].(string)
+	if (address == "") == (uuid == "") {
+		return schedule, errors.New("exactly one of device_address or service_uuid must be specified")
+	}
+	if address != "" {
+		schedule.deviceAddress = strings.ToUpper(address)
+	}
+	if uuid != "" {
+		var err error
+		if schedule.serviceUUID, err = cbble.NormalizeUUID(uuid); err != nil {
+			return schedule, errors.New("Invalid service_uuid " + uuid)
+		}
+	}
+
+	chars, _ := row["characteristics"].(string)
+	for _, char := range strings.Split(chars, ",") {
+		if char = strings.TrimSpace(char); char == "" {
+			continue
+		}
+		normalized, err := cbble.NormalizeUUID(char)
+		if err != nil {
+			return schedule, errors.New("Invalid characteristic uuid " + char)
+		}
+		schedule.characteristics = append(schedule.characteristics, normalized)
+	}
+	if len(schedule.characteristics) == 0 {
+		return schedule, errors.New("no characteristics specified")
+	}
+
+	interval, ok := row["interval_seconds"].(float64)
+	if !ok || interval < 1 {
+		return schedule, errors.New("interval_seconds must be 1 or greater")
+	}
+	schedule.interval = time.Duration(interval) * time.Second
+
+	schedule.decode, _ = row["decode"].(string)
+	schedule.decode = strings.ToLower(schedule.decode)
+	if schedule.decode != "" && !stringInList(schedule.decode, decodeFormats...) {
+		return schedule, errors.New("Invalid decode \"" + schedule.decode + "\". Must be one of " + strings.Join(decodeFormats, ", "))
+	}
+
+	return schedule, nil
+}
+
+//updatePollSchedules - Replace the poll schedules with the contents of the BLE_Poll_Schedules collection.
+//If the collection cannot be retrieved, the current schedules are left unchanged
+func (adapt *BleAdapter) updatePollSchedules() {
+	schedules, err := adapt.getPollSchedules()
+	if err != nil {
+		log.Printf("[DEBUG] Poll schedules could not be retrieved: %s", err.Error())
+		return
+	}
+
+	pollSchedulesMutex.Lock()
+	defer pollSchedulesMutex.Unlock()
+	pollSchedules = schedules
+}
+
+//runPollScheduler - Poll devices as their schedules come due until the adapter shuts down
+func (adapt *BleAdapter) runPollScheduler() {
+	ticker := time.NewTicker(pollSchedulerInterval)
+	defer ticker.Stop()
+
+	//The time of the next poll, keyed by schedule and device address
+	nextPolls := make(map[string]time.Time)
+
+	//The polls that are running, keyed by schedule and device address
+	running := make(map[string]bool)
+	runningMutex := sync.Mutex{}
+	slots := make(chan bool, pollMaxConcurrent)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-adapt.ctx.Done():
+			return
+		}
+
+		//There is nowhere to publish values
+		if !mqttIsConnected {
+			continue
+		}
+
+		pollSchedulesMutex.Lock()
+		schedules := pollSchedules
+		pollSchedulesMutex.Unlock()
+
+		active := make(map[string]bool)
+		for _, schedule := range schedules {
+			for _, address := range adapt.getPollAddresses(schedule) {
+				key := schedule.key() + "|" + address
+				active[key] = true
+
+				if next, ok := nextPolls[key]; ok && time.Now().Before(next) {
+					continue
+				}
+
+				runningMutex.Lock()
+				isRunning := running[key]
+				runningMutex.Unlock()
+				if isRunning {
+					continue
+				}
+
+				//Polls that cannot start remain due and are retried on the next tick
+				select {
+				case slots <- true:
+				default:
+					continue
+				}
+				if !pollWindow.TryRLock() {
+					<-slots
+					continue
+				}
+
+				nextPolls[key] = time.Now().Add(schedule.interval)
+				runningMutex.Lock()
+				running[key] = true
+				runningMutex.Unlock()
+
+				go func(key string, address string, schedule pollSchedule) {
+					defer func() {
+						runningMutex.Lock()
+						delete(running, key)
+						runningMutex.Unlock()
+						pollWindow.RUnlock()
+						<-slots
+					}()
+					adapt.pollDevice(adapt.ctx, address, schedule)
+				}(key, address, schedule)
+			}
+		}
+
+		//Forget devices and schedules that no longer apply
+		for key := range nextPolls {
+			if !active[key] {
+				delete(nextPolls, key)
+			}
+		}
+		forgetUnseenDevices(24 * time.Hour)
+	}
+}
+
+//getPollAddresses - Return the addresses of the discovered devices a schedule applies to
+func (adapt *BleAdapter) getPollAddresses(schedule pollSchedule) []string {
+	if schedule.deviceAddress != "" {
+		if _, err := adapt.connection.GetDeviceByAddress(schedule.deviceAddress); err != nil {
+			return []string{}
+		}
+		return []string{schedule.deviceAddress}
+	}
+
+	devices, err := adapt.connection.GetDevices(schedule.serviceUUID)
+	if err != nil {
+		return []string{}
+	}
+
+	//BlueZ keeps devices long after they were last seen, only poll the devices nearby
+	window := pollDeviceSeenWindow
+	if cycle := 2 * time.Duration(scanInterval+pauseInterval) * time.Second; cycle > window {
+		window = cycle
+	}
+
+	addresses := []string{}
+	for _, device := range devices {
+		if deviceSeenWithin(device.Address(), window) {
+			addresses = append(addresses, device.Address())
+		}
+	}
+	return addresses
+}
+
+//markDeviceSeen - Record that discovery has seen a device
+func markDeviceSeen(address string) {
+	seenDevicesMutex.Lock()
+	defer seenDevicesMutex.Unlock()
+
+	seenDevices[strings.ToUpper(address)] = time.Now()
+}
+
+//forgetUnseenDevices - Forget the devices discovery has not seen within the specified duration
+func forgetUnseenDevices(duration time.Duration) {
+	seenDevicesMutex.Lock()
+	defer seenDevicesMutex.Unlock()
+
+	for address, seen := range seenDevices {
+		if time.Since(seen) > duration {
+			delete(seenDevices, address)
+		}
+	}
+}
+
+//deviceSeenWithin - Returns true if discovery has seen a device within the specified duration
+func deviceSeenWithin(address string, duration time.Duration) bool {
+	seenDevicesMutex.Lock()
+	defer seenDevicesMutex.Unlock()
+
+	seen, ok := seenDevices[strings.ToUpper(address)]
+	return ok && time.Since(seen) <= duration
+}
+
+//pollDevice - Connect to a device, read and publish the characteristics of the schedule, and disconnect
+func (adapt *BleAdapter) pollDevice(ctx context.Context, address string, schedule pollSchedule) {
+	unlock := lockDevice(address)
+	defer unlock()
+
+	log.Printf("[DEBUG] Polling device %s", address)
+
+	if err := adapt.connection.Update(); err != nil {
+		log.Printf("[Error]Error updating object cache: %#v", err)
+	}
+	dev, err := adapt.connection.GetDeviceByAddress(address)
+	if err != nil {
+		log.Printf("[WARN] Unable to poll device %s: %s", address, err.Error())
+		return
+	}
+
+	if !dev.Connected() {
+		_, err := withRetry(ctx, retryConnect, func() error {
+			return dev.ConnectContext(ctx)
+		})
+		if err != nil {
+			log.Printf("[WARN] Unable to poll device %s. Error connecting to device: %s", address, err.Error())
+			return
+		}
+		defer adapt.disconnectPolledDevice(address)
+	}
+
+	if dev, err = adapt.connection.WaitForServicesResolved(ctx, address, servicesResolvedTimeout); err != nil {
+		log.Printf("[WARN] Unable to poll device %s: %s", address, err.Error())
+		return
+	}
+
+	for _, uuid := range schedule.characteristics {
+		char, err := adapt.connection.GetDeviceCharacteristic(dev, uuid)
+		if err != nil {
+			log.Printf("[WARN] Unable to poll device %s, characteristic %s: %s", address, uuid, err.Error())
+			continue
+		}
+
+		var value []byte
+		_, err = withRetry(ctx, retryRead, func() (err error) {
+			value, err = char.ReadValueContext(ctx)
+			return err
+		})
+		if err != nil {
+			log.Printf("[WARN] Unable to poll device %s. Error reading characteristic %s: %s", address, uuid, err.Error())
+			continue
+		}
+
+		adapt.publishPolledValue(address, uuid, value, schedule.decode)
+		adapt.evaluateRules(ruleSourcePoll, address, uuid, value)
+	}
+}
+
+//disconnectPolledDevice - Disconnect a device after it was polled, unless a BLE command or the adapter needs it connected
+func (adapt *BleAdapter) disconnectPolledDevice(address string) {
+	connectedDevicesMutex.Lock()
+	stayConnected := connectedDevices[address]
+	connectedDevicesMutex.Unlock()
+
+	if stayConnected || isManagedDevice(address) {
+		return
+	}
+
+	if dev, err := adapt.connection.GetDeviceByAddress(address); err == nil {
+		if err := dev.Disconnect(); err != nil {
+			log.Printf("[ERROR] Error while disconnecting from BLE device %s: %s", address, err.Error())
+		}
+	}
+}
+
+//publishPolledValue - Publish a value read by a poll
+func (adapt *BleAdapter) publishPolledValue(address string, uuid string, value []byte, decode string) {
+	poll := map[string]interface{}{
+		"deviceAddress":           address,
+		"gattCharacteristic":      uuid,
+		"gattCharacteristicValue": cbble.JSONableSlice(value),
+		"timestamp":               time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	if decode != "" {
+		decoded, err := decodeValue(decode, value)
+		if err != nil {
+			log.Printf("[WARN] Unable to decode value of device %s, characteristic %s: %s", address, uuid, err.Error())
+		} else {
+			poll["decodedValue"] = decoded
+		}
+	}
+
+	pollJSON, err := json.Marshal(poll)
+	if err != nil {
+		log.Printf("[ERROR] error marshaling polled value into json: %s", err.Error())
+		return
+	}
+
+	log.Printf("[DEBUG] Publishing polled value: %s", pollJSON)
+	if err := adapt.transport.Publish(pollPublishTopic, pollJSON, messagingQos); err != nil {
+		log.Printf("[ERROR] Error occurred when publishing polled value to MQTT: %v", err)
+	}
+}
+
+//decodeValue - Decode a characteristic value. Multi-byte numbers are little endian, as specified by the Bluetooth specification
+func decodeValue(format string, value []byte) (interface{}, error) {
+	sizes := map[string]int{
+		decodeUint8: 1, decodeInt8: 1,
+		decodeUint16: 2, decodeInt16: 2,
+		decodeUint32: 4, decodeInt32: 4, decodeFloat32: 4,
+	}
+	if size, ok := sizes[format]; ok && len(value) < size {
+		return nil, errors.New("value contains " + strconv.Itoa(len(value)) + " bytes, " + format + " requires " + strconv.Itoa(size))
+	}
+
+	switch format {
+	case decodeHex:
+		return hex.EncodeToString(value), nil
+	case decodeUTF8:
+		return strings.TrimRight(string(value), "\x00"), nil
+	case decodeUint8:
+		return value[0], nil
+	case decodeInt8:
+		return int8(value[0]), nil
+	case decodeUint16:
+		return binary.LittleEndian.Uint16(value), nil
+	case decodeInt16:
+		return int16(binary.LittleEndian.Uint16(value)), nil
+	case decodeUint32:
+		return binary.LittleEndian.Uint32(value), nil
+	case decodeInt32:
+		return int32(binary.LittleEndian.Uint32(value)), nil
+	case decodeFloat32:
+		//NaN and infinity cannot be represented in JSON
+		decoded := math.Float32frombits(binary.LittleEndian.Uint32(value))
+		if math.IsNaN(float64(decoded)) || math.IsInf(float64(decoded), 0) {
+			return nil, errors.New("value is not a finite float32")
+		}
+		return decoded, nil
+	}
+	return nil, errors.New("Unknown decode format " + format)
+}
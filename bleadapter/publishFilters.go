@@ -0,0 +1,201 @@
+package bleadapter
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to the client side device publish filters
+//
+//Publish filters are evaluated before a discovered device is published to the platform.
+//Each filter either allows or denies devices matching a single criteria:
+//
+//  address           - The device MAC address
+//  address_prefix    - A prefix of the device MAC address, typically the OUI (ex. 00:0B:57)
+//  name              - A regular expression matched against the device name and alias
+//  manufacturer_id   - A company identifier contained in the manufacturer advertisement data
+//  service_data_uuid - A service UUID contained in the service advertisement data
+//  min_rssi          - The minimum RSSI of the device
+//
+//A device matching any deny filter is never published. When allow filters exist, a device
+//must match at least one of them ("or" mode) or all of them ("and" mode) to be published.
+
+const (
+	publishFiltersCollectionName = "BLE_Publish_Filters"
+
+	filterTypeAddress         = "address"
+	filterTypeAddressPrefix   = "address_prefix"
+	filterTypeName            = "name"
+	filterTypeManufacturerID  = "manufacturer_id"
+	filterTypeServiceDataUUID = "service_data_uuid"
+	filterTypeMinRSSI         = "min_rssi"
+
+	filterActionAllow = "allow"
+	filterActionDeny  = "deny"
+
+	filterModeAnd = "and"
+	filterModeOr  = "or"
+)
+
+var (
+	publishFilters    []publishFilter
+	publishFilterMode = filterModeOr
+)
+
+//publishFilter - A single allow or deny criteria evaluated against discovered devices
+type publishFilter struct {
+	filterType string
+	action     string
+	value      string
+
+	nameRegex      *regexp.Regexp
+	manufacturerID uint16
+	minRSSI        int16
+}
+
+//newPublishFilter - Validate a filter definition and pre-parse its value
+func newPublishFilter(filterType string, action string, value string) (publishFilter, error) {
+	filter := publishFilter{
+		filterType: strings.ToLower(filterType),
+		action:     strings.ToLower(action),
+		value:      value,
+	}
+
+	if filter.action != filterActionAllow && filter.action != filterActionDeny {
+		return filter, errors.New("Invalid publish filter action \"" + action + "\". Must be one of allow or deny")
+	}
+
+	switch filter.filterType {
+	case filterTypeAddress, filterTypeAddressPrefix:
+		filter.value = normalizeAddress(value)
+	case filterTypeName:
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return filter, errors.New("Invalid publish filter name regular expression \"" + value + "\": " + err.Error())
+		}
+		filter.nameRegex = regex
+	case filterTypeManufacturerID:
+		//Company identifiers can be specified in decimal or hex (0x004C)
+		id, err := strconv.ParseUint(value, 0, 16)
+		if err != nil {
+			return filter, errors.New("Invalid publish filter manufacturer id \"" + value + "\": " + err.Error())
+		}
+		filter.manufacturerID = uint16(id)
+	case filterTypeServiceDataUUID:
+		uuid, err := cbble.NormalizeUUID(value)
+		if err != nil {
+			return filter, errors.New("Invalid publish filter service data uuid \"" + value + "\"")
+		}
+		filter.value = uuid
+	case filterTypeMinRSSI:
+		rssi, err := strconv.ParseInt(value, 10, 16)
+		if err != nil {
+			return filter, errors.New("Invalid publish filter minimum rssi \"" + value + "\": " + err.Error())
+		}
+		filter.minRSSI = int16(rssi)
+	default:
+		return filter, errors.New("Invalid publish filter type \"" + filterType + "\"")
+	}
+
+	return filter, nil
+}
+
+//matches - Returns true if the device satisfies the filter criteria
+func (filter publishFilter) matches(device cbble.Device) bool {
+	switch filter.filterType {
+	case filterTypeAddress:
+		return normalizeAddress(device.Address()) == filter.value
+	case filterTypeAddressPrefix:
+		return strings.HasPrefix(normalizeAddress(device.Address()), filter.value)
+	case filterTypeName:
+		return filter.nameRegex.MatchString(device.Name()) || filter.nameRegex.MatchString(device.Alias())
+	case filterTypeManufacturerID:
+		for _, id := range device.ManufacturerIDs() {
+			if id == filter.manufacturerID {
+				return true
+			}
+		}
+	case filterTypeServiceDataUUID:
+		for _, uuid := range device.ServiceDataUUIDs() {
+			if cbble.ConvertUUID(uuid) == filter.value {
+				return true
+			}
+		}
+	case filterTypeMinRSSI:
+		//RSSI() returns -1 when the device did not report an RSSI
+		rssi := device.RSSI()
+		return rssi != -1 && rssi >= filter.minRSSI
+	}
+	return false
+}
+
+//normalizeAddress - Remove separators from a MAC address so that 00:0B:57, 00-0B-57 and 000b57 compare equal
+func normalizeAddress(address string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(address))
+}
+
+//evaluatePublishFilters - Determine whether or not a device satisfies the publish filters
+func evaluatePublishFilters(device cbble.Device, filters []publishFilter, mode string) bool {
+	allowFilters := 0
+	allowMatches := 0
+
+	for _, filter := range filters {
+		matched := filter.matches(device)
+		if filter.action == filterActionDeny {
+			if matched {
+				log.Printf("[DEBUG] Device %s matched %s deny filter %s", device.Address(), filter.filterType, filter.value)
+				return false
+			}
+			continue
+		}
+
+		allowFilters++
+		if matched {
+			allowMatches++
+		}
+	}
+
+	if allowFilters == 0 {
+		return true
+	}
+
+	if mode == filterModeAnd {
+		return allowMatches == allowFilters
+	}
+	return allowMatches > 0
+}
+
+//getPublishFilters - Retrieve the client side publish filters from the platform
+func (adapt *BleAdapter) getPublishFilters() ([]publishFilter, error) {
+	rows, err := adapt.transport.GetCollection(publishFiltersCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []publishFilter{}
+
+	for _, theRow := range rows {
+		if enabled, _ := theRow["enabled"].(bool); !enabled {
+			continue
+		}
+
+		filterType, _ := theRow["filter_type"].(string)
+		action, _ := theRow["action"].(string)
+		value, _ := theRow["value"].(string)
+
+		filter, err := newPublishFilter(filterType, action, value)
+		if err != nil {
+			log.Printf("[WARN] Skipping publish filter: %s", err.Error())
+			continue
+		}
+		filters = append(filters, filter)
+	}
+
+	log.Printf("[DEBUG] Returning publish filters: %#v", filters)
+	return filters, nil
+}
@@ -0,0 +1,67 @@
+package bleadapter
+
+import (
+	"context"
+	"log"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+	"github.com/godbus/dbus"
+)
+
+//Helper methods related to replaying DBUS recordings
+//
+//A recording, created with the RecordingFile option, contains the DBUS signals and method replies seen
+//by the adapter. Replaying it feeds the signals through the same handlers used during discovery, while
+//method calls made by the handlers, ex. GetManagedObjects, return the recorded replies. This allows
+//issues seen on a customer's gateway to be reproduced deterministically.
+//
+//In passive mode, the DeviceFound and DeviceLost calls made on the advertisement monitor are recorded as
+//signals and replayed through the monitor's handlers.
+
+//Replay - Feed the signals contained in a recording through the adapter's signal handlers. Devices are
+//published to transport, normally a local sink. Replay returns once every signal has been handled or
+//ctx is cancelled. speed is passed to cbble.OpenRecording
+func (adapt *BleAdapter) Replay(ctx context.Context, transport Transport, recordingFile string, speed float64) error {
+	adapt.ctx = ctx
+	adapt.transport = transport
+
+	var err error
+	if adapt.connection, err = cbble.OpenRecording(recordingFile, speed); err != nil {
+		return err
+	}
+	defer adapt.connection.Close()
+
+	//BLE commands are not processed when replaying
+	if err := adapt.transport.Connect(func() { mqttIsConnected = true }, func(error) { mqttIsConnected = false }); err != nil {
+		return err
+	}
+	defer adapt.transport.Disconnect()
+
+	//The collections are not normally available, in which case the local configuration is used
+	adapt.getAdapterConfig()
+	adapt.updateFilters()
+
+	log.Printf("[INFO] Replaying DBUS signals from %s", recordingFile)
+
+	count := 0
+	for {
+		dbussignal, ok := adapt.connection.NextRecordedSignal(ctx)
+		if !ok {
+			break
+		}
+		adapt.handleSignal(dbussignal)
+		count++
+	}
+
+	log.Printf("[INFO] Replayed %d DBUS signals from %s", count, recordingFile)
+	return nil
+}
+
+//recordedMonitorDevice - Return the device path of a recorded advertisement monitor DeviceFound or DeviceLost call
+func recordedMonitorDevice(dbussignal *dbus.Signal) (dbus.ObjectPath, bool) {
+	if len(dbussignal.Body) == 0 {
+		return "", false
+	}
+	path, ok := dbussignal.Body[0].(dbus.ObjectPath)
+	return path, ok
+}
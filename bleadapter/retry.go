@@ -0,0 +1,115 @@
+package bleadapter
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to retrying BLE operations
+//
+//BlueZ frequently returns temporary errors, ex. org.bluez.Error.InProgress, NotReady,
+//le-connection-abort-by-local or a timeout, that do not occur when the operation is attempted
+//again. Connect, pair, read and write operations that fail with a temporary error are retried
+//with an exponential backoff. The number of attempts and the delay before the first retry are
+//configured for each operation by the <operation>_retry_attempts and <operation>_retry_delay_ms
+//adapter configuration columns.
+//
+//The number of attempts made by each operation of a BLE command is returned in the attempts
+//field of the command response.
+
+const (
+	retryConnect = "connect"
+	retryPair    = "pair"
+	retryRead    = "read"
+	retryWrite   = "write"
+
+	//The maximum delay between attempts
+	retryMaxDelay = 10 * time.Second
+)
+
+//retryPolicy - The number of times an operation is attempted and the delay before the first retry
+type retryPolicy struct {
+	attempts int
+	delay    time.Duration
+}
+
+var (
+	retryPolicies = map[string]retryPolicy{
+		retryConnect: {attempts: 3, delay: time.Second},
+		retryPair:    {attempts: 3, delay: time.Second},
+		retryRead:    {attempts: 3, delay: 500 * time.Millisecond},
+		retryWrite:   {attempts: 3, delay: 500 * time.Millisecond},
+	}
+	retryPoliciesMutex sync.Mutex
+)
+
+//setRetryPolicies - Update the retry policies from the <operation>_retry_* adapter configuration columns
+func setRetryPolicies(config map[string]interface{}) {
+	retryPoliciesMutex.Lock()
+	defer retryPoliciesMutex.Unlock()
+
+	for operation, policy := range retryPolicies {
+		if attempts, ok := config[operation+"_retry_attempts"].(float64); ok && attempts > 0 {
+			policy.attempts = int(attempts)
+		}
+		if delay, ok := config[operation+"_retry_delay_ms"].(float64); ok && delay >= 0 {
+			policy.delay = time.Duration(delay) * time.Millisecond
+		}
+		retryPolicies[operation] = policy
+	}
+}
+
+//getRetryPolicy - Retrieve the retry policy of an operation
+func getRetryPolicy(operation string) retryPolicy {
+	retryPoliciesMutex.Lock()
+	defer retryPoliciesMutex.Unlock()
+
+	if policy, ok := retryPolicies[operation]; ok {
+		return policy
+	}
+	return retryPolicy{attempts: 1}
+}
+
+//withRetry - Perform an operation, retrying temporary BlueZ errors according to the operation's retry policy.
+//Returns the number of attempts made and the error returned by the last attempt
+func withRetry(ctx context.Context, operation string, perform func() error) (int, error) {
+	policy := getRetryPolicy(operation)
+	delay := policy.delay
+
+	for attempt := 1; ; attempt++ {
+		err := perform()
+		if err == nil || attempt >= policy.attempts || !cbble.IsTemporary(err) {
+			return attempt, err
+		}
+
+		log.Printf("[WARN] Attempt %d of %d to %s failed with a temporary error, retrying in %s: %s", attempt, policy.attempts, operation, delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return attempt, err
+		}
+
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+//retry - Perform an operation of a BLE command with withRetry, recording the number of attempts in the command response
+func (blecmd *BLECommand) retry(operation string, perform func(ctx context.Context) error) error {
+	attempts, err := withRetry(blecmd.ctx, operation, func() error {
+		return perform(blecmd.ctx)
+	})
+
+	attemptsMap, ok := blecmd.command["attempts"].(map[string]interface{})
+	if !ok {
+		attemptsMap = map[string]interface{}{}
+		blecmd.command["attempts"] = attemptsMap
+	}
+	attemptsMap[operation] = attempts
+	return err
+}
@@ -0,0 +1,422 @@
+package bleadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to the edge rules engine
+//
+//Rules, defined in the BLE_Rules collection, allow simple automations to run on the gateway without
+//a round trip to the platform. Each rule evaluates a condition against values received from devices:
+//
+//  notification  - Notifications received from managed devices, keyed by characteristic UUID
+//  poll          - Values read by the poll scheduler, keyed by characteristic UUID
+//  read          - Values read by read commands, keyed by characteristic UUID
+//  advertisement - Advertisements of discovered devices, keyed by rssi, manufacturer/<company id>
+//                  or service_data/<service uuid>
+//
+//The value is decoded with one of the poll decode formats and compared to the rule's threshold. Without
+//a cooldown, a rule fires each time its condition becomes true for a device. With cooldown_seconds, a rule
+//fires whenever its condition is true and it has not fired for the device within the cooldown. When a
+//rule fires, its action either publishes an alert or executes a BLE command, exactly as if the command
+//had been sent from the platform.
+
+const (
+	rulesCollectionName = "BLE_Rules"
+	ruleAlertTopic      = "bleadapter/rules/alert"
+
+	ruleSourceNotification  = "notification"
+	ruleSourcePoll          = "poll"
+	ruleSourceRead          = "read"
+	ruleSourceAdvertisement = "advertisement"
+
+	ruleKeyRSSI         = "rssi"
+	ruleKeyManufacturer = "manufacturer/"
+	ruleKeyServiceData  = "service_data/"
+
+	ruleActionPublish = "publish"
+	ruleActionCommand = "command"
+)
+
+var (
+	rules      []*rule
+	rulesMutex sync.Mutex
+
+	ruleSources   = []string{ruleSourceNotification, ruleSourcePoll, ruleSourceRead, ruleSourceAdvertisement}
+	ruleOperators = []string{"gt", "gte", "lt", "lte", "eq", "ne"}
+)
+
+//rule - A condition evaluated against device values and the action executed when it is met
+type rule struct {
+	name          string
+	source        string
+	deviceAddress string //Optional. Rules without an address apply to every device
+	key           string
+	decode        string
+	offset        int
+	operator      string
+	threshold     string
+	action        string
+	actionTopic   string
+	actionCommand map[string]interface{}
+	cooldown      time.Duration
+
+	//The state of the rule for each device, keyed by address
+	met       map[string]bool
+	lastFired map[string]time.Time
+}
+
+//getRules - Retrieve the enabled rules from the BLE_Rules collection
+func (adapt *BleAdapter) getRules() ([]*rule, error) {
+	rows, err := adapt.transport.GetCollection(rulesCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	theRules := []*rule{}
+	for _, theRow := range rows {
+		if enabled, _ := theRow["enabled"].(bool); !enabled {
+			continue
+		}
+
+		theRule, err := newRule(theRow)
+		if err != nil {
+			log.Printf("[WARN] Skipping invalid rule %#v: %s", theRow["name"], err.Error())
+			continue
+		}
+		theRules = append(theRules, theRule)
+	}
+
+	return theRules, nil
+}
+
+//newRule - Create a rule from a row of the BLE_Rules collection
+func newRule(row map[string]interface{}) (*rule, error) {
+	theRule := &rule{met: make(map[string]bool), lastFired: make(map[string]time.Time)}
+
+	theRule.name, _ = row["name"].(string)
+
+	source, _ := row["source"].(string)
+	if theRule.source = strings.ToLower(source); !stringInList(theRule.source, ruleSources...) {
+		return nil, errors.New("source must be one of " + strings.Join(ruleSources, ", "))
+	}
+
+	if address, _ := row["device_address"].(string); address != "" {
+		theRule.deviceAddress = strings.ToUpper(address)
+	}
+
+	key, _ := row["key"].(string)
+	theRule.key = strings.ToLower(key)
+	if theRule.source == ruleSourceAdvertisement {
+		if theRule.key != ruleKeyRSSI && !strings.HasPrefix(theRule.key, ruleKeyManufacturer) && !strings.HasPrefix(theRule.key, ruleKeyServiceData) {
+			return nil, errors.New("advertisement rules must have a key of rssi, manufacturer/<company id> or service_data/<service uuid>")
+		}
+		if strings.HasPrefix(theRule.key, ruleKeyManufacturer) {
+			id, err := strconv.ParseUint(strings.TrimPrefix(theRule.key, ruleKeyManufacturer), 0, 16)
+			if err != nil {
+				return nil, errors.New("Invalid manufacturer company id in key " + key)
+			}
+			theRule.key = ruleKeyManufacturer + strconv.FormatUint(id, 10)
+		}
+		if strings.HasPrefix(theRule.key, ruleKeyServiceData) {
+			uuid, err := cbble.NormalizeUUID(strings.TrimPrefix(theRule.key, ruleKeyServiceData))
+			if err != nil {
+				return nil, errors.New("Invalid service uuid in key " + key)
+			}
+			theRule.key = ruleKeyServiceData + uuid
+		}
+	} else if theRule.key == "" {
+		return nil, errors.New("key must specify a characteristic UUID")
+	} else {
+		uuid, err := cbble.NormalizeUUID(theRule.key)
+		if err != nil {
+			return nil, errors.New("Invalid characteristic uuid in key " + key)
+		}
+		theRule.key = uuid
+	}
+
+	decode, _ := row["decode"].(string)
+	if theRule.decode = strings.ToLower(decode); theRule.decode == "" {
+		theRule.decode = decodeHex
+	}
+	if !stringInList(theRule.decode, decodeFormats...) {
+		return nil, errors.New("decode must be one of " + strings.Join(decodeFormats, ", "))
+	}
+
+	offset, _ := row["offset"].(float64)
+	if offset < 0 {
+		return nil, errors.New("offset must be 0 or greater")
+	}
+	theRule.offset = int(offset)
+
+	operator, _ := row["operator"].(string)
+	if theRule.operator = strings.ToLower(operator); !stringInList(theRule.operator, ruleOperators...) {
+		return nil, errors.New("operator must be one of " + strings.Join(ruleOperators, ", "))
+	}
+
+	theRule.threshold, _ = row["threshold"].(string)
+	if theRule.decode == decodeHex {
+		theRule.threshold = strings.ToLower(theRule.threshold)
+	}
+	numeric := theRule.key == ruleKeyRSSI || (theRule.decode != decodeHex && theRule.decode != decodeUTF8)
+	if numeric {
+		if _, err := strconv.ParseFloat(theRule.threshold, 64); err != nil {
+			return nil, errors.New("threshold must be a number")
+		}
+	} else if theRule.operator != "eq" && theRule.operator != "ne" {
+		return nil, errors.New("only the eq and ne operators can be used with " + theRule.decode + " values")
+	}
+
+	action, _ := row["action"].(string)
+	switch theRule.action = strings.ToLower(action); theRule.action {
+	case ruleActionPublish:
+		if theRule.actionTopic, _ = row["action_topic"].(string); theRule.actionTopic == "" {
+			theRule.actionTopic = ruleAlertTopic
+		}
+	case ruleActionCommand:
+		command, _ := row["action_command"].(string)
+		if err := json.Unmarshal([]byte(command), &theRule.actionCommand); err != nil {
+			return nil, errors.New("action_command must be a JSON BLE command: " + err.Error())
+		}
+		if name, ok := theRule.actionCommand["command"].(string); !ok || name == "" {
+			return nil, errors.New("action_command must specify a command")
+		} else if _, ok := commandSchemas[strings.ToLower(name)]; !ok {
+			return nil, errors.New("action_command specifies an unknown command " + name)
+		}
+	default:
+		return nil, errors.New("action must be one of publish or command")
+	}
+
+	cooldown, _ := row["cooldown_seconds"].(float64)
+	theRule.cooldown = time.Duration(cooldown) * time.Second
+
+	return theRule, nil
+}
+
+//updateRules - Replace the rules with the contents of the BLE_Rules collection. If the collection
+//cannot be retrieved, the current rules are left unchanged
+func (adapt *BleAdapter) updateRules() {
+	theRules, err := adapt.getRules()
+	if err != nil {
+		log.Printf("[DEBUG] Rules could not be retrieved: %s", err.Error())
+		return
+	}
+
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	//Preserve the state of unchanged rules so that they do not fire again
+	previous := make(map[string]*rule)
+	for _, theRule := range rules {
+		previous[theRule.name] = theRule
+	}
+	for _, theRule := range theRules {
+		if prev, ok := previous[theRule.name]; ok && theRule.sameDefinition(prev) {
+			theRule.met = prev.met
+			theRule.lastFired = prev.lastFired
+		}
+	}
+
+	rules = theRules
+}
+
+//sameDefinition - Return true if the rules have the same condition and action
+func (theRule *rule) sameDefinition(other *rule) bool {
+	ruleJSON, _ := json.Marshal(theRule.actionCommand)
+	otherJSON, _ := json.Marshal(other.actionCommand)
+
+	return theRule.source == other.source && theRule.deviceAddress == other.deviceAddress && theRule.key == other.key &&
+		theRule.decode == other.decode && theRule.offset == other.offset && theRule.operator == other.operator &&
+		theRule.threshold == other.threshold && theRule.action == other.action && theRule.actionTopic == other.actionTopic &&
+		string(ruleJSON) == string(otherJSON) && theRule.cooldown == other.cooldown
+}
+
+//evaluateRules - Evaluate the rules for a source against a value received from a device
+func (adapt *BleAdapter) evaluateRules(source string, address string, key string, value []byte) {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	address = strings.ToUpper(address)
+	key = cbble.ConvertUUID(key)
+
+	for _, theRule := range rules {
+		if theRule.source != source || theRule.key != key || (theRule.deviceAddress != "" && theRule.deviceAddress != address) {
+			continue
+		}
+
+		var decoded interface{}
+		var err error
+		if theRule.offset > len(value) {
+			err = errors.New("offset " + strconv.Itoa(theRule.offset) + " exceeds the length of the value")
+		} else {
+			decoded, err = decodeValue(theRule.decode, value[theRule.offset:])
+		}
+		if err != nil {
+			log.Printf("[WARN] Unable to evaluate rule %s for device %s: %s", theRule.name, address, err.Error())
+			continue
+		}
+
+		adapt.applyRule(theRule, address, decoded)
+	}
+}
+
+//evaluateAdvertisementRules - Evaluate the advertisement rules against a discovered device
+func (adapt *BleAdapter) evaluateAdvertisementRules(device cbble.Device) {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	address := strings.ToUpper(device.Address())
+
+	for _, theRule := range rules {
+		if theRule.source != ruleSourceAdvertisement || (theRule.deviceAddress != "" && theRule.deviceAddress != address) {
+			continue
+		}
+
+		if theRule.key == ruleKeyRSSI {
+			//RSSI() returns -1 when the device did not report an RSSI
+			if rssi := device.RSSI(); rssi != -1 {
+				adapt.applyRule(theRule, address, rssi)
+			}
+			continue
+		}
+
+		//Advertisement data is keyed by manufacturer id or service uuid
+		var value []byte
+		var ok bool
+		if strings.HasPrefix(theRule.key, ruleKeyManufacturer) {
+			id, _ := strconv.ParseUint(strings.TrimPrefix(theRule.key, ruleKeyManufacturer), 10, 16)
+			value, ok = device.ManufacturerValue(uint16(id))
+		} else {
+			value, ok = device.ServiceDataValue(strings.TrimPrefix(theRule.key, ruleKeyServiceData))
+		}
+		if !ok {
+			continue
+		}
+		if theRule.offset > len(value) {
+			log.Printf("[WARN] Unable to evaluate rule %s for device %s: offset %d exceeds the length of the value", theRule.name, address, theRule.offset)
+		} else if decoded, err := decodeValue(theRule.decode, value[theRule.offset:]); err != nil {
+			log.Printf("[WARN] Unable to evaluate rule %s for device %s: %s", theRule.name, address, err.Error())
+		} else {
+			adapt.applyRule(theRule, address, decoded)
+		}
+	}
+}
+
+//applyRule - Compare a decoded value to the rule's threshold and execute the action when the rule fires. The rules must be locked
+func (adapt *BleAdapter) applyRule(theRule *rule, address string, value interface{}) {
+	met := theRule.compare(value)
+	wasMet := theRule.met[address]
+	theRule.met[address] = met
+
+	if !met {
+		return
+	}
+	if (wasMet && theRule.cooldown == 0) || time.Since(theRule.lastFired[address]) < theRule.cooldown {
+		return
+	}
+	theRule.lastFired[address] = time.Now()
+
+	log.Printf("[INFO] Rule %s fired for device %s. Value = %v", theRule.name, address, value)
+
+	//Actions are executed asynchronously, so that commands can operate on the device that triggered the rule
+	switch theRule.action {
+	case ruleActionPublish:
+		go adapt.publishRuleAlert(theRule, address, value)
+	case ruleActionCommand:
+		command := make(map[string]interface{})
+		for name, commandValue := range theRule.actionCommand {
+			command[name] = commandValue
+		}
+		//Commands without a device address operate on the device that triggered the rule
+		if _, ok := command["deviceAddress"]; !ok {
+			command["deviceAddress"] = address
+		}
+		if _, ok := command["commandId"]; !ok {
+			command["commandId"] = "rule:" + theRule.name
+		}
+		go adapt.executeBLECommand(command)
+	}
+}
+
+//compare - Return true if value satisfies the rule's condition
+func (theRule *rule) compare(value interface{}) bool {
+	number, isNumber := toFloat64(value)
+	if !isNumber {
+		//hex and utf8 values are compared as strings
+		text, _ := value.(string)
+		return (theRule.operator == "eq") == (text == theRule.threshold)
+	}
+
+	threshold, err := strconv.ParseFloat(theRule.threshold, 64)
+	if err != nil {
+		return false
+	}
+
+	switch theRule.operator {
+	case "gt":
+		return number > threshold
+	case "gte":
+		return number >= threshold
+	case "lt":
+		return number < threshold
+	case "lte":
+		return number <= threshold
+	case "eq":
+		return number == threshold
+	case "ne":
+		return number != threshold
+	}
+	return false
+}
+
+//toFloat64 - Convert a decoded numeric value to a float64
+func toFloat64(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case uint8:
+		return float64(number), true
+	case int8:
+		return float64(number), true
+	case uint16:
+		return float64(number), true
+	case int16:
+		return float64(number), true
+	case uint32:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case float32:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+//publishRuleAlert - Publish the alert of a rule with the publish action
+func (adapt *BleAdapter) publishRuleAlert(theRule *rule, address string, value interface{}) {
+	alert := map[string]interface{}{
+		"rule":          theRule.name,
+		"deviceAddress": address,
+		"source":        theRule.source,
+		"key":           theRule.key,
+		"value":         value,
+		"threshold":     theRule.threshold,
+		"timestamp":     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	alertJSON, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("[ERROR] error marshaling rule alert into json: %s", err.Error())
+		return
+	}
+
+	log.Printf("[DEBUG] Publishing rule alert: %s", alertJSON)
+	if err := adapt.transport.Publish(theRule.actionTopic, alertJSON, messagingQos); err != nil {
+		log.Printf("[ERROR] Error occurred when publishing rule alert to MQTT: %v", err)
+	}
+}
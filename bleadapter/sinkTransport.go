@@ -0,0 +1,71 @@
+package bleadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//sinkTransport - A Transport that writes published messages to a local file or stdout rather than
+//to a broker. Used when replaying recordings, so that the messages the adapter would have published
+//can be compared with the messages received by the platform.
+//
+//Each message is written as a single line of JSON:
+//
+//  {"time":"...","topic":"bleadapter/bledevice","qos":2,"payload":{...}}
+type sinkTransport struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+//sinkMessage - A message written by the sink transport
+type sinkMessage struct {
+	Time    time.Time       `json:"time"`
+	Topic   string          `json:"topic"`
+	Qos     int             `json:"qos"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+//NewSinkTransport - Create a Transport that writes published messages to writer
+func NewSinkTransport(writer io.Writer) Transport {
+	return &sinkTransport{writer: writer}
+}
+
+func (transport *sinkTransport) Connect(onConnect func(), onConnectLost func(error)) error {
+	onConnect()
+	return nil
+}
+
+func (transport *sinkTransport) Disconnect() error {
+	return nil
+}
+
+func (transport *sinkTransport) Publish(topic string, payload []byte, qos int) error {
+	message := sinkMessage{Time: time.Now(), Topic: topic, Qos: qos, Payload: payload}
+
+	//Payloads that are not JSON are written as strings
+	if !json.Valid(payload) {
+		message.Payload, _ = json.Marshal(string(payload))
+	}
+
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	_, err = transport.writer.Write(append(messageJSON, '\n'))
+	return err
+}
+
+//Subscribe - No messages are received from the sink
+func (transport *sinkTransport) Subscribe(topic string, qos int) (<-chan *Message, error) {
+	return make(chan *Message), nil
+}
+
+func (transport *sinkTransport) GetCollection(collectionName string) ([]map[string]interface{}, error) {
+	return nil, errors.New(collectionName + " is not available from the local sink")
+}
@@ -0,0 +1,560 @@
+package bleadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+)
+
+//Helper methods related to MCUmgr device management
+//
+//Zephyr and other MCUboot based devices expose the Simple Management Protocol (SMP) through a
+//single characteristic of the SMP service. Requests are written to the characteristic and responses
+//are received as notifications. Each message contains an 8 byte header followed by a CBOR map:
+//
+//  op (1) | flags (1) | length (2) | group (2) | sequence (1) | command id (1)
+//
+//The smp command performs one of the following operations on a device:
+//
+//  imageList    - List the images in each slot
+//  imageUpload  - Upload an image to the secondary slot
+//  imageTest    - Boot the image with the specified hash once, on the next reset
+//  imageConfirm - Make the running image, or the image with the specified hash, permanent
+//  reset        - Reset the device
+//  echo         - Echo a message
+//  taskStats    - Retrieve the statistics of each OS task
+//  stats        - List the statistics groups, or retrieve the statistics of a group
+//  fsDownload   - Download a file from the device's file system
+
+const (
+	smpCharacteristicUUID = "da2e7828-fbce-4e01-ae9e-261174997c48"
+	smpProgressTopic      = "bleadapter/bledevice/smp/progress"
+	smpHeaderSize         = 8
+	smpResponseTimeout    = 10 * time.Second
+	smpProgressInterval   = time.Second
+
+	//The SMP characteristic is written without a response, so each write must fit in a single
+	//ATT packet of MTU - 3 bytes. The default ATT MTU is used when BlueZ does not report the MTU
+	smpDefaultMTU    = 23
+	smpATTHeaderSize = 3
+
+	//The upload chunk size used when requests are fragmented and no chunkSize is specified
+	smpDefaultChunkSize = 128
+
+	//The number of consecutive upload responses that may not advance the offset
+	smpMaxStalls = 3
+
+	smpOpRead       = 0
+	smpOpReadReply  = 1
+	smpOpWrite      = 2
+	smpOpWriteReply = 3
+
+	smpGroupOS    = 0
+	smpGroupImage = 1
+	smpGroupStats = 2
+	smpGroupFS    = 8
+
+	smpIDEcho       = 0
+	smpIDTaskStats  = 2
+	smpIDReset      = 5
+	smpIDImageState = 0
+	smpIDUpload     = 1
+	smpIDStatsRead  = 0
+	smpIDStatsList  = 1
+	smpIDFile       = 0
+)
+
+//SMP - A struct used to encapsulate the "smp" subcommand
+type SMP struct{}
+
+var smp = SMP{}
+
+//Descriptions of the SMP return codes
+var smpReturnCodes = map[uint64]string{
+	1:  "unknown error",
+	2:  "out of memory",
+	3:  "invalid value",
+	4:  "timeout",
+	5:  "no entry",
+	6:  "bad state",
+	7:  "response too large",
+	8:  "not supported",
+	9:  "corrupt",
+	10: "busy",
+}
+
+//smpClient - Sends SMP requests to a device and receives the responses
+type smpClient struct {
+	char cbble.Characteristic
+	mtu  int
+
+	//The maximum number of bytes of image data sent in each upload request. 0 sends as much as
+	//fits in a single write
+	chunkSize int
+
+	//Set when the device was built with SMP reassembly, allowing requests to be fragmented into
+	//several writes. Otherwise, each request must fit in a single write, as with mcumgr
+	reassembly bool
+
+	mutex     sync.Mutex
+	sequence  byte
+	responses chan []byte
+
+	//Notifications are reassembled into complete responses
+	pending []byte
+}
+
+//Name - Return the name of the subcommand
+func (cmd SMP) Name() string {
+	return "SMP"
+}
+
+//Process - Execute the subcommand
+//
+//  operation - The SMP operation to perform
+//  hash - The hex encoded image hash of imageTest, and optionally imageConfirm
+//  imageUrl or packageId - The image uploaded by imageUpload, downloaded or uploaded like firmware packages
+//  message - The message sent by echo
+//  statsGroup - Optional. The statistics group retrieved by stats
+//  fileName - The file downloaded by fsDownload
+//  chunkSize - Optional. The maximum number of bytes of image data sent in each upload request
+//  reassembly - Optional. Fragment requests larger than the ATT MTU. The device must support SMP reassembly
+//
+//The result of the operation is returned in the result field of the response
+func (cmd SMP) Process(blecmd *BLECommand) error {
+	adapt := blecmd.adapter
+	address := strings.ToUpper((*blecmd.device).Address())
+	operation, _ := blecmd.command["operation"].(string)
+
+	//Without reassembly, uploads send as much data as fits in a single write by default
+	reassembly, _ := blecmd.command["reassembly"].(bool)
+	chunkSize := 0
+	if reassembly {
+		chunkSize = smpDefaultChunkSize
+	}
+	if size, ok := blecmd.command["chunkSize"].(float64); ok {
+		if size < 1 || size > 2048 {
+			log.Printf("[ERROR] Unable to perform SMP operation. Invalid chunkSize.")
+			return newCommandError(cmd.Name(), errorCodeInvalidCommand, "Unable to perform SMP operation. chunkSize must be between 1 and 2048.", nil)
+		}
+		chunkSize = int(size)
+	}
+
+	client, err := newSMPClient(adapt.connection, *blecmd.device, chunkSize, reassembly)
+	if err != nil {
+		log.Printf("[ERROR] Unable to perform SMP operation: %s", err.Error())
+		return newCommandError(cmd.Name(), "", "Unable to perform SMP operation. "+err.Error(), err)
+	}
+
+	progress := smpProgress{adapter: adapt, address: address, commandID: blecmd.request.CommandID, operation: operation}
+	result, err := cmd.perform(adapt.ctx, client, operation, blecmd.command, progress)
+	if err != nil {
+		log.Printf("[ERROR] SMP %s operation failed: %s", operation, err.Error())
+		return newCommandError(cmd.Name(), "", "SMP "+operation+" operation failed. "+err.Error(), err)
+	}
+
+	blecmd.command["result"] = result
+	log.Printf("[DEBUG] Subcommand %s complete", cmd.Name())
+	return nil
+}
+
+//perform - Perform an SMP operation and return its result
+func (cmd SMP) perform(ctx context.Context, client *smpClient, operation string, command map[string]interface{}, progress smpProgress) (interface{}, error) {
+	switch operation {
+	case "imageList":
+		response, err := client.request(ctx, smpOpRead, smpGroupImage, smpIDImageState, map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+		return smpJSONValue(response), nil
+	case "imageTest", "imageConfirm":
+		request := map[string]interface{}{"confirm": operation == "imageConfirm"}
+		if hashString, ok := command["hash"].(string); ok && hashString != "" {
+			hash, err := hex.DecodeString(hashString)
+			if err != nil {
+				return nil, invalidCommandError("hash must be hex encoded")
+			}
+			request["hash"] = hash
+		} else if operation == "imageTest" {
+			return nil, invalidCommandError("hash must be specified")
+		}
+		response, err := client.request(ctx, smpOpWrite, smpGroupImage, smpIDImageState, request)
+		if err != nil {
+			return nil, err
+		}
+		return smpJSONValue(response), nil
+	case "imageUpload":
+		return client.uploadImage(ctx, command, progress)
+	case "reset":
+		_, err := client.request(ctx, smpOpWrite, smpGroupOS, smpIDReset, map[string]interface{}{})
+		return nil, err
+	case "echo":
+		message, _ := command["message"].(string)
+		response, err := client.request(ctx, smpOpWrite, smpGroupOS, smpIDEcho, map[string]interface{}{"d": message})
+		if err != nil {
+			return nil, err
+		}
+		return response["r"], nil
+	case "taskStats":
+		response, err := client.request(ctx, smpOpRead, smpGroupOS, smpIDTaskStats, map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+		return smpJSONValue(response["tasks"]), nil
+	case "stats":
+		if group, ok := command["statsGroup"].(string); ok && group != "" {
+			response, err := client.request(ctx, smpOpRead, smpGroupStats, smpIDStatsRead, map[string]interface{}{"name": group})
+			if err != nil {
+				return nil, err
+			}
+			return smpJSONValue(response["fields"]), nil
+		}
+		response, err := client.request(ctx, smpOpRead, smpGroupStats, smpIDStatsList, map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+		return smpJSONValue(response["stat_list"]), nil
+	case "fsDownload":
+		fileName, _ := command["fileName"].(string)
+		if fileName == "" {
+			return nil, invalidCommandError("fileName must be specified")
+		}
+		return client.downloadFile(ctx, fileName, progress)
+	}
+	return nil, invalidCommandError("Invalid operation \"" + operation + "\". Must be one of imageList, imageUpload, imageTest, imageConfirm, reset, echo, taskStats, stats or fsDownload")
+}
+
+//newSMPClient - Enable notifications from the SMP characteristic of a device
+func newSMPClient(conn *cbble.Connection, dev cbble.Device, chunkSize int, reassembly bool) (*smpClient, error) {
+	char, err := conn.GetDeviceCharacteristic(dev, smpCharacteristicUUID)
+	if err != nil {
+		return nil, &commandError{Code: errorCodeCharNotFound, Message: "SMP characteristic not found. The device does not support MCUmgr"}
+	}
+
+	mtu := int(char.MTU())
+	if mtu < smpDefaultMTU {
+		mtu = smpDefaultMTU
+	}
+
+	client := &smpClient{char: char, mtu: mtu, chunkSize: chunkSize, reassembly: reassembly, responses: make(chan []byte, 10)}
+	if err := char.HandleNotify(client.handleNotification); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+//handleNotification - Reassemble notifications into complete responses
+func (client *smpClient) handleNotification(data []byte) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.pending = append(client.pending, data...)
+	if len(client.pending) < smpHeaderSize {
+		return
+	}
+
+	length := int(binary.BigEndian.Uint16(client.pending[2:4]))
+	if len(client.pending) < smpHeaderSize+length {
+		return
+	}
+
+	response := client.pending[:smpHeaderSize+length]
+	client.pending = client.pending[smpHeaderSize+length:]
+
+	select {
+	case client.responses <- response:
+	default:
+		log.Printf("[WARN] Discarding unexpected SMP response")
+	}
+}
+
+//request - Send an SMP request and wait for its response
+func (client *smpClient) request(ctx context.Context, op byte, group uint16, id byte, payload map[string]interface{}) (map[string]interface{}, error) {
+	body, err := cborEncode(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	client.mutex.Lock()
+	client.sequence++
+	sequence := client.sequence
+	client.pending = nil
+	client.mutex.Unlock()
+
+	//Discard responses to earlier requests that timed out
+	for len(client.responses) > 0 {
+		<-client.responses
+	}
+
+	header := make([]byte, smpHeaderSize)
+	header[0] = op
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(body)))
+	binary.BigEndian.PutUint16(header[4:6], group)
+	header[6] = sequence
+	header[7] = id
+
+	if err := client.write(append(header, body...)); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(smpResponseTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case response := <-client.responses:
+			if response[6] != sequence || binary.BigEndian.Uint16(response[4:6]) != group || response[7] != id {
+				log.Printf("[WARN] Discarding SMP response to another request")
+				continue
+			}
+			if response[0] != op+1 {
+				return nil, fmt.Errorf("invalid SMP response op %d", response[0])
+			}
+			return decodeSMPResponse(response[smpHeaderSize:])
+		case <-timer.C:
+			return nil, &commandError{Code: errorCodeTimeout, Message: fmt.Sprintf("timed out waiting for the response to SMP request group %d id %d", group, id)}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//write - Write a request to the SMP characteristic. With reassembly, the request is fragmented into
+//writes that fit the ATT MTU, and the device reassembles them using the length in the header
+func (client *smpClient) write(frame []byte) error {
+	fragmentSize := client.mtu - smpATTHeaderSize
+	if !client.reassembly && len(frame) > fragmentSize {
+		return fmt.Errorf("the %d byte SMP request does not fit in a single %d byte write. Set reassembly if the device supports SMP reassembly", len(frame), fragmentSize)
+	}
+	for len(frame) > 0 {
+		size := fragmentSize
+		if size > len(frame) {
+			size = len(frame)
+		}
+		if err := client.char.WriteValue(frame[:size]); err != nil {
+			return err
+		}
+		frame = frame[size:]
+	}
+	return nil
+}
+
+//decodeSMPResponse - Decode the CBOR body of a response, returning an error if the device reported one
+func decodeSMPResponse(body []byte) (map[string]interface{}, error) {
+	value, err := cborDecode(body)
+	if err != nil {
+		return nil, errors.New("invalid SMP response: " + err.Error())
+	}
+	response, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid SMP response: not a map")
+	}
+
+	//SMP version 1 reports errors with rc, version 2 with an err map containing the group and rc
+	rc, _ := response["rc"].(uint64)
+	if errMap, ok := response["err"].(map[string]interface{}); ok {
+		rc, _ = errMap["rc"].(uint64)
+	}
+	if rc != 0 {
+		description, ok := smpReturnCodes[rc]
+		if !ok {
+			description = fmt.Sprintf("error code %d", rc)
+		}
+		return nil, errors.New("the device returned " + description)
+	}
+	return response, nil
+}
+
+//uploadImage - Upload an image to the secondary slot
+func (client *smpClient) uploadImage(ctx context.Context, command map[string]interface{}, progress smpProgress) (interface{}, error) {
+	var image []byte
+	var err error
+	if url, ok := command["imageUrl"].(string); ok && url != "" {
+		image, err = downloadPackage(ctx, url)
+	} else if packageID, ok := command["packageId"].(string); ok && packageID != "" {
+		image, err = getUploadedPackage(packageID)
+	} else {
+		err = invalidCommandError("imageUrl or packageId must be specified")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(image) == 0 {
+		return nil, errors.New("the image is empty")
+	}
+
+	sha := sha256.Sum256(image)
+	offset := 0
+	stalls := 0
+	for offset < len(image) {
+		request := map[string]interface{}{"off": offset}
+		if offset == 0 {
+			request["image"] = 0
+			request["len"] = len(image)
+			request["sha"] = sha[:]
+		}
+
+		size, err := client.uploadChunkSize(request, len(image)-offset)
+		if err != nil {
+			return nil, err
+		}
+		request["data"] = image[offset : offset+size]
+
+		response, err := client.request(ctx, smpOpWrite, smpGroupImage, smpIDUpload, request)
+		if err != nil {
+			return nil, err
+		}
+
+		//The device reports the offset it expects next, which allows uploads to resume
+		next, ok := response["off"].(uint64)
+		if !ok || next > uint64(len(image)) {
+			return nil, errors.New("invalid SMP upload response")
+		}
+
+		//A device that keeps rejecting the data would otherwise be sent the same chunk forever
+		if int(next) <= offset {
+			stalls++
+			if stalls > smpMaxStalls {
+				return nil, fmt.Errorf("the device did not accept the image data at offset %d", offset)
+			}
+		} else {
+			stalls = 0
+		}
+		offset = int(next)
+		progress.publish(offset, len(image))
+	}
+
+	return map[string]interface{}{"size": len(image), "sha256": hex.EncodeToString(sha[:])}, nil
+}
+
+//uploadChunkSize - Return the number of bytes of image data to add to an upload request. Without
+//reassembly, the whole encoded request must fit in a single write
+func (client *smpClient) uploadChunkSize(request map[string]interface{}, remaining int) (int, error) {
+	size := remaining
+	if client.chunkSize > 0 && client.chunkSize < size {
+		size = client.chunkSize
+	}
+	if client.reassembly {
+		return size, nil
+	}
+
+	//Encode the request without data to find the space left for the data and its length
+	request["data"] = []byte{}
+	body, err := cborEncode(request)
+	if err != nil {
+		return 0, err
+	}
+	available := client.mtu - smpATTHeaderSize - smpHeaderSize - len(body)
+	if size > available {
+		size = available
+	}
+
+	//The empty byte string has a one byte head, and longer lengths take up to two more bytes
+	for size > 0 && size+cborHeadSize(uint64(size))-1 > available {
+		size--
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("the ATT MTU of %d bytes is too small for SMP upload requests. Set reassembly if the device supports SMP reassembly", client.mtu)
+	}
+	return size, nil
+}
+
+//downloadFile - Download a file from the device's file system
+func (client *smpClient) downloadFile(ctx context.Context, fileName string, progress smpProgress) (interface{}, error) {
+	contents := []byte{}
+	size := -1
+	for size == -1 || len(contents) < size {
+		response, err := client.request(ctx, smpOpRead, smpGroupFS, smpIDFile, map[string]interface{}{"name": fileName, "off": len(contents)})
+		if err != nil {
+			return nil, err
+		}
+
+		//The length of the file is only included in the first response
+		if length, ok := response["len"].(uint64); ok && size == -1 {
+			size = int(length)
+		}
+		data, _ := response["data"].([]byte)
+		if size == -1 || (len(data) == 0 && len(contents) < size) {
+			return nil, errors.New("invalid SMP file download response")
+		}
+		contents = append(contents, data...)
+		progress.publish(len(contents), size)
+	}
+
+	return map[string]interface{}{"fileName": fileName, "fileSize": size, "fileData": contents}, nil
+}
+
+//smpJSONValue - Convert a decoded response so that it can be returned as JSON. Byte strings, such as
+//image hashes, are hex encoded
+func smpJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return hex.EncodeToString(v)
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, elem := range v {
+			array[i] = smpJSONValue(elem)
+		}
+		return array
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			object[key] = smpJSONValue(elem)
+		}
+		return object
+	}
+	return value
+}
+
+//smpProgress - Publishes the progress of SMP uploads and downloads
+type smpProgress struct {
+	adapter   *BleAdapter
+	address   string
+	commandID interface{}
+	operation string
+	last      *time.Time
+}
+
+//publish - Publish the progress of a transfer, at most once every smpProgressInterval and when the transfer completes
+func (progress *smpProgress) publish(sent int, total int) {
+	if progress.last != nil && sent < total && time.Since(*progress.last) < smpProgressInterval {
+		return
+	}
+	now := time.Now()
+	progress.last = &now
+
+	event := map[string]interface{}{
+		"deviceAddress": progress.address,
+		"operation":     progress.operation,
+		"bytes":         sent,
+		"totalBytes":    total,
+		"timestamp":     now.UTC().Format(time.RFC3339Nano),
+	}
+	if progress.commandID != nil {
+		event["commandId"] = progress.commandID
+	}
+	if total > 0 {
+		event["percent"] = sent * 100 / total
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] error marshaling SMP progress into json: %s", err.Error())
+		return
+	}
+
+	log.Printf("[DEBUG] Publishing SMP progress: %s", eventJSON)
+	if err := progress.adapter.transport.Publish(smpProgressTopic, eventJSON, messagingQos); err != nil {
+		log.Printf("[ERROR] Error occurred when publishing SMP progress to MQTT: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package bleadapter
+
+import (
+	"errors"
+	"log"
+
+	cb "github.com/clearblade/Go-SDK"
+	MQTT "github.com/clearblade/paho.mqtt.golang"
+)
+
+//Transport - The messaging backend used to exchange messages with the platform and to
+//retrieve the adapter configuration and filter collections.
+//
+//Topics passed to a Transport are relative to the device. Implementations prefix them
+//with the device name, ex. bleadapter/bledevice is published to <deviceName>/bleadapter/bledevice
+type Transport interface {
+	//Connect - Connect to the message broker. onConnect is invoked each time a connection is
+	//established and onConnectLost each time the connection is lost. Implementations reconnect automatically
+	Connect(onConnect func(), onConnectLost func(error)) error
+
+	//Disconnect - Disconnect from the message broker
+	Disconnect() error
+
+	//Publish - Publish a message to a topic
+	Publish(topic string, payload []byte, qos int) error
+
+	//Subscribe - Subscribe to a topic. Messages received on the topic are sent to the returned channel
+	Subscribe(topic string, qos int) (<-chan *Message, error)
+
+	//GetCollection - Retrieve the rows of a configuration collection, ex. BLE_Adapter_Config or BLE_Device_Filters
+	GetCollection(collectionName string) ([]map[string]interface{}, error)
+}
+
+//Message - A message received from a Transport
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+//clearBladeTransport - A Transport that uses the ClearBlade Platform MQTT broker and data collections
+type clearBladeTransport struct {
+	client *cb.DeviceClient
+}
+
+//NewClearBladeTransport - Create a Transport using an authenticated ClearBlade device client
+func NewClearBladeTransport(client *cb.DeviceClient) Transport {
+	return &clearBladeTransport{client: client}
+}
+
+func (transport *clearBladeTransport) Connect(onConnect func(), onConnectLost func(error)) error {
+	log.Printf("[DEBUG] Initializing MQTT with callbacks")
+	var callbacks = &cb.Callbacks{
+		OnConnectionLostCallback: func(client MQTT.Client, err error) { onConnectLost(err) },
+		OnConnectCallback:        func(client MQTT.Client) { onConnect() },
+	}
+	return transport.client.InitializeMQTTWithCallback("bleadapter_"+transport.client.DeviceName, "", 30, nil, nil, callbacks)
+}
+
+func (transport *clearBladeTransport) Disconnect() error {
+	return transport.client.Disconnect()
+}
+
+func (transport *clearBladeTransport) Publish(topic string, payload []byte, qos int) error {
+	return transport.client.Publish(transport.client.DeviceName+"/"+topic, payload, qos)
+}
+
+func (transport *clearBladeTransport) Subscribe(topic string, qos int) (<-chan *Message, error) {
+	publishChannel, err := transport.client.Subscribe(transport.client.DeviceName+"/"+topic, qos)
+	if err != nil {
+		return nil, err
+	}
+
+	//Convert the messages received from the ClearBlade client, closing the channel when the subscription ends
+	messageChannel := make(chan *Message)
+	go func() {
+		defer close(messageChannel)
+		for publish := range publishChannel {
+			messageChannel <- &Message{Topic: publish.Topic.Whole, Payload: publish.Payload}
+		}
+	}()
+	return messageChannel, nil
+}
+
+func (transport *clearBladeTransport) GetCollection(collectionName string) ([]map[string]interface{}, error) {
+	//Passing an empty query results in all rows being returned
+	results, err := transport.client.GetDataByName(collectionName, &cb.Query{})
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := results["DATA"].([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected response received when retrieving " + collectionName)
+	}
+
+	rows := []map[string]interface{}{}
+	for _, row := range data {
+		if theRow, ok := row.(map[string]interface{}); ok {
+			rows = append(rows, theRow)
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	cbble "github.com/clearblade/ble-adapter-go/ble"
+	"github.com/godbus/dbus"
+)
+
+//Standalone subcommands used to debug BLE devices in the field. The subcommands use
+//the ble package directly and do not require platform credentials.
+//
+//  ble-adapter-go scan [-duration 10] [-uuids <uuid>,...]
+//  ble-adapter-go info <address>
+//  ble-adapter-go gatt <address>
+//  ble-adapter-go read <address> <characteristic uuid>
+//  ble-adapter-go write <address> <characteristic uuid> <hex value>
+//  ble-adapter-go notify [-duration 0] <address> <characteristic uuid>
+//  ble-adapter-go pair <address>
+//  ble-adapter-go remove <address>
+
+//cliOptions - The flags shared by the subcommands
+type cliOptions struct {
+	json          bool
+	verbose       bool
+	timeout       int
+	duration      int
+	uuids         string
+	stayConnected bool
+}
+
+//cliCommand - A subcommand. run returns the result to print, or nil if the command printed its own output
+type cliCommand struct {
+	usage       string
+	description string
+	args        int
+	run         func(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error)
+}
+
+//cliResult - The result of a subcommand, printed as a table or as JSON
+type cliResult interface {
+	printTable(w io.Writer)
+}
+
+var cliCommands = map[string]cliCommand{
+	"scan":   {usage: "", description: "Scan for BLE devices", args: 0, run: cliScan},
+	"info":   {usage: "<address>", description: "Print the properties of a BLE device", args: 1, run: cliInfo},
+	"gatt":   {usage: "<address>", description: "Connect to a BLE device and print its GATT services and characteristics", args: 1, run: cliGatt},
+	"read":   {usage: "<address> <characteristic uuid>", description: "Read the value of a characteristic", args: 2, run: cliRead},
+	"write":  {usage: "<address> <characteristic uuid> <hex value>", description: "Write a value, ex. 0c172b2d, to a characteristic", args: 3, run: cliWrite},
+	"notify": {usage: "<address> <characteristic uuid>", description: "Print notifications from a characteristic until interrupted", args: 2, run: cliNotify},
+	"pair":   {usage: "<address>", description: "Pair with a BLE device", args: 1, run: cliPair},
+	"remove": {usage: "<address>", description: "Remove (unpair) a BLE device", args: 1, run: cliRemove},
+}
+
+//isCLICommand - Is the argument the name of a subcommand
+func isCLICommand(name string) bool {
+	_, ok := cliCommands[name]
+	return ok
+}
+
+//cliUsage - Print the available subcommands
+func cliUsage(w io.Writer) {
+	names := []string{}
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Commands:\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, cliCommands[name].description)
+	}
+	fmt.Fprintf(w, "\nRun ble-adapter-go <command> -h for the options of a command\n")
+}
+
+//runCLICommand - Execute a subcommand, returning the exit code of the process
+func runCLICommand(name string, args []string) int {
+	command := cliCommands[name]
+
+	options := cliOptions{}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.BoolVar(&options.json, "json", false, "Print the results as JSON")
+	flags.BoolVar(&options.verbose, "verbose", false, "Print log messages to stderr")
+	flags.IntVar(&options.timeout, "timeout", 30, "The number of seconds to wait for the device to be found, connected and resolved")
+	switch name {
+	case "scan":
+		flags.IntVar(&options.duration, "duration", 10, "The number of seconds to scan for")
+		flags.StringVar(&options.uuids, "uuids", "", "A comma separated list of service uuids to filter on")
+	case "notify":
+		flags.IntVar(&options.duration, "duration", 0, "The number of seconds to print notifications for. 0 prints notifications until interrupted")
+	case "gatt", "read", "write":
+		flags.BoolVar(&options.stayConnected, "stayConnected", false, "Remain connected to the device once the command completes")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ble-adapter-go %s [options] %s\n\n%s\n\n", name, command.usage, command.description)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != command.args {
+		flags.Usage()
+		return 2
+	}
+
+	//The ble package logs through the standard logger
+	log.SetOutput(ioutil.Discard)
+	if options.verbose {
+		log.SetOutput(os.Stderr)
+	}
+
+	conn, err := cbble.Open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to connect to BlueZ: %s\n", err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	//Stop the command when interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	result, err := command.run(ctx, conn, options, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+
+	if result != nil {
+		if err := printCLIResult(os.Stdout, result, options.json); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+	}
+	return 0
+}
+
+func printCLIResult(w io.Writer, result cliResult, asJSON bool) error {
+	if !asJSON {
+		result.printTable(w)
+		return nil
+	}
+
+	resultJSON, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(resultJSON))
+	return nil
+}
+
+//cliDevice - The properties of a BLE device
+type cliDevice struct {
+	Address          string                 `json:"address"`
+	Path             dbus.ObjectPath        `json:"path"`
+	Name             string                 `json:"name"`
+	Alias            string                 `json:"alias"`
+	RSSI             *int16                 `json:"rssi,omitempty"`
+	TxPower          *int16                 `json:"txPower,omitempty"`
+	Paired           bool                   `json:"paired"`
+	Connected        bool                   `json:"connected"`
+	Trusted          bool                   `json:"trusted"`
+	Blocked          bool                   `json:"blocked"`
+	ServicesResolved bool                   `json:"servicesResolved"`
+	UUIDs            []string               `json:"uuids"`
+	ManufacturerData map[string]interface{} `json:"manufacturerData,omitempty"`
+	ServiceData      map[string]interface{} `json:"serviceData,omitempty"`
+}
+
+type cliDevices []cliDevice
+
+//cliGattService - A GATT service and its characteristics
+type cliGattService struct {
+	UUID            string                  `json:"uuid"`
+	Path            dbus.ObjectPath         `json:"path"`
+	Primary         bool                    `json:"primary"`
+	Characteristics []cliGattCharacteristic `json:"characteristics"`
+}
+
+//cliGattCharacteristic - A GATT characteristic
+type cliGattCharacteristic struct {
+	UUID  string          `json:"uuid"`
+	Path  dbus.ObjectPath `json:"path"`
+	Flags []string        `json:"flags"`
+}
+
+type cliGattServices []cliGattService
+
+//cliValue - The value of a characteristic
+type cliValue struct {
+	Address        string              `json:"address"`
+	Characteristic string              `json:"characteristic"`
+	Value          cbble.JSONableSlice `json:"value"`
+	Time           *time.Time          `json:"time,omitempty"`
+}
+
+//cliMessage - The result of commands that do not return data
+type cliMessage struct {
+	Address string `json:"address"`
+	Result  string `json:"result"`
+}
+
+func newCLIDevice(device cbble.Device) cliDevice {
+	info := cliDevice{
+		Address:          device.Address(),
+		Path:             device.Path(),
+		Name:             device.Name(),
+		Alias:            device.Alias(),
+		Paired:           device.Paired(),
+		Connected:        device.Connected(),
+		Trusted:          device.Trusted(),
+		Blocked:          device.Blocked(),
+		ServicesResolved: device.ServicesResolved(),
+		UUIDs:            device.UUIDs(),
+		ManufacturerData: device.ManufacturerData(),
+		ServiceData:      device.ServiceData(),
+	}
+
+	//RSSI and TxPower are -1 when they are not available
+	if rssi := device.RSSI(); rssi != -1 {
+		info.RSSI = &rssi
+	}
+	if txPower := device.TxPower(); txPower != -1 {
+		info.TxPower = &txPower
+	}
+	return info
+}
+
+func (devices cliDevices) printTable(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ADDRESS\tNAME\tRSSI\tPAIRED\tCONNECTED\tUUIDS")
+	for _, device := range devices {
+		rssi := ""
+		if device.RSSI != nil {
+			rssi = fmt.Sprintf("%d", *device.RSSI)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%t\t%t\t%s\n", device.Address, device.Alias, rssi, device.Paired, device.Connected, strings.Join(device.UUIDs, ","))
+	}
+	table.Flush()
+}
+
+func (device cliDevice) printTable(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Address\t%s\n", device.Address)
+	fmt.Fprintf(table, "Path\t%s\n", device.Path)
+	fmt.Fprintf(table, "Name\t%s\n", device.Name)
+	fmt.Fprintf(table, "Alias\t%s\n", device.Alias)
+	if device.RSSI != nil {
+		fmt.Fprintf(table, "RSSI\t%d\n", *device.RSSI)
+	}
+	if device.TxPower != nil {
+		fmt.Fprintf(table, "TxPower\t%d\n", *device.TxPower)
+	}
+	fmt.Fprintf(table, "Paired\t%t\n", device.Paired)
+	fmt.Fprintf(table, "Connected\t%t\n", device.Connected)
+	fmt.Fprintf(table, "Trusted\t%t\n", device.Trusted)
+	fmt.Fprintf(table, "Blocked\t%t\n", device.Blocked)
+	fmt.Fprintf(table, "ServicesResolved\t%t\n", device.ServicesResolved)
+	for _, uuid := range device.UUIDs {
+		fmt.Fprintf(table, "UUID\t%s\n", uuid)
+	}
+	for id, data := range device.ManufacturerData {
+		fmt.Fprintf(table, "ManufacturerData\t%s: %v\n", id, data)
+	}
+	for uuid, data := range device.ServiceData {
+		fmt.Fprintf(table, "ServiceData\t%s: %v\n", uuid, data)
+	}
+	table.Flush()
+}
+
+func (services cliGattServices) printTable(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVICE\tCHARACTERISTIC\tFLAGS")
+	for _, service := range services {
+		fmt.Fprintf(table, "%s\t\t\n", service.UUID)
+		for _, char := range service.Characteristics {
+			fmt.Fprintf(table, "\t%s\t%s\n", char.UUID, strings.Join(char.Flags, ","))
+		}
+	}
+	table.Flush()
+}
+
+func (value cliValue) printTable(w io.Writer) {
+	if value.Time != nil {
+		fmt.Fprintf(w, "%s  %s\n", value.Time.Format("15:04:05.000"), hex.EncodeToString(value.Value))
+		return
+	}
+	fmt.Fprintln(w, hex.EncodeToString(value.Value))
+}
+
+func (message cliMessage) printTable(w io.Writer) {
+	fmt.Fprintf(w, "%s: %s\n", message.Address, message.Result)
+}
+
+//cliScan - Scan for devices for the specified duration and print the devices that were seen
+func cliScan(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	filter := cbble.DiscoveryFilter{}
+	for _, uuid := range strings.Split(options.uuids, ",") {
+		if uuid = strings.TrimSpace(strings.ToLower(uuid)); uuid != "" {
+			filter.UUIDs = append(filter.UUIDs, uuid)
+		}
+	}
+
+	for _, rule := range []string{cbble.AddRule, cbble.PropertiesRule} {
+		if err := conn.AddMatch(rule); err != nil {
+			return nil, err
+		}
+		defer conn.RemoveMatch(rule)
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, time.Duration(options.duration)*time.Second)
+	defer cancel()
+
+	signals := conn.StartDiscovery(scanCtx, make(chan bool), filter)
+	if signals == nil {
+		return nil, errors.New("unable to start discovery")
+	}
+
+	//Record the devices that were seen during the scan
+	seen := map[string]bool{}
+	for s := range signals {
+		path := string(s.Path)
+		if s.Name == cbble.InterfacesAdded && len(s.Body) > 0 {
+			if objectPath, ok := s.Body[0].(dbus.ObjectPath); ok {
+				path = string(objectPath)
+			}
+		}
+		if address := cbble.ParseAddressFromPath(path); address != "" {
+			//Strip the path of any GATT objects, ex. dev_00_0B_57_36_73_9F/service0001
+			seen[strings.Split(address, "/")[0]] = true
+		}
+	}
+
+	if err := conn.Update(); err != nil {
+		return nil, err
+	}
+
+	devices := cliDevices{}
+	found, _ := conn.GetDevices(filter.UUIDs...)
+	for _, device := range found {
+		if seen[device.Address()] {
+			devices = append(devices, newCLIDevice(device))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices, nil
+}
+
+//cliInfo - Print the properties of a device
+func cliInfo(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	device, err := cliFindDevice(ctx, conn, options, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return newCLIDevice(device), nil
+}
+
+//cliGatt - Print the GATT services and characteristics of a device
+func cliGatt(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	device, disconnect, err := cliConnectDevice(ctx, conn, options, args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	services, err := conn.GetDeviceServices(device)
+	if err != nil {
+		return nil, err
+	}
+	chars, _ := conn.GetDeviceCharacteristics(device)
+
+	result := cliGattServices{}
+	for _, service := range services {
+		gattService := cliGattService{
+			UUID:            service.UUID(),
+			Path:            service.Path(),
+			Primary:         service.Primary(),
+			Characteristics: []cliGattCharacteristic{},
+		}
+		for _, char := range chars {
+			if char.Service() == service.Path() {
+				gattService.Characteristics = append(gattService.Characteristics, cliGattCharacteristic{
+					UUID:  char.UUID(),
+					Path:  char.Path(),
+					Flags: char.Flags(),
+				})
+			}
+		}
+		sort.Slice(gattService.Characteristics, func(i, j int) bool {
+			return gattService.Characteristics[i].Path < gattService.Characteristics[j].Path
+		})
+		result = append(result, gattService)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+//cliRead - Read the value of a characteristic
+func cliRead(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	device, disconnect, err := cliConnectDevice(ctx, conn, options, args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	char, err := conn.GetDeviceCharacteristic(device, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, fmt.Errorf("characteristic %s not found: %s", args[1], err.Error())
+	}
+
+	value, err := char.ReadValue()
+	if err != nil {
+		return nil, err
+	}
+	return cliValue{Address: device.Address(), Characteristic: char.UUID(), Value: value}, nil
+}
+
+//cliWrite - Write a value to a characteristic
+func cliWrite(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	value, err := hex.DecodeString(strings.Replace(strings.TrimPrefix(args[2], "0x"), ":", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex value %s", args[2])
+	}
+
+	device, disconnect, err := cliConnectDevice(ctx, conn, options, args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	char, err := conn.GetDeviceCharacteristic(device, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, fmt.Errorf("characteristic %s not found: %s", args[1], err.Error())
+	}
+
+	if err := char.WriteValue(value); err != nil {
+		return nil, err
+	}
+	return cliMessage{Address: device.Address(), Result: "wrote " + hex.EncodeToString(value) + " to " + char.UUID()}, nil
+}
+
+//cliNotify - Print notifications from a characteristic until the duration elapses or the command is interrupted
+func cliNotify(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	device, disconnect, err := cliConnectDevice(ctx, conn, options, args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	char, err := conn.GetDeviceCharacteristic(device, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, fmt.Errorf("characteristic %s not found: %s", args[1], err.Error())
+	}
+
+	if options.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(options.duration)*time.Second)
+		defer cancel()
+	}
+
+	values := make(chan []byte, 100)
+	if err := char.HandleNotify(func(value []byte) { values <- value }); err != nil {
+		return nil, err
+	}
+	defer conn.StopNotifications()
+
+	for {
+		select {
+		case value := <-values:
+			now := time.Now()
+			if err := printCLIResult(os.Stdout, cliValue{Address: device.Address(), Characteristic: char.UUID(), Value: value, Time: &now}, options.json); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+//cliPair - Pair with a device
+func cliPair(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	device, err := cliFindDevice(ctx, conn, options, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := device.Pair(); err != nil {
+		return nil, err
+	}
+	return cliMessage{Address: device.Address(), Result: "paired"}, nil
+}
+
+//cliRemove - Remove (unpair) a device
+func cliRemove(ctx context.Context, conn *cbble.Connection, options cliOptions, args []string) (cliResult, error) {
+	if err := conn.Update(); err != nil {
+		return nil, err
+	}
+
+	device, err := conn.GetDeviceByAddress(strings.ToUpper(args[0]))
+	if err != nil {
+		return nil, fmt.Errorf("device %s not found", args[0])
+	}
+
+	adapter, err := conn.GetAdapter()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := adapter.RemoveDevice(&device); err != nil {
+		return nil, err
+	}
+	return cliMessage{Address: device.Address(), Result: "removed"}, nil
+}
+
+//cliFindDevice - Find a device in the object cache. If the device is not found, discovery is
+//started until the device is found or the timeout elapses
+func cliFindDevice(ctx context.Context, conn *cbble.Connection, options cliOptions, address string) (cbble.Device, error) {
+	address = strings.ToUpper(address)
+
+	if err := conn.Update(); err != nil {
+		return nil, err
+	}
+	if device, err := conn.GetDeviceByAddress(address); err == nil {
+		return device, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(options.timeout)*time.Second)
+	defer cancel()
+
+	//Discovery runs until the context is cancelled. The signals are not needed
+	signals := conn.StartDiscovery(ctx, make(chan bool), cbble.DiscoveryFilter{})
+	if signals == nil {
+		return nil, errors.New("unable to start discovery")
+	}
+	go func() {
+		for range signals {
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("device %s not found", address)
+		case <-time.After(time.Second):
+			if err := conn.Update(); err != nil {
+				return nil, err
+			}
+			if device, err := conn.GetDeviceByAddress(address); err == nil {
+				return device, nil
+			}
+		}
+	}
+}
+
+//cliConnectDevice - Connect to a device and wait for its services to be resolved. The returned
+//function disconnects from the device, unless it was already connected or -stayConnected was specified
+func cliConnectDevice(ctx context.Context, conn *cbble.Connection, options cliOptions, address string) (cbble.Device, func(), error) {
+	device, err := cliFindDevice(ctx, conn, options, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	disconnect := func() {}
+	if !device.Connected() {
+		if err := device.Connect(); err != nil {
+			return nil, nil, err
+		}
+		if !options.stayConnected {
+			disconnect = func() { device.Disconnect() }
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(options.timeout)*time.Second)
+	defer cancel()
+
+	//The object cache must be refreshed for the ServicesResolved property to be updated
+	for !device.ServicesResolved() {
+		select {
+		case <-ctx.Done():
+			disconnect()
+			return nil, nil, fmt.Errorf("services of device %s were not resolved", device.Address())
+		case <-time.After(500 * time.Millisecond):
+			if err := conn.Update(); err != nil {
+				disconnect()
+				return nil, nil, err
+			}
+			if device, err = conn.GetDeviceByAddress(device.Address()); err != nil {
+				disconnect()
+				return nil, nil, err
+			}
+		}
+	}
+
+	return device, disconnect, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//Settings are resolved with the following precedence, lowest first:
+//
+//  1. The local configuration file specified with -config or BLE_ADAPTER_CONFIG
+//  2. BLE_ADAPTER_<FLAG NAME> environment variables, ex. BLE_ADAPTER_SYSTEM_SECRET
+//  3. Command line flags
+//
+//Adapter settings in the adapterConfig section of the configuration file are
+//overridden by the BLE_Adapter_Config collection.
+
+const (
+	configFlagName   = "config"
+	adapterConfigKey = "adapterConfig"
+	configEnvPrefix  = "BLE_ADAPTER_"
+)
+
+var (
+	configFile string
+
+	//Adapter settings read from the adapterConfig section of the configuration file
+	adapterConfig map[string]interface{}
+
+	//Flags specified on the command line, in an environment variable or in the configuration file
+	specifiedFlags = map[string]bool{}
+)
+
+//loadConfig - Apply the configuration file and environment variables to every flag
+//that was not specified on the command line
+func loadConfig() error {
+	flag.Visit(func(f *flag.Flag) {
+		specifiedFlags[f.Name] = true
+	})
+
+	if !specifiedFlags[configFlagName] {
+		configFile = os.Getenv(envName(configFlagName))
+	}
+
+	fileSettings := map[string]interface{}{}
+	if configFile != "" {
+		var err error
+		if fileSettings, err = readConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+
+	if settings, ok := fileSettings[adapterConfigKey]; ok {
+		theSettings, err := toStringMap(settings)
+		if err != nil {
+			return fmt.Errorf("%s: Invalid %s section: %s", configFile, adapterConfigKey, err.Error())
+		}
+		adapterConfig = theSettings
+		delete(fileSettings, adapterConfigKey)
+	}
+
+	for name := range fileSettings {
+		if name == configFlagName || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: Unknown setting \"%s\"", configFile, name)
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == configFlagName || specifiedFlags[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		source := "environment variable " + envName(f.Name)
+		if !ok {
+			var fileValue interface{}
+			if fileValue, ok = fileSettings[f.Name]; ok {
+				value = fmt.Sprint(fileValue)
+				source = configFile
+			}
+		}
+		if !ok {
+			return
+		}
+
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: Invalid value \"%s\" for %s: %s", source, value, f.Name, setErr.Error())
+			return
+		}
+		specifiedFlags[f.Name] = true
+	})
+	return err
+}
+
+//readConfigFile - Read a JSON or YAML configuration file. The format is determined by the file extension
+func readConfigFile(fileName string) (map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		err = json.Unmarshal(contents, &settings)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &settings)
+	default:
+		return nil, fmt.Errorf("%s: Unsupported configuration file format. Expected .json, .yaml or .yml", fileName)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+	return settings, nil
+}
+
+//toStringMap - Convert a section of a configuration file to a map. YAML decodes nested maps with interface{} keys
+func toStringMap(value interface{}) (map[string]interface{}, error) {
+	switch theMap := value.(type) {
+	case map[string]interface{}:
+		return theMap, nil
+	case map[interface{}]interface{}:
+		settings := map[string]interface{}{}
+		for key, elem := range theMap {
+			settings[fmt.Sprint(key)] = elem
+		}
+		return settings, nil
+	}
+	return nil, errors.New("expected a map of settings")
+}
+
+//envName - Return the environment variable used to specify a flag, ex. platformURL is BLE_ADAPTER_PLATFORM_URL
+func envName(flagName string) string {
+	name := configEnvPrefix
+	previous := ' '
+	for _, char := range flagName {
+		if unicode.IsUpper(char) && unicode.IsLower(previous) {
+			name += "_"
+		}
+		name += string(unicode.ToUpper(char))
+		previous = char
+	}
+	return name
+}
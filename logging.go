@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/logutils"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+//Log destinations and formats
+const (
+	logDestinationFile     = "file"
+	logDestinationStdout   = "stdout"
+	logDestinationJournald = "journald"
+	logDestinationSyslog   = "syslog"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	journalSocket = "/run/systemd/journal/socket"
+	syslogTag     = "bleadapter"
+)
+
+var (
+	logLevels = []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR"}
+
+	//Bluetooth addresses are logged either as 00:0B:57:36:73:9F or as part of a
+	//DBUS object path, /org/bluez/hci0/dev_00_0B_57_36_73_9F
+	addressRegex   = regexp.MustCompile(`([0-9A-Fa-f]{2}[:_]){5}[0-9A-Fa-f]{2}`)
+	commandIDRegex = regexp.MustCompile(`\bcommandId=(\S+)`)
+)
+
+//logEntry - A single log message, split into the fields included in structured logs
+type logEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Subsystem string    `json:"subsystem,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Message   string    `json:"message"`
+	Address   string    `json:"address,omitempty"`
+	CommandID string    `json:"commandId,omitempty"`
+
+	tagged bool //Was the level specified in the message, ex. [DEBUG]
+}
+
+//logWriter - Writes the output of the standard logger to the configured destination and format
+type logWriter struct {
+	format  string
+	output  io.Writer
+	syslog  *syslog.Writer
+	journal net.Conn
+}
+
+//initLogging - Direct the standard logger to the destination and format specified on the command line.
+//The returned closer flushes and closes the destination.
+func initLogging() (io.Closer, error) {
+	writer := &logWriter{format: logFormat}
+
+	var closer io.Closer
+	switch logDestination {
+	case logDestinationFile:
+		//Ensure the log file can be written to before rotating log files are created
+		file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("error opening log file: %s. Use -logDestination stdout, journald or syslog on read-only file systems", err.Error())
+		}
+		file.Close()
+
+		rotatingFile := &lumberjack.Logger{
+			Filename:   logFile,
+			MaxSize:    logMaxSize, // megabytes
+			MaxBackups: logMaxBackups,
+			MaxAge:     logMaxAge, //days
+			Compress:   logCompress,
+		}
+		writer.output = rotatingFile
+		closer = rotatingFile
+	case logDestinationStdout:
+		writer.output = os.Stdout
+	case logDestinationSyslog:
+		syslogWriter, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogTag)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to syslog: %s", err.Error())
+		}
+		writer.syslog = syslogWriter
+		closer = syslogWriter
+	case logDestinationJournald:
+		conn, err := net.Dial("unixgram", journalSocket)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to journald: %s", err.Error())
+		}
+		writer.journal = conn
+		closer = conn
+	default:
+		return nil, errors.New("invalid log destination " + logDestination)
+	}
+
+	//The file and line are always logged. Timestamps are added by the logWriter
+	log.SetFlags(log.Llongfile)
+	log.SetOutput(&logutils.LevelFilter{
+		Levels:   logLevels,
+		MinLevel: logutils.LogLevel(strings.ToUpper(logLevel)),
+		Writer:   writer,
+	})
+
+	if closer == nil {
+		closer = writer
+	}
+	return closer, nil
+}
+
+//Write - Write a line produced by the standard logger
+func (writer *logWriter) Write(p []byte) (int, error) {
+	entry := parseLogEntry(string(p))
+
+	var err error
+	switch {
+	case writer.journal != nil:
+		err = writer.writeJournal(entry)
+	case writer.syslog != nil:
+		err = writer.writeSyslog(entry)
+	default:
+		_, err = writer.output.Write([]byte(writer.formatEntry(entry, true) + "\n"))
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing log message: %s\n", err.Error())
+	}
+	return len(p), nil
+}
+
+//Close - Nothing needs to be released when logging to stdout
+func (writer *logWriter) Close() error {
+	return nil
+}
+
+//formatEntry - Format an entry as text or json
+func (writer *logWriter) formatEntry(entry logEntry, includeTime bool) string {
+	if writer.format == logFormatJSON {
+		entryJSON, err := json.Marshal(entry)
+		if err == nil {
+			return string(entryJSON)
+		}
+	}
+
+	//Text entries resemble the output of log.LstdFlags|log.Lshortfile
+	text := entry.Source + ": " + entry.Message
+	if entry.tagged {
+		text = entry.Source + ": [" + strings.ToUpper(entry.Level) + "] " + entry.Message
+	}
+	if includeTime {
+		text = entry.Time.Format("2006/01/02 15:04:05") + " " + text
+	}
+	return text
+}
+
+func (writer *logWriter) writeSyslog(entry logEntry) error {
+	message := writer.formatEntry(entry, false)
+	switch entry.Level {
+	case "debug":
+		return writer.syslog.Debug(message)
+	case "warn":
+		return writer.syslog.Warning(message)
+	case "error":
+		return writer.syslog.Err(message)
+	}
+	return writer.syslog.Info(message)
+}
+
+//writeJournal - Send an entry to journald using the native protocol, so that the
+//structured fields can be queried with journalctl, ex. journalctl BLE_ADDRESS=00:0B:57:36:73:9F
+func (writer *logWriter) writeJournal(entry logEntry) error {
+	priority := map[string]string{"debug": "7", "info": "6", "warn": "4", "error": "3"}[entry.Level]
+	if priority == "" {
+		priority = "6"
+	}
+
+	fields := [][2]string{
+		{"MESSAGE", entry.Message},
+		{"PRIORITY", priority},
+		{"SYSLOG_IDENTIFIER", syslogTag},
+		{"CODE_FILE", entry.Source},
+		{"SUBSYSTEM", entry.Subsystem},
+	}
+	if entry.Address != "" {
+		fields = append(fields, [2]string{"BLE_ADDRESS", entry.Address})
+	}
+	if entry.CommandID != "" {
+		fields = append(fields, [2]string{"COMMAND_ID", entry.CommandID})
+	}
+
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if !strings.Contains(field[1], "\n") {
+			buf.WriteString(field[0] + "=" + field[1] + "\n")
+			continue
+		}
+		//Values containing newlines are sent with their length as a little endian 64 bit integer
+		buf.WriteString(field[0] + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(field[1])))
+		buf.WriteString(field[1] + "\n")
+	}
+
+	_, err := writer.journal.Write(buf.Bytes())
+	return err
+}
+
+//parseLogEntry - Split a line written by the standard logger, using the log.Llongfile flag, into its fields.
+//ex. /src/ble-adapter-go/bleadapter/bleadapter.go:123: [DEBUG] Received BLE read Command commandId=1
+func parseLogEntry(line string) logEntry {
+	entry := logEntry{
+		Time:    time.Now(),
+		Level:   "info",
+		Message: strings.TrimRight(line, "\n"),
+	}
+
+	if ndx := strings.Index(entry.Message, ".go:"); ndx >= 0 {
+		if end := strings.Index(entry.Message[ndx:], ": "); end >= 0 {
+			file := entry.Message[:ndx+end]
+			entry.Message = entry.Message[ndx+end+2:]
+			entry.Source = filepath.Base(file)
+			entry.Subsystem = strings.TrimSuffix(filepath.Base(file[:ndx+3]), ".go")
+		}
+	}
+
+	if strings.HasPrefix(entry.Message, "[") {
+		if end := strings.Index(entry.Message, "]"); end > 0 {
+			entry.Level = strings.ToLower(entry.Message[1:end])
+			entry.tagged = true
+			entry.Message = strings.TrimSpace(entry.Message[end+1:])
+		}
+	}
+
+	if address := addressRegex.FindString(entry.Message); address != "" {
+		entry.Address = strings.ToUpper(strings.Replace(address, "_", ":", -1))
+	}
+	if match := commandIDRegex.FindStringSubmatch(entry.Message); match != nil {
+		entry.CommandID = match[1]
+	}
+
+	return entry
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	lumberjack "gopkg.in/natefinch/lumberjack.v2"
-
-	"github.com/clearblade/BLE-ADAPTER-GO/bleadapter"
 	cb "github.com/clearblade/Go-SDK"
-	"github.com/hashicorp/logutils"
+	"github.com/clearblade/ble-adapter-go/bleadapter"
 )
 
 var (
@@ -24,51 +24,146 @@ var (
 	scanInterval int
 	logLevel     string
 
+	logDestination string
+	logFormat      string
+	logFile        string
+	logMaxSize     int
+	logMaxBackups  int
+	logMaxAge      int
+	logCompress    bool
+
+	//Generic MQTT broker settings, used when transport is mqtt
+	transportType          string
+	brokerURL              string
+	mqttUsername           string
+	mqttPassword           string
+	mqttClientID           string
+	mqttProtocolVersion    uint
+	mqttCACert             string
+	mqttClientCert         string
+	mqttClientKey          string
+	mqttInsecureSkipVerify bool
+
+	//DBUS recording and replay settings
+	recordFile   string
+	replayFile   string
+	replaySpeed  float64
+	replayOutput string
+
+	//Device registry settings
+	registryFile   string
+	registryMaxAge int
+
 	deviceClient *cb.DeviceClient
 )
 
 const (
 	platURL = "http://localhost:9000"
 	messURL = "localhost:1883"
+
+	transportClearBlade = "clearblade"
+	transportMQTT       = "mqtt"
 )
 
 func init() {
-	flag.StringVar(&sysKey, "systemKey", "", "system key (required)")
-	flag.StringVar(&sysSec, "systemSecret", "", "system secret (required)")
+	flag.StringVar(&sysKey, "systemKey", "", "system key (required when transport is clearblade)")
+	flag.StringVar(&sysSec, "systemSecret", "", "system secret (required when transport is clearblade)")
 	flag.StringVar(&deviceName, "deviceName", "", "name of device (required)")
-	flag.StringVar(&password, "password", "", "password (or active key) for device authentication (required)")
+	flag.StringVar(&password, "password", "", "password (or active key) for device authentication (required when transport is clearblade)")
 	flag.StringVar(&platformURL, "platformURL", platURL, "platform url (optional)")
 	flag.StringVar(&messagingURL, "messagingURL", messURL, "messaging URL (optional)")
 	flag.IntVar(&scanInterval, "scanInterval", 360, "The number of seconds to scan for BLE devices (optional)")
-	flag.StringVar(&logLevel, "logLevel", "warn", "The level of logging to use. Available levels are 'debug', 'warn', 'error' (optional)")
+	flag.StringVar(&logLevel, "logLevel", "warn", "The level of logging to use. Available levels are 'debug', 'info', 'warn', 'error' (optional)")
+	flag.StringVar(&logDestination, "logDestination", logDestinationFile, "Where to write log messages. Available destinations are 'file', 'stdout', 'journald', 'syslog' (optional)")
+	flag.StringVar(&logFormat, "logFormat", logFormatText, "The format of log messages. Available formats are 'text', 'json' (optional)")
+	flag.StringVar(&logFile, "logFile", "/var/log/bleadapter.log", "The log file to write to when logDestination is 'file' (optional)")
+	flag.IntVar(&logMaxSize, "logMaxSize", 10, "The size, in megabytes, at which the log file is rotated (optional)")
+	flag.IntVar(&logMaxBackups, "logMaxBackups", 5, "The number of rotated log files to keep (optional)")
+	flag.IntVar(&logMaxAge, "logMaxAge", 28, "The number of days to keep rotated log files (optional)")
+	flag.BoolVar(&logCompress, "logCompress", false, "Compress rotated log files using gzip (optional)")
+	flag.StringVar(&configFile, configFlagName, "", "JSON or YAML configuration file (optional)")
+	flag.StringVar(&transportType, "transport", transportClearBlade, "The messaging backend to use. Available transports are 'clearblade', 'mqtt' (optional)")
+	flag.StringVar(&brokerURL, "brokerURL", "", "The url of the MQTT broker, ex. tcp://localhost:1883 or ssl://localhost:8883 (required when transport is mqtt)")
+	flag.StringVar(&mqttUsername, "mqttUsername", "", "The username used to authenticate to the MQTT broker (optional)")
+	flag.StringVar(&mqttPassword, "mqttPassword", "", "The password used to authenticate to the MQTT broker (optional)")
+	flag.StringVar(&mqttClientID, "mqttClientID", "", "The MQTT client id. Defaults to bleadapter_<deviceName> (optional)")
+	flag.UintVar(&mqttProtocolVersion, "mqttProtocolVersion", 4, "The MQTT protocol version, 3 (MQTT 3.1), 4 (MQTT 3.1.1) or 5 (MQTT 5) (optional)")
+	flag.StringVar(&mqttCACert, "mqttCACert", "", "PEM file containing the CA certificates used to verify the MQTT broker (optional)")
+	flag.StringVar(&mqttClientCert, "mqttClientCert", "", "PEM file containing the client certificate used to authenticate to the MQTT broker (optional)")
+	flag.StringVar(&mqttClientKey, "mqttClientKey", "", "PEM file containing the private key of the client certificate (optional)")
+	flag.BoolVar(&mqttInsecureSkipVerify, "mqttInsecureSkipVerify", false, "Do not verify the certificate of the MQTT broker (optional)")
+	flag.StringVar(&recordFile, "recordFile", "", "Record the DBUS signals and method replies seen by the adapter to the specified file (optional)")
+	flag.StringVar(&replayFile, "replayFile", "", "Replay a recording created with -recordFile rather than scanning for devices. No platform credentials are required (optional)")
+	flag.Float64Var(&replaySpeed, "replaySpeed", 0, "The speed at which a recording is replayed. 1 replays signals with the recorded delays, 0 replays them without delay (optional)")
+	flag.StringVar(&registryFile, "registryFile", "", "The file the device registry is saved to, ex. /var/lib/bleadapter/devices.json. By default the registry is kept in memory only (optional)")
+	flag.IntVar(&registryMaxAge, "registryMaxAge", 30, "The number of days a device remains in the device registry after it was last seen. 0 keeps devices forever (optional)")
+	flag.StringVar(&replayOutput, "replayOutput", "", "The file the messages published while replaying are written to. Defaults to stdout (optional)")
 }
 
 func usage() {
-	log.Printf("Usage: ble-adapter [options]\n\n")
+	log.Printf("Usage: ble-adapter [options]\n       ble-adapter <command> [options] [arguments]\n\n")
 	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr)
+	cliUsage(os.Stderr)
 }
 
 func validateFlags() {
 	flag.Parse()
-	if sysKey == "" ||
-		sysSec == "" ||
-		deviceName == "" ||
-		password == "" {
+
+	if err := loadConfig(); err != nil {
+		log.Printf("[ERROR] Invalid configuration: %s\n\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := bleadapter.SetLocalConfig(adapterConfig); err != nil {
+		log.Printf("[ERROR] Invalid configuration: %s\n\n", err.Error())
+		os.Exit(1)
+	}
+
+	if transportType != transportClearBlade && transportType != transportMQTT {
+		log.Printf("[ERROR] Invalid transport specified\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if replayFile != "" {
+		if recordFile != "" {
+			log.Printf("[ERROR] -recordFile cannot be used with -replayFile\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if deviceName == "" ||
+		(transportType == transportClearBlade && (sysKey == "" || sysSec == "" || password == "")) ||
+		(transportType == transportMQTT && brokerURL == "") {
 
 		log.Printf("[ERROR] Missing required flags\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if logLevel != "error" && logLevel != "warn" && logLevel != "debug" {
+	if logLevel != "error" && logLevel != "warn" && logLevel != "info" && logLevel != "debug" {
 		log.Printf("[ERROR] Invalid log level specified\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	if logDestination != logDestinationFile && logDestination != logDestinationStdout &&
+		logDestination != logDestinationJournald && logDestination != logDestinationSyslog {
+		log.Printf("[ERROR] Invalid log destination specified\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if logFormat != logFormatText && logFormat != logFormatJSON {
+		log.Printf("[ERROR] Invalid log format specified\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
 }
 
-//ClearBlade Device Client init helper
-func initCbDeviceClient() {
+//ClearBlade Device Client init helper. Authentication is retried every minute until it succeeds
+//or ctx is cancelled
+func initCbDeviceClient(ctx context.Context) error {
 	log.Printf("[DEBUG] setting platform URL to %s", platformURL)
 	log.Printf("[DEBUG] setting messaging URL to %s", messagingURL)
 
@@ -79,50 +174,128 @@ func initCbDeviceClient() {
 		log.Printf("[WARN] Will retry in 1 minute...")
 
 		// sleep 1 minute
-		time.Sleep(time.Duration(time.Minute * 1))
+		select {
+		case <-time.After(time.Minute):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		_, err = deviceClient.Authenticate()
 	}
+	return nil
+}
+
+//initTransport - Create the messaging backend specified on the command line. Returns an error if
+//ctx is cancelled before the ClearBlade device client authenticates
+func initTransport(ctx context.Context) (bleadapter.Transport, error) {
+	if transportType == transportMQTT {
+		log.Printf("[DEBUG] setting broker URL to %s", brokerURL)
+		clientID := mqttClientID
+		if clientID == "" {
+			clientID = "bleadapter_" + deviceName
+		}
+
+		return bleadapter.NewMQTTTransport(bleadapter.MQTTOptions{
+			BrokerURL:          brokerURL,
+			ClientID:           clientID,
+			Username:           mqttUsername,
+			Password:           mqttPassword,
+			ProtocolVersion:    mqttProtocolVersion,
+			TopicPrefix:        deviceName,
+			CACertFile:         mqttCACert,
+			CertFile:           mqttClientCert,
+			KeyFile:            mqttClientKey,
+			InsecureSkipVerify: mqttInsecureSkipVerify,
+		})
+	}
+
+	log.Printf("[DEBUG] Initializing CB device client")
+	if err := initCbDeviceClient(ctx); err != nil {
+		return nil, err
+	}
+	return bleadapter.NewClearBladeTransport(deviceClient), nil
 }
 
 func main() {
+	//Field debugging subcommands run standalone, without connecting to the platform
+	if len(os.Args) > 1 && isCLICommand(os.Args[1]) {
+		os.Exit(runCLICommand(os.Args[1], os.Args[2:]))
+	}
+
 	flag.Usage = usage
 	log.Printf("Validating command line options")
 	validateFlags()
 
-	_, err := os.OpenFile("/var/log/bleadapter.log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
-
+	logCloser, err := initLogging()
 	if err != nil {
-		log.Printf("error opening file: %s", err.Error())
+		log.Printf("[ERROR] %s", err.Error())
 		os.Exit(1)
 	}
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	bleAdapter := bleadapter.BleAdapter{
+		RecordingFile:  recordFile,
+		RegistryFile:   registryFile,
+		RegistryMaxAge: time.Duration(registryMaxAge) * 24 * time.Hour,
+	}
 
-	//Set rolling log files
-	// log.SetOutput(&lumberjack.Logger{
-	// 	Filename:   "/var/log/bleadapter.log",
-	// 	MaxSize:    10, // megabytes
-	// 	MaxBackups: 5,
-	// 	MaxAge:     28, //days
-	// })
+	//Cancel the adapter context when SIGINT or SIGTERM is received so that
+	//the adapter can clean up before exiting
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("[DEBUG] Received signal %s, shutting down", sig)
+		cancel()
 
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"DEBUG", "WARN", "ERROR"},
-		MinLevel: logutils.LogLevel(strings.ToUpper(logLevel)),
-		Writer: &lumberjack.Logger{
-			Filename:   "/var/log/bleadapter.log",
-			MaxSize:    10, // megabytes
-			MaxBackups: 5,
-			MaxAge:     28, //days
-		},
-	}
-	log.SetOutput(filter)
+		//A second signal terminates immediately
+		sig = <-signals
+		log.Printf("[WARN] Received signal %s during shutdown, exiting", sig)
+		logCloser.Close()
+		os.Exit(1)
+	}()
 
-	bleAdapter := bleadapter.BleAdapter{}
+	//Messages published while replaying a recording are written to a local sink
+	var transport bleadapter.Transport
+	if replayFile != "" {
+		output := os.Stdout
+		if replayOutput != "" {
+			if output, err = os.Create(replayOutput); err != nil {
+				log.Printf("[ERROR] %s", err.Error())
+				os.Exit(1)
+			}
+			defer output.Close()
+		}
+		transport = bleadapter.NewSinkTransport(output)
+	} else if transport, err = initTransport(ctx); err != nil {
+		//The adapter was stopped before it could connect
+		if ctx.Err() != nil {
+			log.Printf("[DEBUG] BLE Adapter stopped")
+			logCloser.Close()
+			return
+		}
+		log.Printf("[ERROR] %s", err.Error())
+		os.Exit(1)
+	}
 
-	log.Printf("[DEBUG] Initializing CB device client")
-	initCbDeviceClient()
+	if replayFile != "" {
+		err := bleAdapter.Replay(ctx, transport, replayFile, replaySpeed)
+		if err != nil {
+			log.Printf("[ERROR] Unable to replay %s: %s", replayFile, err.Error())
+		}
+		logCloser.Close()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 
 	log.Printf("[DEBUG] Starting BLE Adapter")
-	bleAdapter.Start(deviceClient, scanInterval)
+	//Only override the adapter configuration if a scan interval was specified
+	if !specifiedFlags["scanInterval"] {
+		scanInterval = 0
+	}
+	bleAdapter.Start(ctx, transport, scanInterval)
+
+	log.Printf("[DEBUG] BLE Adapter stopped")
+	logCloser.Close()
 }